@@ -3,137 +3,614 @@ package api
 import (
 	"context"
 	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/health"
+	"event-delivery-kafka/api/idempotency"
+	"event-delivery-kafka/api/ratelimit"
 	"event-delivery-kafka/api/server"
+	"event-delivery-kafka/api/tracking"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/delivery/circuitbreaker"
 	"event-delivery-kafka/delivery/destinations/mocks"
 	backoffStr "event-delivery-kafka/kafka/backoff"
 	"event-delivery-kafka/kafka/components"
 	"event-delivery-kafka/kafka/processors"
+	"event-delivery-kafka/kafka/serde"
+	"event-delivery-kafka/logging"
+	"event-delivery-kafka/metrics"
 	"event-delivery-kafka/models"
+	"event-delivery-kafka/tracing"
 	"fmt"
-	"github.com/cenkalti/backoff/v4"
 	"github.com/segmentio/kafka-go"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 type App struct {
-	Port               string
-	Topic              string
-	BrokerAddress      string
-	DestinationTimeout time.Duration
-	Destinations       []mocks.Destination
+	Port                string
+	GRPCPort            string // port of the gRPC API, disabled when empty
+	Topic               string
+	BrokerAddress       string
+	DestinationTimeout  time.Duration
+	Destinations        []mocks.Destination
+	IdempotencyStore    string // "memory" (default) or "file"
+	IdempotencyFile     string // path of the file used by the "file" idempotency store
+	IdempotencyTTL      time.Duration
+	SchemaDir           string            // directory with one json schema per event type, payloads are not validated when empty
+	APIKeys             map[string]string // principal id -> API key
+	HMACSecrets         map[string]string // key id (principal id) -> shared secret of signed requests
+	HMACMaxSkew         time.Duration     // max age of a signed request, nonces are remembered for this window
+	UserRateLimit       ratelimit.Config  // events per user, disabled when Rate is 0
+	CredentialRateLimit ratelimit.Config  // requests per API key / HMAC key id, disabled when Rate is 0
+	MaxEventBytes       int64             // max size of a single (decompressed) event
+	MaxBodyBytes        int64             // max size of a (decompressed) request body, also of signed bodies
+	AsyncQueueSize      int               // max events accepted asynchronously and not yet written to kafka
+	AsyncWorkers        int               // goroutines writing the events accepted asynchronously
+	TrackingTTL         time.Duration     // how long the delivery status of an async event is kept, async ingest is disabled when 0
+	ValueFormat         string            // "raw" (default), "json", "avro" or "protobuf", see serde.Serializer
+	SchemaRegistryURL   string            // Confluent compatible schema registry of the value schemas, in-process when empty
+	ShutdownTimeout     time.Duration     // max time to finish requests and deliveries in progress on shutdown, 30s when 0
+	ReadinessTimeout    time.Duration     // max time of every check of /readyz, 2s when 0
+	Tracing             tracing.Config    // exporter of the spans, spans are not exported by default
+	Logger              *zap.Logger       // optional, logger of the app, the API and the deliveries
+	KafkaLogger         *zap.Logger       // optional, logger of the internal logs of the Kafka readers and writers
+	RetryTopicDelays    []time.Duration   // delays of the retry topics of every destination (like 1m, 10m, 1h), retries are in place when empty
+
+	RetryPolicy    backoffStr.PolicyConfig            // retry policy of the destinations, the exponential backoff when empty
+	RetryPolicies  map[string]backoffStr.PolicyConfig // retry policy of a destination by its name, instead of RetryPolicy
+	CircuitBreaker circuitbreaker.Config              // circuit breaker of every destination, disabled when FailureThreshold is 0
+	Batch          components.BatchConfig             // batches of the destinations, events are delivered one by one when MaxSize is 0 or 1
+	Batches        map[string]components.BatchConfig  // batches of a destination by its name, instead of Batch
+
+	valueRegistry serde.Registry
+	metrics       *metrics.Metrics         // shared by the server, the producer and the consumers, exposed at /metrics
+	consumers     []*components.Consumer   // one per destination and per retry topic of the destination, in the order of Destinations
+	circuits      *circuitbreaker.Registry // breakers of the destinations, exposed at /circuits, nil when disabled
+	stopConsuming context.CancelFunc
 }
 
-func (a *App) Run() {
+/*
+Runs the app until SIGINT or SIGTERM (or until a listener fails) and then shuts it down gracefully, in order:
+1. the REST and gRPC APIs stop accepting requests, finish the requests in progress and write the queued async events
+2. consumers stop fetching and finish the delivery of their current message, with its retries
+3. offsets of the delivered messages are committed
+4. the producer is flushed and closed and the readers are closed
+Steps 1-3 share ShutdownTimeout, deliveries still retrying at the deadline are aborted without committing their
+offset, so their messages are delivered again after restart. Returns nil after a shutdown on a signal.
+*/
+func (a *App) Run() error {
+	a.Logger = logging.OrNop(a.Logger)
+	tracerProvider, err := tracing.Provider{}.New(a.Tracing)
+	if err != nil {
+		return err
+	}
+	defer a.shutdownTracing(tracerProvider)
+
+	a.metrics = metrics.Metrics{}.New()
+	a.circuits = a.createCircuits()
 	a.checkIfTopicExistsAndCreate(a.BrokerAddress)
 	a.createAndStartConsumers()
 
-	mux := http.NewServeMux()
-	s := server.Server{
-		Mux:      mux,
-		Producer: a.createProducer(),
+	producer := a.createProducer()
+	idempotencyStore := a.createIdempotencyStore()
+	s := &server.Server{
+		Mux:                   http.NewServeMux(),
+		Producer:              producer,
+		IdempotencyStore:      idempotencyStore,
+		SchemaRegistry:        a.createSchemaRegistry(),
+		Authenticator:         a.createAuthenticator(),
+		UserRateLimiter:       createRateLimiter("user", a.UserRateLimit),
+		CredentialRateLimiter: createRateLimiter("credential", a.CredentialRateLimit),
+		MaxEventBytes:         a.MaxEventBytes,
+		MaxBodyBytes:          a.MaxBodyBytes,
+		Tracker:               a.createTracker(),
+		AsyncQueueSize:        a.AsyncQueueSize,
+		AsyncWorkers:          a.AsyncWorkers,
+		Readiness:             a.createReadiness(producer),
+		Metrics:               a.metrics,
+		Circuits:              a.circuits,
+		Logger:                a.Logger,
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	serveErrors := make(chan error, 2)
+	go func() {
+		serveErrors <- s.Initialize(a.Port)
+	}()
+	if a.GRPCPort != "" {
+		go func() {
+			serveErrors <- s.InitializeGRPC(a.GRPCPort)
+		}()
+	}
+
+	select {
+	case sig := <-signals:
+		a.Logger.Info("shutting down", zap.String("signal", sig.String()))
+	case err = <-serveErrors:
+		a.Logger.Error("failed to serve, shutting down", zap.Error(err))
+	}
+
+	a.shutdown(s, producer, idempotencyStore)
+	return err
+}
+
+func (a *App) shutdown(s *server.Server, producer *components.Producer, idempotencyStore idempotency.Store) {
+	timeout := a.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		a.Logger.Error("failed to shutdown server", zap.Error(err))
+	}
+
+	a.stopConsuming()
+	for _, consumer := range a.consumers {
+		if err := consumer.Shutdown(ctx); err != nil {
+			a.Logger.Warn("consumer did not finish its delivery", zap.String("consumer", consumer.Name()), zap.Error(err))
+		}
+	}
+
+	if err := producer.Close(); err != nil {
+		a.Logger.Error("failed to close producer", zap.Error(err))
+	}
+	for _, consumer := range a.consumers {
+		if err := consumer.Close(); err != nil {
+			a.Logger.Error("failed to close consumer", zap.Error(err))
+		}
+	}
+	if closer, ok := idempotencyStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			a.Logger.Error("failed to close idempotency store", zap.Error(err))
+		}
+	}
+	a.Logger.Info("shutdown completed")
+}
+
+// exports the spans of the shutdown too, so it runs after it with a timeout of its own
+func (a *App) shutdownTracing(tracerProvider *tracing.Provider) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		a.Logger.Error("failed to export spans", zap.Error(err))
 	}
-	s.Initialize(a.Port)
 }
 
 func (a *App) createProducer() *components.Producer {
-	producerConfig := components.ProducerConfig{
+	producer := components.Producer{}.New(a.Topic, a.BrokerAddress, a.producerConfig())
+	serializer, err := serde.ForFormat(a.ValueFormat, a.createValueRegistry())
+	if err != nil {
+		panic(err.Error())
+	}
+	producer.Serializer = serializer
+	producer.Metrics = a.metrics
+	return producer
+}
+
+func (a *App) producerConfig() components.ProducerConfig {
+	return components.ProducerConfig{
 		Balancer:     &kafka.Murmur2Balancer{}, //ensures that messages with the same key are routed to the same partition
 		WriteTimeout: 5 * time.Second,
 		ReadTimeout:  5 * time.Second,
 		RequiredAcks: kafka.RequireAll, // wait for all kafka nodes to acknowledge the writes
-		Logger:       log.New(os.Stdout, "kafka writer: ", 0),
+		Logger:       a.Logger,
+		KafkaLogger:  a.KafkaLogger,
 	}
+}
 
-	return components.Producer{}.New(a.Topic, a.BrokerAddress, producerConfig)
+/*
+Producer and consumers share the registry of the value schemas. The in-process registry is only for local runs,
+because values written by other processes (or before a restart) can not be decoded with it.
+*/
+func (a *App) createValueRegistry() serde.Registry {
+	if a.valueRegistry != nil {
+		return a.valueRegistry
+	}
+	if a.SchemaRegistryURL == "" {
+		a.valueRegistry = serde.MemoryRegistry{}.New()
+	} else {
+		a.valueRegistry = serde.RegistryClient{}.New(a.SchemaRegistryURL, 5*time.Second)
+	}
+	return a.valueRegistry
+}
+
+/*
+Idempotency keys are kept in memory by default. The file store keeps them across restarts.
+App can not deduplicate requests if the file can not be opened. In such a case, app should stop working (panic)
+*/
+func (a *App) createIdempotencyStore() idempotency.Store {
+	ttl := a.IdempotencyTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+
+	switch a.IdempotencyStore {
+	case "", "memory":
+		return idempotency.MemoryStore{}.New(ttl)
+	case "file":
+		store, err := idempotency.FileStore{}.New(a.IdempotencyFile, ttl)
+		if err != nil {
+			panic(err.Error())
+		}
+		return store
+	default:
+		panic(fmt.Sprintf("unknown idempotency store %s", a.IdempotencyStore))
+	}
+}
+
+/*
+App should not accept events that can not be validated, so an invalid schema directory stops the app (panic)
+*/
+func (a *App) createSchemaRegistry() *validation.SchemaRegistry {
+	if a.SchemaDir == "" {
+		return nil
+	}
+
+	registry := validation.SchemaRegistry{}.New()
+	if err := registry.LoadDir(a.SchemaDir); err != nil {
+		panic(err.Error())
+	}
+	return registry
+}
+
+/*
+Requests are authenticated with static API keys and/or HMAC signatures. When no credentials are configured,
+authentication is disabled (only for local development).
+*/
+func (a *App) createAuthenticator() auth.Authenticator {
+	var chain auth.Chain
+	if len(a.APIKeys) > 0 {
+		chain = append(chain, auth.APIKeyAuthenticator{}.New(a.APIKeys))
+	}
+	if len(a.HMACSecrets) > 0 {
+		maxSkew := a.HMACMaxSkew
+		if maxSkew == 0 {
+			maxSkew = 5 * time.Minute
+		}
+		maxBodyBytes := a.MaxBodyBytes
+		if maxBodyBytes == 0 {
+			maxBodyBytes = 10 << 20
+		}
+		chain = append(chain, auth.HMACAuthenticator{}.New(a.HMACSecrets, maxSkew, maxBodyBytes))
+	}
+
+	if len(chain) == 0 {
+		a.Logger.Warn("no API keys or HMAC secrets configured, authentication of /events is disabled")
+		return nil
+	}
+	return chain
+}
+
+func (a *App) createTracker() *tracking.Tracker {
+	if a.TrackingTTL <= 0 {
+		return nil
+	}
+	return tracking.Tracker{}.New(a.TrackingTTL)
+}
+
+func createRateLimiter(name string, config ratelimit.Config) *ratelimit.Limiter {
+	if config.Rate <= 0 {
+		return nil
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	return ratelimit.Limiter{}.New(name, config)
 }
 
+/*
+Starts a consumer for every destination, and with retry topics a consumer for every retry topic of every destination.
+Every consumer has a group of its own, so they keep their own offsets. A failed event moves from the topic of the
+events to the retry topics in the order of RetryTopicDelays, and to the dead-letter topic after the last one. The
+consumers of a destination share its circuit breaker, so they all pause while its circuit is open.
+*/
 func (a *App) createAndStartConsumers() {
-	for i, _ := range a.Destinations {
-		consumerConfig := components.ConsumerConfig{
-			GroupID:     "event-delivery-kafka-" + a.Destinations[i].Name(), //different group Id for each consumer. Destination name should be unique
-			MinBytes:    10e3,                                             // 10KB
-			MaxBytes:    10e6,                                             // 10MB
-			StartOffset: kafka.FirstOffset,
-			Logger:      log.New(os.Stdout, fmt.Sprintf("kafka reader for groupId : event-delivery-kafka-%s", a.Destinations[i].Name()), 0),
+	ctx, stopConsuming := context.WithCancel(context.Background())
+	a.stopConsuming = stopConsuming
+	for _, destination := range a.Destinations {
+		breaker := a.createBreaker(destination.Name())
+		action := withCircuitBreaker(breaker, a.createConsumerAction(destination))
+		batchAction := withCircuitBreakerBatch(breaker, a.createConsumerBatchAction(destination))
+		stages := a.consumerStages(destination.Name())
+		for i, stage := range stages {
+			consumerConfig := components.ConsumerConfig{
+				GroupID:     stage.groupID,
+				MinBytes:    10e3, // 10KB
+				MaxBytes:    10e6, // 10MB
+				StartOffset: kafka.FirstOffset,
+				Logger:      a.Logger,
+				KafkaLogger: a.KafkaLogger,
+				Destination: destination.Name(),
+				Metrics:     a.metrics,
+				DeadLetter:  components.Producer{}.New(components.DeadLetterTopic(a.Topic, destination.Name()), a.BrokerAddress, a.producerConfig()),
+				Delay:       stage.delay,
+				Breaker:     breaker,
+				Batch:       a.createBatchConfig(destination.Name()),
+			}
+			if i+1 < len(stages) {
+				consumerConfig.Retry = components.Producer{}.New(stages[i+1].topic, a.BrokerAddress, a.producerConfig())
+			}
+
+			consumer := components.Consumer{}.New(
+				stage.topic,
+				a.BrokerAddress,
+				consumerConfig,
+				&processors.Processor{Action: action, BatchAction: batchAction},
+				a.createRetryPolicy(destination.Name()),
+			)
+			a.consumers = append(a.consumers, consumer)
+			go consumer.Consume(ctx)
 		}
+	}
+}
+
+// topic read by a consumer of a destination, with the group and the delay of the consumer
+type consumerStage struct {
+	topic   string
+	groupID string
+	delay   time.Duration
+}
 
-		backoffStrategy := a.createBackOffStrategy()
+// the topic of the events, followed by the retry topics of the destination
+func (a *App) consumerStages(destination string) []consumerStage {
+	groupID := "event-delivery-kafka-" + destination //different group Id for each consumer. Destination name should be unique
+	stages := []consumerStage{{topic: a.Topic, groupID: groupID}}
+	for _, delay := range a.RetryTopicDelays {
+		stages = append(stages, consumerStage{
+			topic:   components.RetryTopic(a.Topic, destination, delay),
+			groupID: groupID + "-retry-" + components.FormatDelay(delay),
+			delay:   delay,
+		})
+	}
+	return stages
+}
 
-		consumer := components.Consumer{}.New(
-			a.Topic,
-			a.BrokerAddress,
-			consumerConfig,
-			processors.Processor{}.New(a.createConsumerAction(a.Destinations[i])),
-			*backoffStrategy,
-		)
-		go consumer.Consume(context.Background())
+func (a *App) createConsumerAction(dest mocks.Destination) func(ctx context.Context, message kafka.Message) error {
+	batchAction := a.createConsumerBatchAction(dest)
+	return func(ctx context.Context, message kafka.Message) error {
+		return delivery.EventErrors(batchAction(ctx, []kafka.Message{message}), 1)[0]
 	}
 }
 
-func (a *App) createConsumerAction(dest mocks.Destination) func(message kafka.Message) error {
-	return func(message kafka.Message) error {
-		ev := models.Event{}.New(string(message.Key), string(message.Value))
+/*
+Delivers the messages with a single call of the destination. Messages that can not be decoded are not sent and fail
+with a permanent error, then the error is a delivery.BatchError, like the error of a destination that failed only some
+of the events.
+*/
+func (a *App) createConsumerBatchAction(dest mocks.Destination) func(ctx context.Context, messages []kafka.Message) error {
+	serializers := serde.Serializers(a.createValueRegistry())
+	return func(ctx context.Context, messages []kafka.Message) error {
+		failed := map[int]error{}
+		var decoded []kafka.Message
+		var events []models.Event
+		var indexes []int // of the decoded messages
+		for i, message := range messages {
+			ev, err := components.DecodeEvent(message, serializers)
+			if err != nil {
+				// the message will never be decoded, retrying can not help
+				failed[i] = delivery.Permanent(err)
+				continue
+			}
+			decoded = append(decoded, message)
+			events = append(events, *ev)
+			indexes = append(indexes, i)
+		}
+
+		if len(events) > 0 {
+			err := a.receive(ctx, dest, decoded, events)
+			var batchErr *delivery.BatchError
+			if err != nil && !errors.As(err, &batchErr) && len(failed) == 0 {
+				return err
+			}
+			for i, eventErr := range delivery.EventErrors(err, len(events)) {
+				if eventErr != nil {
+					failed[indexes[i]] = eventErr
+				}
+			}
+		}
+		if len(failed) > 0 {
+			return delivery.PartiallyFailed(failed)
+		}
+		return nil
+	}
+}
 
-		result := make(chan error, 1)
+// calls the destination once with the events of the messages, the call fails when it does not return within DestinationTimeout
+func (a *App) receive(ctx context.Context, dest mocks.Destination, messages []kafka.Message, events []models.Event) error {
+	attributes := []attribute.KeyValue{attribute.String("destination", dest.Name()), attribute.Int("messaging.batch.message_count", len(events))}
+	if len(events) == 1 {
+		attributes = append(attributes, attribute.String("event.id", events[0].EventID))
+	}
+	_, span := tracing.Tracer().Start(ctx, dest.Name()+" receive", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+	start := time.Now()
+	result := make(chan error, 1)
+	if cloudEventsDest, ok := dest.(mocks.CloudEventsDestination); ok {
+		cloudEvents := make([]models.CloudEvent, len(events))
+		for i := range events {
+			cloudEvents[i] = components.CloudEventFromEvent(messages[i], events[i])
+		}
+		go func() {
+			result <- cloudEventsDest.ReceiveCloudEvents(cloudEvents...)
+		}()
+	} else {
 		go func() {
-			result <- dest.Receive(*ev)
+			result <- dest.Receive(events...)
 		}()
+	}
 
-		select {
-		case <-time.After(a.DestinationTimeout):
-			log.Printf("failed to send message: %v for key %s \n", dest.Name()+" : timed out", string(message.Key))
-			return errors.New(dest.Name() + " : timed out")
-		case res := <-result:
-			if res != nil {
-				log.Printf("failed to send message: %v for key %s \n", res.Error(), string(message.Key))
-				return errors.New(res.Error())
-			}
-			return nil
+	select {
+	case <-time.After(a.DestinationTimeout):
+		a.metrics.DeliveryAttempt(dest.Name(), time.Since(start), metrics.AttemptTimeout)
+		err := delivery.Retryable(errors.New(dest.Name() + " : timed out"))
+		tracing.End(span, err)
+		return err
+	case res := <-result:
+		if res != nil {
+			a.metrics.DeliveryAttempt(dest.Name(), time.Since(start), metrics.AttemptError)
+			tracing.End(span, res)
+			return res
 		}
+		a.metrics.DeliveryAttempt(dest.Name(), time.Since(start), metrics.AttemptSuccess)
+		tracing.End(span, nil)
+		return nil
+	}
+}
+
+// registry of the circuit breakers of the destinations, nil when they are disabled
+func (a *App) createCircuits() *circuitbreaker.Registry {
+	if a.CircuitBreaker.FailureThreshold <= 0 {
+		return nil
 	}
+	config := a.CircuitBreaker
+	config.Logger = a.Logger
+	return circuitbreaker.Registry{}.New(config)
 }
 
+// circuit breaker of the destination, nil when circuit breakers are disabled
+func (a *App) createBreaker(destination string) *circuitbreaker.Breaker {
+	if a.circuits == nil {
+		return nil
+	}
+	return a.circuits.Breaker(destination)
+}
+
+/*
+The actions run only when the circuit of the destination lets them through, and return circuitbreaker.ErrOpen
+otherwise. Without breaker, they always run.
+*/
+func withCircuitBreaker(breaker *circuitbreaker.Breaker, action func(ctx context.Context, message kafka.Message) error) func(ctx context.Context, message kafka.Message) error {
+	return func(ctx context.Context, message kafka.Message) error {
+		return breaker.Execute(func() error {
+			return action(ctx, message)
+		})
+	}
+}
+
+func withCircuitBreakerBatch(breaker *circuitbreaker.Breaker, action func(ctx context.Context, messages []kafka.Message) error) func(ctx context.Context, messages []kafka.Message) error {
+	return func(ctx context.Context, messages []kafka.Message) error {
+		return breaker.Execute(func() error {
+			return action(ctx, messages)
+		})
+	}
+}
+
+// creates the topic of the events and the retry and dead-letter topics of every destination, when they do not exist
 func (a *App) checkIfTopicExistsAndCreate(brokerAddress string) {
+	topics := []*components.Topic{a.createTopic()}
+	for _, destination := range a.Destinations {
+		for _, delay := range a.RetryTopicDelays {
+			topics = append(topics, a.createRetryTopic(destination.Name(), delay))
+		}
+		topics = append(topics, a.createDeadLetterTopic(destination.Name()))
+	}
+	for _, topic := range topics {
+		if !topic.TopicExists(topic.Name(), brokerAddress) {
+			topic.CreateTopic(brokerAddress)
+		}
+	}
+}
+
+func (a *App) createTopic() *components.Topic {
+	return newTopic(a.Topic, "24")
+}
+
+// dead letters are kept for a week, so they can be inspected and replayed
+func (a *App) createDeadLetterTopic(destination string) *components.Topic {
+	return newTopic(components.DeadLetterTopic(a.Topic, destination), "168")
+}
+
+// retry topics keep their messages for a week too, so delays can be hours long
+func (a *App) createRetryTopic(destination string, delay time.Duration) *components.Topic {
+	return newTopic(components.RetryTopic(a.Topic, destination, delay), "168")
+}
+
+func newTopic(name string, retentionHours string) *components.Topic {
 	config := []kafka.ConfigEntry{{
 		ConfigName:  "log.retention.hours",
-		ConfigValue: "24",
+		ConfigValue: retentionHours,
 	}}
 
 	topicConfig := components.TopicConfig{
-		Topic:             a.Topic,
+		Topic:             name,
 		NumPartitions:     10,
 		ReplicationFactor: 1,
 		ConfigEntries:     config,
 	}
 
-	topic := components.Topic{}.New(topicConfig)
-	if !topic.TopicExists(a.Topic, brokerAddress) {
-		topic.CreateTopic(brokerAddress)
-	}
+	return components.Topic{}.New(topicConfig)
 }
 
 /*
-Custom implementation of exponential backoff strategy to achieve the following time periods to choose randomly when to
-run the next try. With existing implementation, use custom properties is not allowed.
-[0.125sec , 0.375sec]	1st retry
-[0.1875sec , 0.5625sec]	2nd retry
-[0.2812sec , 0.843sec]	3rd retry
+The app is ready when the broker answers, the topic exists, the producer can write to every partition of the topic
+and the consumer of every destination is still running. A consumer stops only when its reader fails, so the pod should
+stop receiving traffic until it is restarted.
+*/
+func (a *App) createReadiness(producer *components.Producer) *health.Checker {
+	timeout := a.ReadinessTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
 
-For more information, check documentation in github.com/cenkalti/backoff/v4@v4.1.3/exponential.go:16
+	topic := a.createTopic()
+	checks := []health.Check{
+		{Name: "broker", Check: func(ctx context.Context) error {
+			return components.PingBroker(ctx, a.BrokerAddress)
+		}},
+		{Name: "topic", Check: func(ctx context.Context) error {
+			exists, err := topic.Exists(ctx, a.BrokerAddress)
+			if err == nil && !exists {
+				err = fmt.Errorf("topic %s does not exist", a.Topic)
+			}
+			return err
+		}},
+		{Name: "producer", Check: producer.Writable},
+	}
+	for i := range a.consumers {
+		consumer, name := a.consumers[i], a.consumers[i].Name()
+		checks = append(checks, health.Check{Name: "consumer/" + name, Check: func(ctx context.Context) error {
+			if !consumer.Running() {
+				return errors.New("consumer of " + name + " is not running")
+			}
+			return nil
+		}})
+	}
+	return health.Checker{}.New(timeout, checks...)
+}
+
+/*
+Retry policy of the destination, from RetryPolicies or else RetryPolicy. Every consumer gets a policy of its own, because
+policies keep the state of the backoff of the current message.
 */
-func (a *App) createBackOffStrategy() *backoffStr.ExponentialBackOffWithRetries {
-	config := backoffStr.ExponentialBackOffWithRetriesConfig{
-		InitialInterval:     250 * time.Millisecond,
-		RandomizationFactor: 0.5,
-		Multiplier:          1.5,
-		MaxInterval:         900 * time.Millisecond,
-		MaxElapsedTime:      4 * time.Second,
-		Stop:                -1,
-		Clock:               backoff.SystemClock,
-	}
-
-	return backoffStr.ExponentialBackOffWithRetries{}.New(3, config)
+func (a *App) createRetryPolicy(destination string) backoffStr.RetryPolicy {
+	config, ok := a.RetryPolicies[destination]
+	if !ok {
+		config = a.RetryPolicy
+	}
+	config.Logger = a.Logger
+	policy, err := backoffStr.ForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return policy
+}
+
+// batches of the destination, from Batches or else Batch
+func (a *App) createBatchConfig(destination string) components.BatchConfig {
+	if config, ok := a.Batches[destination]; ok {
+		return config
+	}
+	return a.Batch
 }
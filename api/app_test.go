@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"errors"
+	"event-delivery-kafka/delivery"
 	"event-delivery-kafka/delivery/destinations/mocks"
 	"event-delivery-kafka/kafka/components"
 	"event-delivery-kafka/models"
@@ -81,6 +82,30 @@ func (des *DestinationMock) Name() string {
 	return des.NameDest
 }
 
+// receives the events as CloudEvents, like a webhook or an event router
+type CloudEventsDestinationMock struct {
+	NameDest string
+	Received []models.CloudEvent
+}
+
+func (des *CloudEventsDestinationMock) Receive(event ...models.Event) error {
+	return delivery.Permanent(errors.New("cloudevents destinations should receive cloudevents"))
+}
+
+func (des *CloudEventsDestinationMock) ReceiveCloudEvents(event ...models.CloudEvent) error {
+	for i := range event {
+		if err := event[i].Validate(); err != nil {
+			return delivery.Permanent(err)
+		}
+	}
+	des.Received = append(des.Received, event...)
+	return nil
+}
+
+func (des *CloudEventsDestinationMock) Name() string {
+	return des.NameDest
+}
+
 /*
 GIVEN
 Destination fails for each request.
@@ -90,6 +115,7 @@ Two events produced to Kafka
 
 THEN
 4 attempts (1 and 3 retires) for each event to sent to destination
+and both events written to the dead-letter topic of the destination
 */
 func TestDestinationFailedRepeatedly(t *testing.T) {
 	runner := func(args ...int) error {
@@ -115,6 +141,8 @@ func TestDestinationFailedRepeatedly(t *testing.T) {
 	}
 
 	assert.Equal(t, true, createTopic(topicName, os.Getenv("BROKER_ADDRESS")))
+	deadLetterTopic := components.DeadLetterTopic(topicName, des.Name())
+	assert.Equal(t, true, createTopic(deadLetterTopic, os.Getenv("BROKER_ADDRESS")))
 
 	app.createAndStartConsumers()
 	producer := app.createProducer()
@@ -177,6 +205,23 @@ func TestDestinationFailedRepeatedly(t *testing.T) {
 	//4th attempt for key user_test_2
 	assert.Equal(t, "user_test_2", des.RequestsReceivedHistory[7].UserId)
 	assert.Equal(t, "failed", des.RequestsReceivedHistory[7].Status)
+
+	//both events are written to the dead-letter topic of the destination after the retries
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{os.Getenv("BROKER_ADDRESS")},
+		Topic:   deadLetterTopic,
+	})
+	defer reader.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range []string{"user_test_1", "user_test_2"} {
+		deadLetter, err := reader.ReadMessage(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(deadLetter.Key))
+		assert.Equal(t, des.Name(), components.HeaderValue(deadLetter, components.HeaderDeadLetterDestination))
+		assert.Equal(t, "4", components.HeaderValue(deadLetter, components.HeaderDeadLetterAttempts))
+		assert.Equal(t, topicName, components.HeaderValue(deadLetter, components.HeaderDeadLetterTopic))
+	}
 }
 
 /*
@@ -472,6 +517,58 @@ func TestDestinationFailedAndThenSucceed(t *testing.T) {
 	assert.Equal(t, "success", des.RequestsReceivedHistory[1].Status)
 }
 
+/*
+GIVEN
+Destination receives CloudEvents
+
+WHEN
+One event, that was not sent as a CloudEvent, produced to Kafka
+
+THEN
+the destination receives it as a valid CloudEvent with the default source and type and the user id as partitionkey
+*/
+func TestCloudEventsDestinationReceivesCloudEvents(t *testing.T) {
+	des := CloudEventsDestinationMock{NameDest: "destination_cloudevents" + uuid.New().String()}
+	destinations := []mocks.Destination{&des}
+
+	topicName := uuid.New().String() //unique topic name for each test
+	app := App{
+		Port:               os.Getenv("PORT"),
+		Topic:              topicName,
+		BrokerAddress:      os.Getenv("BROKER_ADDRESS"),
+		DestinationTimeout: 500 * time.Millisecond,
+		Destinations:       destinations,
+	}
+
+	assert.Equal(t, true, createTopic(topicName, os.Getenv("BROKER_ADDRESS")))
+
+	app.createAndStartConsumers()
+	producer := app.createProducer()
+
+	kafkaMessage1 := kafka.Message{
+		Key:   []byte("user_test_1"),
+		Value: []byte(`{"x": 1}`),
+		Time:  time.Now(),
+	}
+
+	_ = producer.Writer.WriteMessages(context.Background(), kafkaMessage1)
+
+	//wait max 60 sec and check. If destination has received the event then break
+	for i := 0; i < 60; i++ {
+		if len(des.Received) >= 1 {
+			time.Sleep(1 * time.Second)
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	assert.Equal(t, 1, len(des.Received))
+	assert.Equal(t, "/event-delivery-kafka", des.Received[0].Source)
+	assert.Equal(t, "event-delivery-kafka.event", des.Received[0].Type)
+	assert.Equal(t, "user_test_1", des.Received[0].Extensions["partitionkey"])
+	assert.Equal(t, `{"x": 1}`, string(des.Received[0].Data))
+}
+
 /*
 Topic should have ONLY ONE partition to preserve ordering of messages
 to have the test passed
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+/*
+Authenticates requests with static API keys, sent with header X-API-Key or as a bearer token
+(Authorization: Bearer <key>). Only the sha256 of every key is kept, so lookups do not compare secrets
+byte by byte.
+*/
+type APIKeyAuthenticator struct {
+	principals map[string]string // sha256 of key -> principal id
+}
+
+// keys maps every principal id to its API key
+func (APIKeyAuthenticator) New(keys map[string]string) *APIKeyAuthenticator {
+	principals := make(map[string]string, len(keys))
+	for principal, key := range keys {
+		principals[hashKey(key)] = principal
+	}
+	return &APIKeyAuthenticator{principals: principals}
+}
+
+func (authenticator *APIKeyAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	key := request.Header.Get(APIKeyHeader)
+	if key == "" {
+		authorization := request.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return nil, nil
+		}
+		key = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	principal, ok := authenticator.principals[hashKey(key)]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{ID: principal, Method: "api_key"}, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrMissingCredentials = errors.New("request does not carry any credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+/*
+Principal is the authenticated client that sent a request. ID is attached to the produced Kafka messages, so
+destinations know who sent every event.
+*/
+type Principal struct {
+	ID     string
+	Method string // "api_key" or "hmac"
+}
+
+/*
+Authenticator verifies the credentials of a request.
+It returns (nil, nil) when the request does not carry credentials of its kind, so authenticators can be chained.
+*/
+type Authenticator interface {
+	Authenticate(request *http.Request) (*Principal, error)
+}
+
+/*
+Chain tries every authenticator in order and returns the principal of the first one that recognises the credentials
+of the request. ErrMissingCredentials is returned when none of them does.
+*/
+type Chain []Authenticator
+
+func (chain Chain) Authenticate(request *http.Request) (*Principal, error) {
+	for _, authenticator := range chain {
+		principal, err := authenticator.Authenticate(request)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+	return nil, ErrMissingCredentials
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// returns nil when the request was not authenticated (authentication is disabled)
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
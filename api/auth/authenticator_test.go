@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	authenticator := APIKeyAuthenticator{}.New(map[string]string{"mobile_sdk": "key_1"})
+
+	request, _ := http.NewRequest("PUT", "/events", nil)
+	principal, err := authenticator.Authenticate(request)
+	assert.Nil(t, err)
+	assert.Nil(t, principal)
+
+	request.Header.Set(APIKeyHeader, "key_1")
+	principal, err = authenticator.Authenticate(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "mobile_sdk", principal.ID)
+
+	request, _ = http.NewRequest("PUT", "/events", nil)
+	request.Header.Set("Authorization", "Bearer key_2")
+	_, err = authenticator.Authenticate(request)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestHMACAuthentication(t *testing.T) {
+	authenticator := HMACAuthenticator{}.New(map[string]string{"billing_service": "secret_1"}, 5*time.Minute, 1<<20)
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+
+	request := signedRequest("secret_1", "nonce_1", time.Now(), body)
+	principal, err := authenticator.Authenticate(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "billing_service", principal.ID)
+
+	// body is still available for the handler
+	bodyBytes, _ := ioutil.ReadAll(request.Body)
+	assert.Equal(t, body, string(bodyBytes))
+
+	// same nonce can not be used again
+	_, err = authenticator.Authenticate(signedRequest("secret_1", "nonce_1", time.Now(), body))
+	assert.Equal(t, ErrReplayedNonce, err)
+}
+
+func TestHMACAuthenticationWithInvalidRequests(t *testing.T) {
+	authenticator := HMACAuthenticator{}.New(map[string]string{"billing_service": "secret_1"}, 5*time.Minute, 1<<20)
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+
+	_, err := authenticator.Authenticate(signedRequest("secret_2", "nonce_1", time.Now(), body))
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	_, err = authenticator.Authenticate(signedRequest("secret_1", "nonce_2", time.Now().Add(-10*time.Minute), body))
+	assert.Equal(t, ErrRequestExpired, err)
+
+	_, err = authenticator.Authenticate(signedRequest("secret_1", "nonce_4", time.Now(), strings.Repeat("a", 1<<20+1)))
+	assert.Equal(t, ErrBodyTooLarge, err)
+
+	tampered := signedRequest("secret_1", "nonce_3", time.Now(), body)
+	tampered.Body = ioutil.NopCloser(strings.NewReader("{\"user_id\": \"user_test_2\", \"payload\": \"event click !!!!\"}"))
+	_, err = authenticator.Authenticate(tampered)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestHMACAuthenticationWithSignedDigest(t *testing.T) {
+	authenticator := HMACAuthenticator{}.New(map[string]string{"billing_service": "secret_1"}, 5*time.Minute, 1024)
+	body := strings.Repeat("{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}\n", 100)
+
+	// the body is larger than maxBodyBytes, but it is not read before the handler
+	request := withDigest(signedRequest("secret_1", "nonce_1", time.Now(), body), body)
+	principal, err := authenticator.Authenticate(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "billing_service", principal.ID)
+	bodyBytes, err := ioutil.ReadAll(request.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(bodyBytes))
+
+	// a tampered body fails only when it is read to its end
+	tampered := withDigest(signedRequest("secret_1", "nonce_2", time.Now(), body), body)
+	tampered.Body = ioutil.NopCloser(strings.NewReader(body + body))
+	_, err = authenticator.Authenticate(tampered)
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(tampered.Body)
+	assert.Equal(t, ErrBodyTampered, err)
+
+	// the tampered body did not use the nonce, the original request with it is still accepted once
+	original := withDigest(signedRequest("secret_1", "nonce_2", time.Now(), body), body)
+	_, err = authenticator.Authenticate(original)
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(original.Body)
+	assert.Nil(t, err)
+	replayed := withDigest(signedRequest("secret_1", "nonce_2", time.Now(), body), body)
+	_, err = authenticator.Authenticate(replayed)
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(replayed.Body)
+	assert.Equal(t, ErrReplayedNonce, err)
+
+	// the digest is part of the signature
+	forged := withDigest(signedRequest("secret_1", "nonce_3", time.Now(), body), body+body)
+	_, err = authenticator.Authenticate(forged)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	invalid := signedRequest("secret_1", "nonce_4", time.Now(), body)
+	invalid.Header.Set(HMACDigestHeader, "not hex")
+	_, err = authenticator.Authenticate(invalid)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestChainWithoutCredentials(t *testing.T) {
+	chain := Chain{
+		APIKeyAuthenticator{}.New(map[string]string{"mobile_sdk": "key_1"}),
+		HMACAuthenticator{}.New(map[string]string{"billing_service": "secret_1"}, 5*time.Minute, 1<<20),
+	}
+
+	request, _ := http.NewRequest("PUT", "/events", nil)
+	_, err := chain.Authenticate(request)
+	assert.Equal(t, ErrMissingCredentials, err)
+}
+
+func signedRequest(secret string, nonce string, signedAt time.Time, body string) *http.Request {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	request, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	request.Header.Set(HMACKeyIDHeader, "billing_service")
+	request.Header.Set(HMACTimestampHeader, timestamp)
+	request.Header.Set(HMACNonceHeader, nonce)
+	request.Header.Set(HMACSignatureHeader, hex.EncodeToString(Sign([]byte(secret), "PUT", "/events", timestamp, nonce, []byte(body))))
+	return request
+}
+
+func withDigest(request *http.Request, body string) *http.Request {
+	digest := sha256.Sum256([]byte(body))
+	request.Header.Set(HMACDigestHeader, hex.EncodeToString(digest[:]))
+	return request
+}
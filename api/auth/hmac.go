@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HMACKeyIDHeader     = "X-Auth-Key-Id"
+	HMACTimestampHeader = "X-Auth-Timestamp"
+	HMACNonceHeader     = "X-Auth-Nonce"
+	HMACSignatureHeader = "X-Auth-Signature"
+	HMACDigestHeader    = "X-Auth-Content-Sha256"
+)
+
+var (
+	ErrRequestExpired = errors.New("request timestamp is outside of the allowed window")
+	ErrReplayedNonce  = errors.New("nonce has already been used")
+	ErrBodyTooLarge   = errors.New("signed request body too large")
+	ErrBodyTampered   = errors.New("request body does not match its signed digest")
+)
+
+/*
+Authenticates requests signed with a shared secret. Clients send the headers
+X-Auth-Key-Id     : id of the secret, it is also the principal id
+X-Auth-Timestamp  : unix time in seconds when the request was signed
+X-Auth-Nonce      : random value, unique for every request
+X-Auth-Signature  : hex(hmac-sha256(secret, method + "\n" + request uri + "\n" + timestamp + "\n" + nonce + "\n" + hex(sha256(body))))
+
+Requests older (or newer) than maxSkew are rejected, and every nonce is accepted only once within that window,
+so a captured request can not be replayed.
+Clients can send the hex(sha256(body)) of the signature in header X-Auth-Content-Sha256. The signature is then
+verified before the body is read, and the body is hashed while the handler reads it: a body that does not match
+the digest fails with ErrBodyTampered when it is read to its end, and the nonce is used only then, so a tampered
+copy of a request can not burn the nonce of the original. Handlers must not act on such a body before its end (see
+VerifiedAtEnd). Without the header the body has to be read to verify the signature, so signed bodies larger than
+maxBodyBytes are rejected.
+*/
+type HMACAuthenticator struct {
+	secrets      map[string][]byte
+	maxSkew      time.Duration
+	maxBodyBytes int64
+	nonces       *nonceCache
+	now          func() time.Time
+}
+
+// secrets maps every key id (principal id) to its shared secret
+func (HMACAuthenticator) New(secrets map[string]string, maxSkew time.Duration, maxBodyBytes int64) *HMACAuthenticator {
+	secretBytes := make(map[string][]byte, len(secrets))
+	for keyID, secret := range secrets {
+		secretBytes[keyID] = []byte(secret)
+	}
+
+	return &HMACAuthenticator{
+		secrets:      secretBytes,
+		maxSkew:      maxSkew,
+		maxBodyBytes: maxBodyBytes,
+		nonces:       &nonceCache{nonces: make(map[string]time.Time)},
+		now:          time.Now,
+	}
+}
+
+func (authenticator *HMACAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	signature := request.Header.Get(HMACSignatureHeader)
+	if signature == "" {
+		return nil, nil
+	}
+
+	keyID := request.Header.Get(HMACKeyIDHeader)
+	timestamp := request.Header.Get(HMACTimestampHeader)
+	nonce := request.Header.Get(HMACNonceHeader)
+	secret, ok := authenticator.secrets[keyID]
+	if !ok || nonce == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	now := authenticator.now()
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-authenticator.maxSkew)) || signedAt.After(now.Add(authenticator.maxSkew)) {
+		return nil, ErrRequestExpired
+	}
+
+	// nonces are used after the signature is verified, so unsigned requests can not fill the cache
+	useNonce := func() error {
+		if !authenticator.nonces.add(keyID+"/"+nonce, now, 2*authenticator.maxSkew) {
+			return ErrReplayedNonce
+		}
+		return nil
+	}
+
+	var verifyingBody *digestVerifyingBody
+	bodyHash := strings.ToLower(request.Header.Get(HMACDigestHeader))
+	if bodyHash != "" {
+		digest, err := hex.DecodeString(bodyHash)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, ErrInvalidCredentials
+		}
+		verifyingBody = &digestVerifyingBody{ReadCloser: request.Body, hash: sha256.New(), digest: digest, verified: useNonce}
+	} else {
+		// the body is part of the signature, so it is read here and restored for the handler
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, authenticator.maxBodyBytes+1))
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > authenticator.maxBodyBytes {
+			return nil, ErrBodyTooLarge
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		digest := sha256.Sum256(body)
+		bodyHash = hex.EncodeToString(digest[:])
+	}
+
+	expected := signDigest(secret, request.Method, request.URL.RequestURI(), timestamp, nonce, bodyHash)
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, expected) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if verifyingBody != nil {
+		request.Body = verifyingBody
+	} else if err := useNonce(); err != nil {
+		return nil, err
+	}
+
+	return &Principal{ID: keyID, Method: "hmac"}, nil
+}
+
+func Sign(secret []byte, method string, requestURI string, timestamp string, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return signDigest(secret, method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+}
+
+func signDigest(secret []byte, method string, requestURI string, timestamp string, nonce string, bodyHash string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + bodyHash))
+	return mac.Sum(nil)
+}
+
+// returns true when the body of request is verified against its signed digest only when it is read to its end
+func VerifiedAtEnd(request *http.Request) bool {
+	_, ok := request.Body.(*digestVerifyingBody)
+	return ok
+}
+
+/*
+Reads what is left of a body that is verified at its end and returns the error of the verification, so handlers
+that decode the body (a decompressor can stop before the end of its input) never skip it. Nil for other bodies.
+*/
+func VerifyBody(request *http.Request) error {
+	body, ok := request.Body.(*digestVerifyingBody)
+	if !ok {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, body)
+	return err
+}
+
+/*
+Hashes the body while it is read and fails with ErrBodyTampered instead of io.EOF when it does not match digest.
+verified is called once when it does (it uses the nonce of the request), and its error is returned instead of io.EOF.
+*/
+type digestVerifyingBody struct {
+	io.ReadCloser
+	hash     hash.Hash
+	digest   []byte
+	verified func() error
+	result   error // io.EOF or the error of the verification, once the body is read to its end
+}
+
+func (body *digestVerifyingBody) Read(p []byte) (int, error) {
+	if body.result != nil {
+		return 0, body.result
+	}
+
+	n, err := body.ReadCloser.Read(p)
+	body.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	body.result = io.EOF
+	if !hmac.Equal(body.hash.Sum(nil), body.digest) {
+		body.result = ErrBodyTampered
+	} else if err := body.verified(); err != nil {
+		body.result = err
+	}
+	return n, body.result
+}
+
+type nonceCache struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time // nonce -> expiration
+	nextSweep time.Time
+}
+
+// returns false if the nonce has already been added and has not expired yet
+func (cache *nonceCache) add(nonce string, now time.Time, ttl time.Duration) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if now.After(cache.nextSweep) {
+		for n, expiresAt := range cache.nonces {
+			if now.After(expiresAt) {
+				delete(cache.nonces, n)
+			}
+		}
+		cache.nextSweep = now.Add(ttl)
+	}
+
+	if expiresAt, ok := cache.nonces[nonce]; ok && now.Before(expiresAt) {
+		return false
+	}
+	cache.nonces[nonce] = now.Add(ttl)
+	return true
+}
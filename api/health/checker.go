@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusFailed      = "failed"
+	StatusUnavailable = "unavailable"
+)
+
+/*
+Check of a dependency, it returns nil when the dependency is usable.
+*/
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type Report struct {
+	Status string        `json:"status"` // ok when every check is ok, unavailable otherwise
+	Checks []CheckResult `json:"checks"`
+}
+
+/*
+Runs all the checks concurrently, every one of them with the timeout of the checker, so a hanging dependency can not
+block the readiness probe.
+*/
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+func (Checker) New(timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+func (checker *Checker) Run(ctx context.Context) Report {
+	results := make([]CheckResult, len(checker.checks))
+	var wg sync.WaitGroup
+	for i := range checker.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = checker.run(ctx, checker.checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+func (checker *Checker) run(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, checker.timeout)
+	defer cancel()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	checkResult := CheckResult{Name: check.Name, Status: StatusOK, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		checkResult.Status = StatusFailed
+		checkResult.Error = err.Error()
+	}
+	return checkResult
+}
@@ -0,0 +1,43 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReportIsOKWhenEveryCheckIsOK(t *testing.T) {
+	checker := Checker{}.New(1*time.Second,
+		Check{Name: "broker", Check: func(ctx context.Context) error { return nil }},
+		Check{Name: "topic", Check: func(ctx context.Context) error { return nil }},
+	)
+
+	report := checker.Run(context.Background())
+	assert.Equal(t, StatusOK, report.Status)
+	assert.Equal(t, 2, len(report.Checks))
+	assert.Equal(t, "broker", report.Checks[0].Name)
+	assert.Equal(t, StatusOK, report.Checks[0].Status)
+	assert.Equal(t, "topic", report.Checks[1].Name)
+}
+
+func TestReportIsUnavailableWhenACheckFails(t *testing.T) {
+	checker := Checker{}.New(50*time.Millisecond,
+		Check{Name: "broker", Check: func(ctx context.Context) error { return errors.New("connection refused") }},
+		Check{Name: "topic", Check: func(ctx context.Context) error { return nil }},
+		Check{Name: "consumer/postgres", Check: func(ctx context.Context) error {
+			time.Sleep(1 * time.Second) // ignores ctx, the checker does not wait for it
+			return nil
+		}},
+	)
+
+	start := time.Now()
+	report := checker.Run(context.Background())
+	assert.True(t, time.Since(start) < 1*time.Second)
+	assert.Equal(t, StatusUnavailable, report.Status)
+	assert.Equal(t, CheckResult{Name: "broker", Status: StatusFailed, Error: "connection refused", DurationMs: report.Checks[0].DurationMs}, report.Checks[0])
+	assert.Equal(t, StatusOK, report.Checks[1].Status)
+	assert.Equal(t, StatusFailed, report.Checks[2].Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[2].Error)
+}
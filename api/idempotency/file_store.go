@@ -0,0 +1,149 @@
+package idempotency
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the file is not compacted while running before it has this many lines
+const minCompactLines = 1000
+
+type fileEntry struct {
+	Key      string   `json:"key"`
+	Response Response `json:"response"`
+}
+
+/*
+File-backed dedup store, so keys survive restarts of the app. Every Set appends one json line to the file and keeps
+the entry in memory for lookups. On start the file is loaded and compacted (expired entries are dropped), and while
+running it is compacted again whenever it has more than twice the lines of the keys in memory, so its size follows the
+keys that have not expired.
+*/
+type FileStore struct {
+	*MemoryStore
+	path  string
+	file  *os.File
+	lines int // lines of the file, including the ones of replaced and expired keys
+}
+
+func (FileStore) New(path string, ttl time.Duration) (*FileStore, error) {
+	memoryStore := MemoryStore{}.New(ttl)
+	if err := load(path, memoryStore); err != nil {
+		return nil, err
+	}
+	if err := compact(path, memoryStore); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		MemoryStore: memoryStore,
+		path:        path,
+		file:        file,
+		lines:       len(memoryStore.entries),
+	}, nil
+}
+
+func (store *FileStore) Set(key string, response Response) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	response.ExpiresAt = store.now().Add(store.ttl)
+	line, err := json.Marshal(fileEntry{Key: key, Response: response})
+	if err != nil {
+		return err
+	}
+	if _, err := store.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	store.lines++
+
+	// put sweeps the expired keys, then the file can be compacted
+	store.put(key, response)
+	if store.lines >= minCompactLines && store.lines > 2*len(store.entries) {
+		return store.reopenCompacted()
+	}
+	return nil
+}
+
+// rewrites the file with the keys in memory and appends to the new file
+func (store *FileStore) reopenCompacted() error {
+	if err := compact(store.path, store.MemoryStore); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(store.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	store.file.Close()
+	store.file = file
+	store.lines = len(store.entries)
+	return nil
+}
+
+func (store *FileStore) Close() error {
+	return store.file.Close()
+}
+
+func load(path string, memoryStore *MemoryStore) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := memoryStore.now()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var entry fileEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // a partially written last line after a crash
+		}
+		if !entry.Response.expired(now) {
+			memoryStore.entries[entry.Key] = entry.Response
+		}
+	}
+	return scanner.Err()
+}
+
+/*
+Rewrites the file with only the loaded (not expired) entries. A temporary file is renamed over the old one, so a
+crash during compaction never loses the existing keys.
+*/
+func compact(path string, memoryStore *MemoryStore) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for key, response := range memoryStore.entries {
+		line, err := json.Marshal(fileEntry{Key: key, Response: response})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
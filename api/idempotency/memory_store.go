@@ -0,0 +1,66 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+)
+
+const sweepInterval = 1 * time.Minute
+
+/*
+In-memory dedup store. Keys are lost on restart, so a retry that reaches a new instance of the app is produced again
+(which is still fine for at-least-once delivery). Expired keys are removed lazily on Get and periodically on Set.
+*/
+type MemoryStore struct {
+	mu        *sync.Mutex
+	ttl       time.Duration
+	entries   map[string]Response
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+func (MemoryStore) New(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		mu:      &sync.Mutex{},
+		ttl:     ttl,
+		entries: make(map[string]Response),
+		now:     time.Now,
+	}
+}
+
+func (store *MemoryStore) Get(key string) (Response, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	response, ok := store.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+	if response.expired(store.now()) {
+		delete(store.entries, key)
+		return Response{}, false
+	}
+	return response, true
+}
+
+func (store *MemoryStore) Set(key string, response Response) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	response.ExpiresAt = store.now().Add(store.ttl)
+	store.put(key, response)
+	return nil
+}
+
+func (store *MemoryStore) put(key string, response Response) {
+	now := store.now()
+	if now.After(store.nextSweep) {
+		for k, r := range store.entries {
+			if r.expired(now) {
+				delete(store.entries, k)
+			}
+		}
+		store.nextSweep = now.Add(sweepInterval)
+	}
+	store.entries[key] = response
+}
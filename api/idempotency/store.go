@@ -0,0 +1,26 @@
+package idempotency
+
+import "time"
+
+/*
+Response stored for an idempotency key. When a request is repeated with the same key, this response is returned to
+the client instead of producing the event again.
+*/
+type Response struct {
+	StatusCode int       `json:"status_code"`
+	Body       []byte    `json:"body"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (r Response) expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+/*
+Store keeps the responses of already processed requests for a TTL. Implementations set ExpiresAt on Set and should
+never return expired responses from Get.
+*/
+type Store interface {
+	Get(key string) (Response, bool)
+	Set(key string, response Response) error
+}
@@ -0,0 +1,87 @@
+package idempotency
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreReturnsStoredResponse(t *testing.T) {
+	store := MemoryStore{}.New(1 * time.Minute)
+
+	_, ok := store.Get("user_test_1/key_1")
+	assert.Equal(t, false, ok)
+
+	assert.Nil(t, store.Set("user_test_1/key_1", Response{StatusCode: 200, Body: []byte("stored")}))
+	response, ok := store.Get("user_test_1/key_1")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "stored", string(response.Body))
+}
+
+func TestMemoryStoreExpiresKeys(t *testing.T) {
+	store := MemoryStore{}.New(1 * time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	assert.Nil(t, store.Set("user_test_1/key_1", Response{StatusCode: 200}))
+
+	now = now.Add(2 * time.Minute)
+	_, ok := store.Get("user_test_1/key_1")
+	assert.Equal(t, false, ok)
+}
+
+func TestFileStoreKeepsKeysAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.log")
+
+	store, err := FileStore{}.New(path, 1*time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Set("user_test_1/key_1", Response{StatusCode: 200, Body: []byte("stored")}))
+	assert.Nil(t, store.Close())
+
+	reopened, err := FileStore{}.New(path, 1*time.Minute)
+	assert.Nil(t, err)
+	defer reopened.Close()
+
+	response, ok := reopened.Get("user_test_1/key_1")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "stored", string(response.Body))
+}
+
+func TestFileStoreCompactsExpiredKeysWhileRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.log")
+
+	store, err := FileStore{}.New(path, 1*time.Minute)
+	assert.Nil(t, err)
+	defer store.Close()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for i := 0; i < minCompactLines; i++ {
+		assert.Nil(t, store.Set(fmt.Sprintf("user_test_1/key_%d", i), Response{StatusCode: 200}))
+	}
+
+	// the keys expire, the next Set sweeps them and compacts the file to its own key
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, store.Set("user_test_1/key_new", Response{StatusCode: 200}))
+	assert.Nil(t, store.Set("user_test_1/key_next", Response{StatusCode: 200}))
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(content), "\n"))
+
+	_, ok := store.Get("user_test_1/key_next")
+	assert.Equal(t, true, ok)
+}
@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sweepInterval = 1 * time.Minute
+	idleRetention = 1 * time.Hour // counters of keys without requests for this period are dropped
+)
+
+type Config struct {
+	Rate  float64 // tokens added per second
+	Burst int     // max tokens of a bucket
+}
+
+type KeyStats struct {
+	Key       string `json:"key"`
+	Allowed   uint64 `json:"allowed"`
+	Throttled uint64 `json:"throttled"`
+}
+
+type Stats struct {
+	Name           string     `json:"name"`
+	Rate           float64    `json:"rate"`
+	Burst          int        `json:"burst"`
+	TotalAllowed   uint64     `json:"total_allowed"`
+	TotalThrottled uint64     `json:"total_throttled"`
+	Throttled      []KeyStats `json:"throttled"` // keys with throttled requests, most throttled first
+}
+
+type bucket struct {
+	tokens    float64
+	last      time.Time
+	allowed   uint64
+	throttled uint64
+}
+
+/*
+Token bucket rate limiter with one bucket per key (user id or credential). Every bucket starts full with Burst
+tokens and is refilled with Rate tokens per second. Each request takes one token and is throttled when the
+bucket is empty. Idle buckets are removed periodically, so the number of keys does not grow forever.
+*/
+type Limiter struct {
+	name           string
+	config         Config
+	mu             *sync.Mutex
+	buckets        map[string]*bucket
+	totalAllowed   uint64
+	totalThrottled uint64
+	nextSweep      time.Time
+	now            func() time.Time
+}
+
+func (Limiter) New(name string, config Config) *Limiter {
+	return &Limiter{
+		name:    name,
+		config:  config,
+		mu:      &sync.Mutex{},
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+/*
+Takes a token from the bucket of the key. When the bucket is empty, the request is not allowed and retryAfter is
+the time until the next token is available.
+*/
+func (limiter *Limiter) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limiter.config.Burst), last: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limiter.config.Burst), b.tokens+now.Sub(b.last).Seconds()*limiter.config.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.allowed++
+		limiter.totalAllowed++
+		return true, 0
+	}
+
+	b.throttled++
+	limiter.totalThrottled++
+	return false, time.Duration((1 - b.tokens) / limiter.config.Rate * float64(time.Second))
+}
+
+func (limiter *Limiter) Stats() Stats {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	stats := Stats{
+		Name:           limiter.name,
+		Rate:           limiter.config.Rate,
+		Burst:          limiter.config.Burst,
+		TotalAllowed:   limiter.totalAllowed,
+		TotalThrottled: limiter.totalThrottled,
+		Throttled:      []KeyStats{},
+	}
+	for key, b := range limiter.buckets {
+		if b.throttled > 0 {
+			stats.Throttled = append(stats.Throttled, KeyStats{Key: key, Allowed: b.allowed, Throttled: b.throttled})
+		}
+	}
+	sort.Slice(stats.Throttled, func(i, j int) bool {
+		return stats.Throttled[i].Throttled > stats.Throttled[j].Throttled
+	})
+	return stats
+}
+
+// removes buckets that are idle. Buckets with throttled requests are kept for idleRetention, so they show up in Stats
+func (limiter *Limiter) sweep(now time.Time) {
+	if now.Before(limiter.nextSweep) {
+		return
+	}
+	limiter.nextSweep = now.Add(sweepInterval)
+
+	refillTime := time.Duration(float64(limiter.config.Burst) / limiter.config.Rate * float64(time.Second))
+	for key, b := range limiter.buckets {
+		idle := now.Sub(b.last)
+		if (b.throttled == 0 && idle > refillTime) || idle > idleRetention {
+			delete(limiter.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiterThrottlesWhenBucketIsEmpty(t *testing.T) {
+	limiter := Limiter{}.New("user", Config{Rate: 2, Burst: 2})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	allowed, _ := limiter.Allow("user_test_1")
+	assert.Equal(t, true, allowed)
+	allowed, _ = limiter.Allow("user_test_1")
+	assert.Equal(t, true, allowed)
+
+	allowed, retryAfter := limiter.Allow("user_test_1")
+	assert.Equal(t, false, allowed)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// other keys have their own bucket
+	allowed, _ = limiter.Allow("user_test_2")
+	assert.Equal(t, true, allowed)
+
+	// bucket is refilled with 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = limiter.Allow("user_test_1")
+	assert.Equal(t, true, allowed)
+}
+
+func TestLimiterStatsListThrottledKeys(t *testing.T) {
+	limiter := Limiter{}.New("user", Config{Rate: 1, Burst: 1})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("user_test_1")
+	limiter.Allow("user_test_1")
+	limiter.Allow("user_test_1")
+	limiter.Allow("user_test_2")
+	limiter.Allow("user_test_2")
+	limiter.Allow("user_test_3")
+
+	stats := limiter.Stats()
+	assert.Equal(t, uint64(3), stats.TotalAllowed)
+	assert.Equal(t, uint64(3), stats.TotalThrottled)
+	assert.Equal(t, 2, len(stats.Throttled))
+	assert.Equal(t, KeyStats{Key: "user_test_1", Allowed: 1, Throttled: 2}, stats.Throttled[0])
+	assert.Equal(t, KeyStats{Key: "user_test_2", Allowed: 1, Throttled: 1}, stats.Throttled[1])
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/idempotency"
+	"event-delivery-kafka/api/tracking"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/kafka/components"
+	"event-delivery-kafka/logging"
+	"event-delivery-kafka/models"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAsyncQueueSize = 10000
+	defaultAsyncWorkers   = 4
+	asyncBatchSize        = 500 // max queued events sent to kafka with one Producer.Send call
+)
+
+type AsyncResponse struct {
+	EventID string `json:"event_id"`
+	Status  string `json:"status"`
+}
+
+/*
+Async ingest is enabled when s.Tracker is set. Queued events are written by a pool of workers, which send all the
+events waiting in the queue with a single Producer.Send call, so a slow broker does not block the clients.
+The producer reports the partition and offset of every written event to the tracker.
+*/
+func (s *Server) initializeAsync() {
+	if s.Tracker == nil {
+		return
+	}
+
+	queueSize := s.AsyncQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultAsyncQueueSize
+	}
+	workers := s.AsyncWorkers
+	if workers <= 0 {
+		workers = defaultAsyncWorkers
+	}
+
+	s.asyncQueue = make(chan models.KafkaMessage, queueSize)
+	s.Producer.OnDelivery = s.reportDelivery
+	s.asyncWorkers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.produceAsync()
+	}
+}
+
+/*
+Closes the queue and waits for the workers to write the queued events, up to the deadline of ctx.
+Events accepted after it get 503, like when the queue is full.
+*/
+func (s *Server) drainAsync(ctx context.Context) error {
+	s.asyncMu.Lock()
+	if s.asyncQueue == nil || s.asyncClosed {
+		s.asyncMu.Unlock()
+		return nil
+	}
+	s.asyncClosed = true
+	close(s.asyncQueue)
+	s.asyncMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.asyncWorkers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued events not written to kafka: %w", len(s.asyncQueue), ctx.Err())
+	}
+}
+
+// queues the message without blocking, false when the queue is full or closed
+func (s *Server) enqueueAsync(message models.KafkaMessage) bool {
+	s.asyncMu.RLock()
+	defer s.asyncMu.RUnlock()
+	if s.asyncClosed {
+		return false
+	}
+	select {
+	case s.asyncQueue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Clients ask for async ingest with header "Prefer: respond-async" (RFC 7240) or with query "?async=true".
+The request is handled synchronously when async ingest is disabled.
+*/
+func (s *Server) respondAsync(request *http.Request) bool {
+	if s.Tracker == nil {
+		return false
+	}
+	if request.URL.Query().Get("async") == "true" {
+		return true
+	}
+	for _, header := range request.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(strings.Split(preference, ";")[0]), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Queues the event and returns 202 with the id of the event. The event_id of the client is used if present, otherwise
+a new one is generated. The status of the event can be found with GET /events/{event_id}.
+*/
+func (s *Server) ingestAsync(writer http.ResponseWriter, request *http.Request, event models.Event, key string) {
+	eventID := event.EventID
+	if eventID == "" {
+		eventID = uuid.New().String()
+	}
+
+	s.Tracker.Track(eventID, principalID(request))
+
+	kafkaMessage := s.newKafkaMessage(request.Context(), event, time.Now())
+	kafkaMessage.EventID = eventID
+	if !s.enqueueAsync(*kafkaMessage) {
+		s.Tracker.Forget(eventID, principalID(request))
+		setRetryAfter(writer, 1*time.Second)
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeQueueFull, "too many events waiting to be written to kafka", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := json.Marshal(AsyncResponse{EventID: eventID, Status: tracking.StatusPending})
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.storeIdempotencyResponse(key, idempotency.Response{StatusCode: http.StatusAccepted, Body: body})
+	writer.Header().Set("Location", "/events/"+eventID)
+	writer.Header().Set("Preference-Applied", "respond-async")
+	utils.ConstructSuccessfulResponse(writer, http.StatusAccepted, body)
+}
+
+func (s *Server) produceAsync() {
+	defer s.asyncWorkers.Done()
+	batch := make([]models.KafkaMessage, 0, asyncBatchSize)
+	for message := range s.asyncQueue {
+		batch = append(batch[:0], message)
+	drain:
+		for len(batch) < asyncBatchSize {
+			select {
+			case message, ok := <-s.asyncQueue:
+				if !ok {
+					break drain // closed by drainAsync
+				}
+				batch = append(batch, message)
+			default:
+				break drain
+			}
+		}
+
+		err := s.Producer.Send(context.Background(), batch...)
+		if err != nil {
+			logging.OrNop(s.Logger).Error("failed to write queued events", zap.Int("events", len(batch)), zap.Error(err))
+		}
+
+		// resolves the events the producer did not report, with the error of every message when available
+		var writeErrors kafka.WriteErrors
+		isWriteErrors := errors.As(err, &writeErrors) && len(writeErrors) == len(batch)
+		for i := range batch {
+			messageErr := err
+			if isWriteErrors {
+				messageErr = writeErrors[i]
+			}
+			s.Tracker.Complete(batch[i].EventID, batch[i].Principal, messageErr)
+		}
+	}
+}
+
+func (s *Server) reportDelivery(reports ...components.DeliveryReport) {
+	for _, report := range reports {
+		if report.Err != nil {
+			s.Tracker.Failed(report.EventID, report.Principal, report.Err.Error())
+		} else {
+			s.Tracker.Persisted(report.EventID, report.Principal, report.Partition, report.Offset)
+		}
+	}
+}
+
+/*
+Handle requests with path "/events/{event_id}" like
+GET /events/0b7e8b6a-0f6c-4c1f-a3a4-5d6c86c4c8a1
+Returns the delivery status of an event accepted asynchronously. Events of other principals are never found.
+*/
+func (s *Server) eventStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	eventID := strings.TrimPrefix(request.URL.Path, "/events/")
+	var record tracking.Record
+	found := false
+	if s.Tracker != nil && eventID != "" && !strings.Contains(eventID, "/") {
+		record, found = s.Tracker.Get(eventID, principalID(request))
+	}
+	if !found {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeNotFound, "no event with id "+eventID, http.StatusNotFound)
+		return
+	}
+
+	responseBytes, err := json.Marshal(record)
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.ConstructSuccessfulResponse(writer, http.StatusOK, responseBytes)
+}
+
+// id of the authenticated principal, empty when authentication is disabled
+func principalID(request *http.Request) string {
+	if principal := auth.PrincipalFromContext(request.Context()); principal != nil {
+		return principal.ID
+	}
+	return ""
+}
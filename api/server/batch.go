@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/models"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"net/http"
+	"time"
+)
+
+const (
+	BatchItemSucceeded       = "success"
+	BatchItemValidationError = "validation_error"
+	BatchItemProduceError    = "produce_error"
+	BatchItemRateLimited     = "rate_limited"
+	BatchItemTooLarge        = "too_large"
+)
+
+type BatchItemResult struct {
+	Index             int                    `json:"index"`
+	Status            string                 `json:"status"`
+	Error             string                 `json:"error,omitempty"`
+	Violations        []validation.Violation `json:"violations,omitempty"`
+	RetryAfterSeconds float64                `json:"retry_after_seconds,omitempty"`
+}
+
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+/*
+Handle requests with path "/events/batch" like
+POST /events/batch
+*/
+func (s *Server) batch(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "POST":
+		s.ingestBatch(writer, request)
+		return
+	default:
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+/*
+Accepts a json array of events. Every event is validated on its own and only the valid ones are sent to Kafka with a
+single Producer.Send call. The response contains one result per event (same index as in the request), so clients
+can retry only the events that failed. Status code is 200 when every event is stored, otherwise 207 (Multi-Status).
+*/
+func (s *Server) ingestBatch(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	ct := request.Header.Get("content-type")
+	if ct != "application/json" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeUnsupportedMediaType, fmt.Sprintf("need content-type 'application/json', but got '%s'", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	bodyBytes, err := s.readBody(request, s.maxBodyBytes())
+	if err != nil {
+		constructBodyErrorResponse(writer, request, err)
+		return
+	}
+
+	var rawEvents []json.RawMessage
+	err = json.Unmarshal(bodyBytes, &rawEvents)
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidJSON, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(rawEvents) == 0 {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidRequest, "at least one event should be provided", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchItemResult, len(rawEvents))
+	kafkaMessages := make([]models.KafkaMessage, 0, len(rawEvents))
+	indexes := make([]int, 0, len(rawEvents)) // position in the request of each kafka message
+	now := time.Now()
+	var maxRetryAfter time.Duration
+	for i, rawEvent := range rawEvents {
+		results[i] = BatchItemResult{Index: i, Status: BatchItemSucceeded}
+		if int64(len(rawEvent)) > s.maxEventBytes() {
+			results[i].Status = BatchItemTooLarge
+			results[i].Error = fmt.Sprintf("event exceeds %d bytes", s.maxEventBytes())
+			continue
+		}
+
+		var event models.Event
+		if err := json.Unmarshal(rawEvent, &event); err != nil {
+			results[i].Status = BatchItemValidationError
+			results[i].Error = err.Error()
+			continue
+		}
+
+		if err := s.validateEvent(event); err != nil {
+			results[i].Status = BatchItemValidationError
+			results[i].Error = err.Error()
+			results[i].Violations = violationsOf(err)
+			continue
+		}
+		if allowed, retryAfter := s.allowUser(event.UserID); !allowed {
+			results[i].Status = BatchItemRateLimited
+			results[i].Error = "too many events for user " + event.UserID
+			results[i].RetryAfterSeconds = retryAfter.Seconds()
+			if retryAfter > maxRetryAfter {
+				maxRetryAfter = retryAfter
+			}
+			continue
+		}
+		kafkaMessages = append(kafkaMessages, *s.newKafkaMessage(request.Context(), event, now))
+		indexes = append(indexes, i)
+	}
+
+	if len(kafkaMessages) > 0 {
+		err = s.Producer.Send(request.Context(), kafkaMessages...)
+		markProduceErrors(results, indexes, err)
+	}
+
+	response := BatchResponse{Results: results}
+	for _, result := range results {
+		if result.Status == BatchItemSucceeded {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	statusCode := http.StatusOK
+	if response.Rejected > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	if maxRetryAfter > 0 {
+		setRetryAfter(writer, maxRetryAfter)
+	}
+	utils.ConstructSuccessfulResponse(writer, statusCode, responseBytes)
+}
+
+func violationsOf(err error) []validation.Violation {
+	var validationErr *validation.ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Violations
+	}
+	return nil
+}
+
+/*
+kafka.Writer returns kafka.WriteErrors (one entry per message, nil on success) when only some messages failed.
+Any other error means that the whole write failed, so every produced event is marked as failed.
+*/
+func markProduceErrors(results []BatchItemResult, indexes []int, err error) {
+	if err == nil {
+		return
+	}
+
+	writeErrors, partial := err.(kafka.WriteErrors)
+	for i, index := range indexes {
+		itemErr := err
+		if partial {
+			if i >= len(writeErrors) || writeErrors[i] == nil {
+				continue
+			}
+			itemErr = writeErrors[i]
+		}
+		results[index].Status = BatchItemProduceError
+		results[index].Error = itemErr.Error()
+	}
+}
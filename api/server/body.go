@@ -0,0 +1,189 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/utils"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultMaxEventBytes = 1 << 20  // 1MB
+	defaultMaxBodyBytes  = 10 << 20 // 10MB
+	maxZstdWindowBytes   = 8 << 20  // 8MB, the largest window that zstd decoders are recommended to support
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+func (err *unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content-encoding '%s', supported encodings are gzip and zstd", err.encoding)
+}
+
+type invalidEncodingError struct {
+	err error
+}
+
+func (err *invalidEncodingError) Error() string {
+	return "can not decompress request body: " + err.err.Error()
+}
+
+func (err *invalidEncodingError) Unwrap() error {
+	return err.err
+}
+
+func (s *Server) maxEventBytes() int64 {
+	if s.MaxEventBytes > 0 {
+		return s.MaxEventBytes
+	}
+	return defaultMaxEventBytes
+}
+
+func (s *Server) maxBodyBytes() int64 {
+	if s.MaxBodyBytes > 0 {
+		return s.MaxBodyBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+/*
+Returns the body of the request, decompressed according to its Content-Encoding (gzip or zstd).
+Both the compressed and the decompressed bytes are limited, so a small compressed body that expands to a huge
+one (zip bomb) fails with errBodyTooLarge as soon as the limit is reached, without being read in memory.
+A limit <= 0 means that the body is not limited (used by streaming, which never reads the whole body).
+*/
+func (s *Server) requestBody(request *http.Request, limit int64) (io.ReadCloser, error) {
+	raw := limitReader(request.Body, limit)
+
+	encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return raw, nil
+	case "gzip":
+		reader, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, &invalidEncodingError{err: err}
+		}
+		return &decompressedBody{Reader: limitReader(reader, limit), close: reader.Close}, nil
+	case "zstd":
+		// the window is what a streaming decoder keeps in memory, so it is limited even when the body is not
+		maxMemory := uint64(maxZstdWindowBytes)
+		if limit > 0 && limit < maxZstdWindowBytes {
+			maxMemory = uint64(limit)
+		}
+		decoder, err := zstd.NewReader(raw, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(maxZstdWindowBytes), zstd.WithDecoderMaxMemory(maxMemory))
+		if err != nil {
+			return nil, &invalidEncodingError{err: err}
+		}
+		return &decompressedBody{Reader: limitReader(decoder, limit), close: func() error {
+			decoder.Close()
+			return nil
+		}}, nil
+	default:
+		return nil, &unsupportedEncodingError{encoding: encoding}
+	}
+}
+
+// reads the whole (decompressed) body, up to limit bytes
+func (s *Server) readBody(request *http.Request, limit int64) ([]byte, error) {
+	body, err := s.requestBody(request, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(body)
+	if err == nil {
+		err = auth.VerifyBody(request)
+	}
+	if bodyVerificationError(err) != nil {
+		return nil, err
+	}
+	if err != nil && err != errBodyTooLarge && request.Header.Get("Content-Encoding") != "" {
+		return nil, &invalidEncodingError{err: err}
+	}
+	return bodyBytes, err
+}
+
+// returns the auth error when the body does not match its signed digest or is a replay of a verified one, else nil
+func bodyVerificationError(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrBodyTampered):
+		return auth.ErrBodyTampered
+	case errors.Is(err, auth.ErrReplayedNonce):
+		return auth.ErrReplayedNonce
+	}
+	return nil
+}
+
+func constructBodyErrorResponse(writer http.ResponseWriter, request *http.Request, err error) {
+	var unsupportedErr *unsupportedEncodingError
+	var invalidErr *invalidEncodingError
+	switch {
+	case bodyVerificationError(err) != nil:
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeUnauthorized, bodyVerificationError(err).Error(), http.StatusUnauthorized)
+	case err == errBodyTooLarge:
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodePayloadTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &unsupportedErr):
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeUnsupportedEncoding, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.As(err, &invalidErr):
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+	default:
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type decompressedBody struct {
+	io.Reader
+	close func() error
+}
+
+func (body *decompressedBody) Close() error {
+	return body.close()
+}
+
+/*
+Like io.LimitReader, but fails with errBodyTooLarge instead of returning io.EOF when there are more than limit
+bytes, so a truncated body is never mistaken for a complete one.
+*/
+func limitReader(reader io.Reader, limit int64) io.ReadCloser {
+	closer, ok := reader.(io.ReadCloser)
+	if !ok {
+		closer = ioutil.NopCloser(reader)
+	}
+	if limit <= 0 {
+		return closer
+	}
+	return &limitedReader{ReadCloser: closer, remaining: limit}
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	if reader.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > reader.remaining+1 {
+		p = p[:reader.remaining+1] // read one more byte to know if the body is larger than the limit
+	}
+	n, err := reader.ReadCloser.Read(p)
+	reader.remaining -= int64(n)
+	if reader.remaining < 0 {
+		return n + int(reader.remaining), errBodyTooLarge
+	}
+	return n, err
+}
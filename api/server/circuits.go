@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/delivery/circuitbreaker"
+	"net/http"
+)
+
+type CircuitsResponse struct {
+	Circuits []circuitbreaker.Snapshot `json:"circuits"`
+}
+
+/*
+Handle requests with path "/circuits" like
+GET /circuits
+State of the circuit breaker of every destination. Changes of the states are logged too.
+*/
+func (s *Server) circuits(writer http.ResponseWriter, request *http.Request) {
+	if s.Circuits == nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeNotFound, "circuit breakers are disabled", http.StatusNotFound)
+		return
+	}
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseBytes, err := json.Marshal(CircuitsResponse{Circuits: s.Circuits.Snapshots()})
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.ConstructSuccessfulResponse(writer, http.StatusOK, responseBytes)
+}
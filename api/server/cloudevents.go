@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/models"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	contentTypeCloudEvents      = "application/cloudevents+json"
+	cloudEventsHTTPHeaderPrefix = "ce-"
+)
+
+/*
+PUT /events accepts CloudEvents 1.0 with the HTTP protocol binding
+(https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/http-protocol-binding.md), in structured mode
+(content-type application/cloudevents+json and the whole event in the body) or in binary mode (attributes in ce-*
+headers and the data in the body, with its own content-type).
+*/
+func isCloudEvent(request *http.Request) bool {
+	return isStructuredCloudEvent(request) || request.Header.Get(cloudEventsHTTPHeaderPrefix+"specversion") != ""
+}
+
+func isStructuredCloudEvent(request *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("content-type"))
+	return mediaType == contentTypeCloudEvents
+}
+
+func cloudEventFromRequest(request *http.Request, body []byte) (*models.Event, error) {
+	if isStructuredCloudEvent(request) {
+		var cloudEvent models.CloudEvent
+		if err := json.Unmarshal(body, &cloudEvent); err != nil {
+			return nil, err
+		}
+		return cloudEvent.ToEvent()
+	}
+
+	cloudEvent := models.CloudEvent{DataContentType: request.Header.Get("content-type"), Data: body}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, cloudEventsHTTPHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		// values are percent-encoded by the binding
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			return nil, errors.New("header " + name + " is not percent-encoded: " + err.Error())
+		}
+
+		switch attribute := strings.TrimPrefix(name, cloudEventsHTTPHeaderPrefix); attribute {
+		case "specversion":
+			cloudEvent.SpecVersion = value
+		case "id":
+			cloudEvent.ID = value
+		case "source":
+			cloudEvent.Source = value
+		case "type":
+			cloudEvent.Type = value
+		case "subject":
+			cloudEvent.Subject = value
+		case "dataschema":
+			cloudEvent.DataSchema = value
+		case "time":
+			timestamp, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, errors.New("cloudevent attribute time should be RFC 3339: " + err.Error())
+			}
+			cloudEvent.Time = timestamp
+		default:
+			if cloudEvent.Extensions == nil {
+				cloudEvent.Extensions = map[string]string{}
+			}
+			cloudEvent.Extensions[attribute] = value
+		}
+	}
+	return cloudEvent.ToEvent()
+}
+
+// a body that is not json (or not a json object) is invalid_json, an event with invalid attributes is invalid_event
+func constructCloudEventErrorResponse(writer http.ResponseWriter, request *http.Request, err error) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidJSON, err.Error(), http.StatusBadRequest)
+		return
+	}
+	utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidEvent, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/idempotency"
+	"event-delivery-kafka/api/server/ingestpb"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/models"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+Starts the gRPC API on the given port. It blocks like Initialize, so it should run in its own goroutine, and returns
+nil after Shutdown.
+*/
+func (s *Server) InitializeGRPC(port string) error {
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.grpcServer = s.NewGRPCServer()
+	grpcServer := s.grpcServer
+	s.mu.Unlock()
+
+	if err := grpcServer.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	return nil
+}
+
+/*
+The gRPC API shares validation, rate limits, idempotency keys and the producer with the REST API.
+Messages larger than the max event size are rejected by grpc itself.
+*/
+func (s *Server) NewGRPCServer() *grpc.Server {
+	grpcServer := grpc.NewServer(
+		grpc.MaxRecvMsgSize(int(s.maxEventBytes())),
+		grpc.ChainUnaryInterceptor(s.meterUnary, s.authorizeUnary),
+		grpc.ChainStreamInterceptor(s.meterStream, s.authorizeStream),
+	)
+	ingestpb.RegisterIngestServiceServer(grpcServer, &ingestService{server: s})
+	return grpcServer
+}
+
+type ingestService struct {
+	ingestpb.UnimplementedIngestServiceServer
+	server *Server
+}
+
+func (service *ingestService) Ingest(ctx context.Context, message *ingestpb.Event) (*ingestpb.IngestResponse, error) {
+	s := service.server
+	event := eventFromProto(message)
+	if err := s.validateEvent(event); err != nil {
+		return nil, validationStatus(err)
+	}
+
+	key := grpcIdempotencyKey(ctx, event)
+	if key != "" && s.IdempotencyStore != nil {
+		if response, ok := s.IdempotencyStore.Get(key); ok {
+			return &ingestpb.IngestResponse{Message: responseMessage(response.Body)}, nil
+		}
+		if _, loaded := s.inFlight.LoadOrStore(key, struct{}{}); loaded {
+			return nil, status.Error(codes.Aborted, "a request with the same idempotency key is in progress")
+		}
+		defer s.inFlight.Delete(key)
+	}
+
+	if allowed, retryAfter := s.allowUser(event.UserID); !allowed {
+		return nil, rateLimitedStatus(retryAfter, "too many events for user "+event.UserID)
+	}
+
+	if err := s.Producer.Send(ctx, *s.newKafkaMessage(ctx, event, time.Now())); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	s.storeIdempotencyResponse(key, idempotency.Response{StatusCode: http.StatusOK, Body: ingestedResponseBody})
+	return &ingestpb.IngestResponse{Message: ingestedMessage}, nil
+}
+
+// message of a stored response of the REST API, json strings are decoded
+func responseMessage(body []byte) string {
+	var message string
+	if err := json.Unmarshal(body, &message); err == nil {
+		return message
+	}
+	return string(body)
+}
+
+/*
+Events of the stream are validated and produced in micro-batches like the lines of POST /events/stream, and the
+summary is returned when the client closes the stream. If the stream breaks, the events of the current batch are
+not produced and the client should send them again.
+*/
+func (service *ingestService) IngestStream(stream ingestpb.IngestService_IngestStreamServer) error {
+	s := service.server
+	ingestor := &streamIngestor{
+		server: s,
+		ctx:    stream.Context(),
+		batch:  make([]models.KafkaMessage, 0, streamBatchSize),
+		lines:  make([]int, 0, streamBatchSize),
+	}
+
+	index := 0
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		index++
+		ingestor.addEvent(index, eventFromProto(message))
+	}
+	ingestor.flush()
+
+	return stream.SendAndClose(summaryToProto(ingestor.summary))
+}
+
+// counts the calls by method and status code, like the withMetrics middleware of the REST API
+func (s *Server) meterUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	response, err := handler(ctx, request)
+	s.Metrics.IngestRequest("grpc", info.FullMethod, status.Code(err).String())
+	return response, err
+}
+
+func (s *Server) meterStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, stream)
+	s.Metrics.IngestRequest("grpc", info.FullMethod, status.Code(err).String())
+	return err
+}
+
+func (s *Server) authorizeUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authorizeGRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (s *Server) authorizeStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorizeGRPC(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+}
+
+// keeps the principal in the context of the stream
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authorizedStream) Context() context.Context {
+	return stream.ctx
+}
+
+/*
+Authenticates the call with the API key of metadata "x-api-key" or "authorization: Bearer <key>" and limits the calls
+of every credential, like the authenticate and limitCredential middlewares of the REST API.
+HMAC signatures cover the http body, so signed requests are only supported by the REST API.
+*/
+func (s *Server) authorizeGRPC(ctx context.Context, fullMethod string) (context.Context, error) {
+	if s.Authenticator != nil {
+		request, err := http.NewRequestWithContext(ctx, "POST", fullMethod, http.NoBody)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, name := range []string{"x-api-key", "authorization"} {
+			for _, value := range md.Get(name) {
+				request.Header.Add(name, value)
+			}
+		}
+
+		principal, err := s.Authenticator.Authenticate(request)
+		if err == nil && principal == nil {
+			err = auth.ErrMissingCredentials
+		}
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		ctx = auth.WithPrincipal(ctx, principal)
+	}
+
+	if s.CredentialRateLimiter != nil {
+		key := grpcCredentialKey(ctx)
+		if allowed, retryAfter := s.CredentialRateLimiter.Allow(key); !allowed {
+			return nil, rateLimitedStatus(retryAfter, "too many requests for credential "+key)
+		}
+	}
+	return ctx, nil
+}
+
+func grpcCredentialKey(ctx context.Context) string {
+	if principal := auth.PrincipalFromContext(ctx); principal != nil {
+		return principal.ID
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// same keys as the REST API, with metadata "idempotency-key" or the event_id of the event
+func grpcIdempotencyKey(ctx context.Context, event models.Event) string {
+	key := event.EventID
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("idempotency-key"); len(values) > 0 && values[0] != "" {
+		key = values[0]
+	}
+	if key == "" {
+		return ""
+	}
+	return event.UserID + "/" + key
+}
+
+// schema violations are returned as field violations of the status details
+func validationStatus(err error) error {
+	var validationErr *validation.ValidationError
+	if !errors.As(err, &validationErr) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range validationErr.Violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       violation.Field,
+			Description: violation.Message,
+		})
+	}
+	st, detailsErr := status.New(codes.InvalidArgument, err.Error()).WithDetails(badRequest)
+	if detailsErr != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return st.Err()
+}
+
+func rateLimitedStatus(retryAfter time.Duration, message string) error {
+	st, err := status.New(codes.ResourceExhausted, message).WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, message)
+	}
+	return st.Err()
+}
+
+func eventFromProto(message *ingestpb.Event) models.Event {
+	event := models.Event{
+		UserID:        message.GetUserId(),
+		Payload:       message.GetPayload(),
+		EventID:       message.GetEventId(),
+		EventType:     message.GetEventType(),
+		SchemaVersion: message.GetSchemaVersion(),
+		Source:        message.GetSource(),
+	}
+	if message.GetClientTimestamp() != nil {
+		event.ClientTimestamp = message.GetClientTimestamp().AsTime()
+	}
+	return event
+}
+
+func summaryToProto(summary StreamSummary) *ingestpb.IngestStreamSummary {
+	result := &ingestpb.IngestStreamSummary{
+		Accepted:        int32(summary.Accepted),
+		Rejected:        int32(summary.Rejected),
+		ErrorsTruncated: summary.ErrorsTruncated,
+	}
+	for _, lineError := range summary.Errors {
+		rejected := &ingestpb.RejectedEvent{
+			Index:  int32(lineError.Line),
+			Status: lineError.Status,
+			Error:  lineError.Error,
+		}
+		for _, violation := range lineError.Violations {
+			rejected.Violations = append(rejected.Violations, &ingestpb.Violation{Field: violation.Field, Message: violation.Message})
+		}
+		result.Errors = append(result.Errors, rejected)
+	}
+	return result
+}
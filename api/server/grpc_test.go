@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/server/ingestpb"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/kafka/components"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIngestEventWithGRPC(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	client := newGRPCClient(t, &Server{Producer: &components.Producer{Writer: writerMock}})
+
+	clientTimestamp := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	response, err := client.Ingest(context.Background(), &ingestpb.Event{UserId: "user_test_1", Payload: "event click !!!!", Source: "billing", ClientTimestamp: timestamppb.New(clientTimestamp)})
+	assert.Nil(t, err)
+	assert.Equal(t, "Message received and stored successfully", response.Message)
+	assert.Equal(t, 1, len(writerMock.Messages))
+	event := components.EventFromMessage(writerMock.Messages[0])
+	assert.Equal(t, "user_test_1", event.UserID)
+	assert.Equal(t, "billing", event.Source)
+	assert.Equal(t, clientTimestamp, event.ClientTimestamp)
+}
+
+func TestIngestInvalidEventWithGRPC(t *testing.T) {
+	registry := validation.SchemaRegistry{}.New()
+	assert.Nil(t, registry.Register("click", []byte(clickSchema)))
+	client := newGRPCClient(t, &Server{Producer: &components.Producer{Writer: &KafkaWriterSuccessMock{}}, SchemaRegistry: registry})
+
+	_, err := client.Ingest(context.Background(), &ingestpb.Event{Payload: "event click !!!!"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Ingest(context.Background(), &ingestpb.Event{UserId: "user_test_1", Payload: "{\"x\": \"1\"}", EventType: "click"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	details := status.Convert(err).Details()
+	assert.Equal(t, 1, len(details))
+	assert.Equal(t, "(root)", details[0].(*errdetails.BadRequest).FieldViolations[0].Field)
+}
+
+func TestIngestEventWithGRPCAndProduceFail(t *testing.T) {
+	client := newGRPCClient(t, &Server{Producer: &components.Producer{Writer: &KafkaWriterFailureMock{}}})
+
+	_, err := client.Ingest(context.Background(), &ingestpb.Event{UserId: "user_test_1", Payload: "event click !!!!"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestIngestEventWithGRPCAndAPIKey(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	client := newGRPCClient(t, &Server{
+		Producer:      &components.Producer{Writer: writerMock},
+		Authenticator: auth.APIKeyAuthenticator{}.New(map[string]string{"mobile_sdk": "key_1"}),
+	})
+
+	_, err := client.Ingest(context.Background(), &ingestpb.Event{UserId: "user_test_1", Payload: "event click !!!!"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key_1")
+	_, err = client.Ingest(ctx, &ingestpb.Event{UserId: "user_test_1", Payload: "event click !!!!"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(writerMock.Messages))
+	assert.Equal(t, "mobile_sdk", components.HeaderValue(writerMock.Messages[0], components.HeaderPrincipal))
+}
+
+func TestIngestStreamWithGRPC(t *testing.T) {
+	writerMock := &KafkaWriterCountingMock{}
+	client := newGRPCClient(t, &Server{Producer: &components.Producer{Writer: writerMock}})
+
+	stream, err := client.IngestStream(context.Background())
+	assert.Nil(t, err)
+	for i := 0; i < streamBatchSize+1; i++ {
+		assert.Nil(t, stream.Send(&ingestpb.Event{UserId: "user_test_1", Payload: "event click !!!!"}))
+	}
+	assert.Nil(t, stream.Send(&ingestpb.Event{Payload: "event without user"}))
+
+	summary, err := stream.CloseAndRecv()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(streamBatchSize+1), summary.Accepted)
+	assert.Equal(t, int32(1), summary.Rejected)
+	assert.Equal(t, int32(streamBatchSize+2), summary.Errors[0].Index)
+	assert.Equal(t, BatchItemValidationError, summary.Errors[0].Status)
+	assert.Equal(t, 2, writerMock.Calls)
+	assert.Equal(t, streamBatchSize+1, writerMock.Messages)
+}
+
+// serves the gRPC API of the server on an in-process listener
+func newGRPCClient(t *testing.T, server *Server) ingestpb.IngestServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := server.NewGRPCServer()
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return ingestpb.NewIngestServiceClient(conn)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"event-delivery-kafka/api/health"
+	"event-delivery-kafka/api/utils"
+	"net/http"
+)
+
+/*
+Handle requests with path "/healthz" like
+GET /healthz
+Liveness probe, the process is alive and serves requests. Dependencies are not checked, so a broker outage does not
+restart the pods.
+*/
+func (s *Server) healthz(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	utils.ConstructSuccessfulResponse(writer, http.StatusOK, []byte(`{"status":"`+health.StatusOK+`"}`))
+}
+
+/*
+Handle requests with path "/readyz" like
+GET /readyz
+Readiness probe, returns 200 when every check of s.Readiness is ok and 503 otherwise, with the result of every check.
+*/
+func (s *Server) readyz(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := health.Report{Status: health.StatusOK, Checks: []health.CheckResult{}}
+	if s.Readiness != nil {
+		report = s.Readiness.Run(request.Context())
+	}
+	responseBytes, err := json.Marshal(report)
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	statusCode := http.StatusOK
+	if report.Status != health.StatusOK {
+		statusCode = http.StatusServiceUnavailable
+	}
+	utils.ConstructSuccessfulResponse(writer, statusCode, responseBytes)
+}
+
+/*
+Handle requests with path "/metrics" like
+GET /metrics
+Metrics of the ingestion and of the delivery in the Prometheus text format. Like the probes, it is not authenticated,
+so Prometheus can scrape it.
+*/
+func (s *Server) metrics(writer http.ResponseWriter, request *http.Request) {
+	if s.Metrics == nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeNotFound, "metrics are disabled", http.StatusNotFound)
+		return
+	}
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.Metrics.Handler().ServeHTTP(writer, request)
+}
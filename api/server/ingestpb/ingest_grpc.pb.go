@@ -0,0 +1,182 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: api/server/ingestpb/ingest.proto
+
+package ingestpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// IngestServiceClient is the client API for IngestService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IngestServiceClient interface {
+	// Produces a single event, like PUT /events.
+	Ingest(ctx context.Context, in *Event, opts ...grpc.CallOption) (*IngestResponse, error)
+	// Produces the events of the stream in micro-batches, like POST /events/stream, and returns a summary when the
+	// client closes the stream.
+	IngestStream(ctx context.Context, opts ...grpc.CallOption) (IngestService_IngestStreamClient, error)
+}
+
+type ingestServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngestServiceClient(cc grpc.ClientConnInterface) IngestServiceClient {
+	return &ingestServiceClient{cc}
+}
+
+func (c *ingestServiceClient) Ingest(ctx context.Context, in *Event, opts ...grpc.CallOption) (*IngestResponse, error) {
+	out := new(IngestResponse)
+	err := c.cc.Invoke(ctx, "/eventdelivery.ingest.v1.IngestService/Ingest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ingestServiceClient) IngestStream(ctx context.Context, opts ...grpc.CallOption) (IngestService_IngestStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &IngestService_ServiceDesc.Streams[0], "/eventdelivery.ingest.v1.IngestService/IngestStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &ingestServiceIngestStreamClient{stream}
+	return x, nil
+}
+
+type IngestService_IngestStreamClient interface {
+	Send(*Event) error
+	CloseAndRecv() (*IngestStreamSummary, error)
+	grpc.ClientStream
+}
+
+type ingestServiceIngestStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *ingestServiceIngestStreamClient) Send(m *Event) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *ingestServiceIngestStreamClient) CloseAndRecv() (*IngestStreamSummary, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(IngestStreamSummary)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngestServiceServer is the server API for IngestService service.
+// All implementations must embed UnimplementedIngestServiceServer
+// for forward compatibility
+type IngestServiceServer interface {
+	// Produces a single event, like PUT /events.
+	Ingest(context.Context, *Event) (*IngestResponse, error)
+	// Produces the events of the stream in micro-batches, like POST /events/stream, and returns a summary when the
+	// client closes the stream.
+	IngestStream(IngestService_IngestStreamServer) error
+	mustEmbedUnimplementedIngestServiceServer()
+}
+
+// UnimplementedIngestServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedIngestServiceServer struct {
+}
+
+func (UnimplementedIngestServiceServer) Ingest(context.Context, *Event) (*IngestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedIngestServiceServer) IngestStream(IngestService_IngestStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method IngestStream not implemented")
+}
+func (UnimplementedIngestServiceServer) mustEmbedUnimplementedIngestServiceServer() {}
+
+// UnsafeIngestServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngestServiceServer will
+// result in compilation errors.
+type UnsafeIngestServiceServer interface {
+	mustEmbedUnimplementedIngestServiceServer()
+}
+
+func RegisterIngestServiceServer(s grpc.ServiceRegistrar, srv IngestServiceServer) {
+	s.RegisterService(&IngestService_ServiceDesc, srv)
+}
+
+func _IngestService_Ingest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Event)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IngestServiceServer).Ingest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/eventdelivery.ingest.v1.IngestService/Ingest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IngestServiceServer).Ingest(ctx, req.(*Event))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IngestService_IngestStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(IngestServiceServer).IngestStream(&ingestServiceIngestStreamServer{stream})
+}
+
+type IngestService_IngestStreamServer interface {
+	SendAndClose(*IngestStreamSummary) error
+	Recv() (*Event, error)
+	grpc.ServerStream
+}
+
+type ingestServiceIngestStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *ingestServiceIngestStreamServer) SendAndClose(m *IngestStreamSummary) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *ingestServiceIngestStreamServer) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngestService_ServiceDesc is the grpc.ServiceDesc for IngestService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IngestService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "eventdelivery.ingest.v1.IngestService",
+	HandlerType: (*IngestServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ingest",
+			Handler:    _IngestService_Ingest_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IngestStream",
+			Handler:       _IngestService_IngestStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "api/server/ingestpb/ingest.proto",
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+)
+
+/*
+Every request gets an id, so an error reported by a client can be matched with the server logs. The id sent by the
+client with header X-Request-ID is used if present, otherwise a new one is generated.
+The id is returned to the client with the same header.
+*/
+func (s *Server) withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get(utils.RequestIDHeader)
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+
+		writer.Header().Set(utils.RequestIDHeader, requestID)
+		next(writer, request.WithContext(utils.WithRequestID(request.Context(), requestID)))
+	}
+}
+
+/*
+Counts the requests of every route by status code. The route is the registered pattern and not the path, so paths
+with event ids do not create a time series each.
+*/
+func (s *Server) withMetrics(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if s.Metrics == nil {
+			next(writer, request)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next(recorder, request)
+		s.Metrics.IngestRequest("http", route, strconv.Itoa(recorder.status))
+	}
+}
+
+// keeps the status code written by the handler, 200 when the handler writes the body without a status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if !recorder.wroteHeader {
+		recorder.status = statusCode
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+/*
+Starts a server span for the request, child of the trace context sent by the client (traceparent header) if any.
+The handler should use the returned writer and request, end records the status code of the response. Only responses
+with status 5xx are errors of the span, 4xx are errors of the client.
+*/
+func traceRequest(name string, route string, writer http.ResponseWriter, request *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, request)...),
+		trace.WithAttributes(attribute.String("request.id", utils.RequestID(request))),
+	)
+
+	recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+	end := func() {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		span.End()
+	}
+	return recorder, request.WithContext(ctx), end
+}
+
+/*
+Rejects requests that can not be authenticated by s.Authenticator. The principal of the request is kept in the
+request context and attached to the produced Kafka messages. Authentication is disabled when s.Authenticator is nil.
+*/
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if s.Authenticator == nil {
+			next(writer, request)
+			return
+		}
+
+		principal, err := s.Authenticator.Authenticate(request)
+		if err == nil && principal == nil {
+			err = auth.ErrMissingCredentials
+		}
+		if err == auth.ErrBodyTooLarge {
+			utils.ConstructErrorResponse(writer, request, utils.ErrorCodePayloadTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			utils.ConstructErrorResponse(writer, request, utils.ErrorCodeUnauthorized, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next(writer, request.WithContext(auth.WithPrincipal(request.Context(), principal)))
+	}
+}
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"event-delivery-kafka/api/utils"
+	"net/http"
+)
+
+/*
+Handle requests with path "/openapi.json" like
+GET /openapi.json
+Returns the OpenAPI document of the REST API. The document is checked against the real handlers by
+TestHandlersMatchOpenAPISpec, so a route, status code or body that changes without the spec fails the tests.
+*/
+func (s *Server) openAPI(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	utils.ConstructSuccessfulResponse(writer, http.StatusOK, []byte(openAPISpec))
+}
+
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "event-delivery-kafka",
+    "version": "1.0.0",
+    "description": "Accepts events over HTTP and produces them to a Kafka topic, from where they are delivered to every destination. Every error is returned with the same envelope and a stable error code."
+  },
+  "servers": [{"url": "http://localhost:8080"}],
+  "security": [{}, {"apiKey": []}, {"bearer": []}, {"hmac": []}],
+  "paths": {
+    "/events": {
+      "put": {
+        "operationId": "ingestEvent",
+        "summary": "Produce a single event",
+        "description": "Waits until the event is acknowledged by Kafka, unless async ingest is requested with header Prefer: respond-async or query async=true. CloudEvents 1.0 are accepted in structured mode (content type application/cloudevents+json) and in binary mode (ce-* headers with the data in the body).",
+        "parameters": [
+          {"$ref": "#/components/parameters/RequestID"},
+          {"$ref": "#/components/parameters/ContentEncoding"},
+          {"name": "Idempotency-Key", "in": "header", "description": "Retries with the same key (scoped per user) return the stored response. The event_id is used when missing.", "schema": {"type": "string"}},
+          {"name": "Prefer", "in": "header", "description": "respond-async returns 202 before the event is written to Kafka.", "schema": {"type": "string", "enum": ["respond-async"]}},
+          {"name": "async", "in": "query", "description": "Same as Prefer: respond-async.", "schema": {"type": "string", "enum": ["true", "false"]}},
+          {"name": "ce-specversion", "in": "header", "description": "Binary mode CloudEvent, the other attributes are sent as ce-id, ce-source, ce-type, ce-subject, ce-time, ce-dataschema and ce-{extension} headers.", "schema": {"type": "string", "enum": ["1.0"]}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/Event"}},
+            "application/cloudevents+json": {"schema": {"$ref": "#/components/schemas/CloudEvent"}},
+            "*/*": {"schema": {"description": "Data of a binary mode CloudEvent, its content type is the datacontenttype of the event."}}
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The event is stored in Kafka. The body is a json string with a message.",
+            "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+            "content": {"application/json": {"schema": {"type": "string", "example": "Message received and stored successfully"}}}
+          },
+          "202": {
+            "description": "The event is queued, its status can be found at the Location.",
+            "headers": {
+              "X-Request-ID": {"$ref": "#/components/headers/RequestID"},
+              "Location": {"description": "/events/{event_id}", "schema": {"type": "string"}}
+            },
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AsyncResponse"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/SchemaViolation"},
+          "429": {"$ref": "#/components/responses/RateLimited"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/QueueFull"}
+        }
+      }
+    },
+    "/events/batch": {
+      "post": {
+        "operationId": "ingestBatch",
+        "summary": "Produce a batch of events",
+        "description": "Every event is validated on its own. Valid events are produced, invalid ones are reported per item with 207.",
+        "parameters": [
+          {"$ref": "#/components/parameters/RequestID"},
+          {"$ref": "#/components/parameters/ContentEncoding"}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "array", "minItems": 1, "items": {"$ref": "#/components/schemas/Event"}}}}
+        },
+        "responses": {
+          "200": {"$ref": "#/components/responses/Batch"},
+          "207": {"$ref": "#/components/responses/Batch"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/RateLimited"}
+        }
+      }
+    },
+    "/events/stream": {
+      "post": {
+        "operationId": "ingestStream",
+        "summary": "Produce a stream of newline-delimited events",
+        "description": "Lines are produced in micro-batches while the body is read. Only the first rejected lines are reported.",
+        "parameters": [
+          {"$ref": "#/components/parameters/RequestID"},
+          {"$ref": "#/components/parameters/ContentEncoding"}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/x-ndjson": {"schema": {"type": "string", "description": "One Event json per line."}}}
+        },
+        "responses": {
+          "200": {"$ref": "#/components/responses/Stream"},
+          "207": {"$ref": "#/components/responses/Stream"},
+          "400": {
+            "description": "The body could not be read. The micro-batches before the error are already produced, their summary is in the details of the error. The events of the last micro-batch are not produced.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StreamErrorResponse"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "413": {
+            "description": "A stream with a signed digest (X-Auth-Content-Sha256) has more valid events than one micro-batch. Its events are held until the digest is verified, so none of them is produced.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StreamErrorResponse"}}}
+          },
+          "415": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/RateLimited"}
+        }
+      }
+    },
+    "/events/{event_id}": {
+      "get": {
+        "operationId": "getEventStatus",
+        "summary": "Delivery status of an event accepted asynchronously",
+        "parameters": [
+          {"$ref": "#/components/parameters/RequestID"},
+          {"name": "event_id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Status of the event.",
+            "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/EventStatus"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/ratelimits": {
+      "get": {
+        "operationId": "getRateLimits",
+        "summary": "Counters of every rate limiter",
+        "parameters": [{"$ref": "#/components/parameters/RequestID"}],
+        "responses": {
+          "200": {
+            "description": "Counters of every enabled limiter, with the throttled keys.",
+            "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RateLimits"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/circuits": {
+      "get": {
+        "operationId": "getCircuits",
+        "summary": "Circuit breaker of every destination",
+        "description": "While the circuit of a destination is open, its consumers do not fetch events and do not commit offsets.",
+        "parameters": [{"$ref": "#/components/parameters/RequestID"}],
+        "responses": {
+          "200": {
+            "description": "State of the circuit of every destination.",
+            "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Circuits"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "This document",
+        "security": [{}],
+        "responses": {
+          "200": {
+            "description": "OpenAPI document of the REST API.",
+            "content": {"application/json": {"schema": {"type": "object", "required": ["openapi", "paths"]}}}
+          }
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "operationId": "getHealth",
+        "summary": "Liveness probe",
+        "description": "The process is alive. Dependencies are not checked.",
+        "security": [{}],
+        "responses": {
+          "200": {
+            "description": "The process is alive.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}
+          }
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "operationId": "getReadiness",
+        "summary": "Readiness probe",
+        "description": "Checks the broker, the topic, the producer and the consumer of every destination.",
+        "security": [{}],
+        "responses": {
+          "200": {
+            "description": "Every check is ok.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}
+          },
+          "503": {
+            "description": "At least one check failed.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}
+          }
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "operationId": "getMetrics",
+        "summary": "Prometheus metrics",
+        "description": "Requests by route and status, produce latency, delivery attempts, outcomes, retries and timeouts per destination, commit failures and end-to-end latency.",
+        "security": [{}],
+        "responses": {
+          "200": {
+            "description": "Metrics in the Prometheus text format.",
+            "content": {"text/plain; version=0.0.4; charset=utf-8": {"schema": {"type": "string"}}}
+          },
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "apiKey": {"type": "apiKey", "in": "header", "name": "X-API-Key"},
+      "bearer": {"type": "http", "scheme": "bearer", "description": "The API key as bearer token."},
+      "hmac": {"type": "apiKey", "in": "header", "name": "X-Auth-Signature", "description": "Hex HMAC-SHA256 of method, request uri, X-Auth-Timestamp, X-Auth-Nonce and sha256 of the body, joined with new lines. X-Auth-Key-Id, X-Auth-Timestamp and X-Auth-Nonce are required too."}
+    },
+    "parameters": {
+      "RequestID": {"name": "X-Request-ID", "in": "header", "description": "Returned with the response and in error bodies. Generated when missing.", "schema": {"type": "string"}},
+      "ContentEncoding": {"name": "Content-Encoding", "in": "header", "schema": {"type": "string", "enum": ["identity", "gzip", "zstd"]}}
+    },
+    "headers": {
+      "RequestID": {"description": "Id of the request.", "schema": {"type": "string"}},
+      "RetryAfter": {"description": "Seconds to wait before retrying.", "schema": {"type": "integer"}}
+    },
+    "responses": {
+      "Error": {
+        "description": "Error with a stable code.",
+        "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "Unauthorized": {
+        "description": "Missing or invalid credentials.",
+        "headers": {
+          "X-Request-ID": {"$ref": "#/components/headers/RequestID"},
+          "WWW-Authenticate": {"schema": {"type": "string"}}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "SchemaViolation": {
+        "description": "The payload does not match the json schema of its event type.",
+        "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SchemaViolationResponse"}}}
+      },
+      "RateLimited": {
+        "description": "Too many requests, retry after Retry-After seconds.",
+        "headers": {
+          "X-Request-ID": {"$ref": "#/components/headers/RequestID"},
+          "Retry-After": {"$ref": "#/components/headers/RetryAfter"}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "QueueFull": {
+        "description": "Too many events are waiting to be written to Kafka, retry after Retry-After seconds.",
+        "headers": {
+          "X-Request-ID": {"$ref": "#/components/headers/RequestID"},
+          "Retry-After": {"$ref": "#/components/headers/RetryAfter"}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "Batch": {
+        "description": "Result of every event of the batch, 207 when some of them are rejected.",
+        "headers": {
+          "X-Request-ID": {"$ref": "#/components/headers/RequestID"},
+          "Retry-After": {"$ref": "#/components/headers/RetryAfter"}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchResponse"}}}
+      },
+      "Stream": {
+        "description": "Summary of the stream, 207 when some lines are rejected.",
+        "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StreamSummary"}}}
+      }
+    },
+    "schemas": {
+      "Event": {
+        "type": "object",
+        "required": ["user_id", "payload"],
+        "properties": {
+          "user_id": {"type": "string", "minLength": 1, "description": "Key of the Kafka message, events of a user keep their order."},
+          "payload": {"type": "string"},
+          "event_id": {"type": "string", "description": "Deduplicates retries, also the id of async events."},
+          "event_type": {"type": "string", "description": "The payload is validated against the json schema of this type."},
+          "schema_version": {"type": "string", "description": "Version of the payload schema of the event type."},
+          "source": {"type": "string", "description": "Application or service that created the event."},
+          "client_timestamp": {"type": "string", "format": "date-time", "description": "When the event happened according to the client."}
+        }
+      },
+      "CloudEvent": {
+        "type": "object",
+        "required": ["specversion", "id", "source", "type"],
+        "description": "The partitionkey extension, or the subject, is the user_id of the event. Extensions are strings, numbers or booleans.",
+        "properties": {
+          "specversion": {"type": "string", "enum": ["1.0"]},
+          "id": {"type": "string", "minLength": 1},
+          "source": {"type": "string", "minLength": 1},
+          "type": {"type": "string", "minLength": 1},
+          "subject": {"type": "string"},
+          "time": {"type": "string", "format": "date-time"},
+          "datacontenttype": {"type": "string"},
+          "dataschema": {"type": "string"},
+          "data": {},
+          "data_base64": {"type": "string", "format": "byte"},
+          "partitionkey": {"type": "string"},
+          "schemaversion": {"type": "string"}
+        },
+        "additionalProperties": {"type": ["string", "number", "boolean"]}
+      },
+      "AsyncResponse": {
+        "type": "object",
+        "required": ["event_id", "status"],
+        "properties": {
+          "event_id": {"type": "string"},
+          "status": {"type": "string", "enum": ["pending"]}
+        }
+      },
+      "EventStatus": {
+        "type": "object",
+        "required": ["event_id", "status", "updated_at"],
+        "properties": {
+          "event_id": {"type": "string"},
+          "status": {"type": "string", "enum": ["pending", "persisted", "failed"]},
+          "partition": {"type": "integer"},
+          "offset": {"type": "integer", "format": "int64"},
+          "error": {"type": "string"},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Violation": {
+        "type": "object",
+        "required": ["field", "message"],
+        "properties": {
+          "field": {"type": "string"},
+          "message": {"type": "string"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["code", "message"],
+        "properties": {
+          "code": {
+            "type": "string",
+            "enum": ["unauthorized", "not_found", "method_not_allowed", "unsupported_media_type", "unsupported_content_encoding", "invalid_content_encoding", "payload_too_large", "invalid_json", "invalid_event", "invalid_request", "schema_violation", "idempotency_key_in_progress", "queue_full", "rate_limited", "produce_failed", "internal_error"]
+          },
+          "message": {"type": "string"},
+          "details": {"description": "More information about the error, like the violations of schema_violation, retry_after_seconds of rate_limited or the StreamSummary of a stream that could not be read to its end."},
+          "request_id": {"type": "string"}
+        }
+      },
+      "ErrorResponse": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"$ref": "#/components/schemas/Error"}}
+      },
+      "SchemaViolationResponse": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "allOf": [
+              {"$ref": "#/components/schemas/Error"},
+              {"type": "object", "required": ["details"], "properties": {"details": {"type": "array", "items": {"$ref": "#/components/schemas/Violation"}}}}
+            ]
+          }
+        }
+      },
+      "StreamErrorResponse": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "allOf": [
+              {"$ref": "#/components/schemas/Error"},
+              {"type": "object", "properties": {"details": {"$ref": "#/components/schemas/StreamSummary"}}}
+            ]
+          }
+        }
+      },
+      "BatchItemResult": {
+        "type": "object",
+        "required": ["index", "status"],
+        "properties": {
+          "index": {"type": "integer"},
+          "status": {"type": "string", "enum": ["success", "validation_error", "produce_error", "rate_limited", "too_large"]},
+          "error": {"type": "string"},
+          "violations": {"type": "array", "items": {"$ref": "#/components/schemas/Violation"}},
+          "retry_after_seconds": {"type": "number"}
+        }
+      },
+      "BatchResponse": {
+        "type": "object",
+        "required": ["accepted", "rejected", "results"],
+        "properties": {
+          "accepted": {"type": "integer"},
+          "rejected": {"type": "integer"},
+          "results": {"type": "array", "items": {"$ref": "#/components/schemas/BatchItemResult"}}
+        }
+      },
+      "StreamLineError": {
+        "type": "object",
+        "required": ["line", "status", "error"],
+        "properties": {
+          "line": {"type": "integer"},
+          "status": {"type": "string", "enum": ["validation_error", "produce_error", "rate_limited", "too_large"]},
+          "error": {"type": "string"},
+          "violations": {"type": "array", "items": {"$ref": "#/components/schemas/Violation"}}
+        }
+      },
+      "StreamSummary": {
+        "type": "object",
+        "required": ["accepted", "rejected"],
+        "properties": {
+          "accepted": {"type": "integer"},
+          "rejected": {"type": "integer"},
+          "errors": {"type": "array", "items": {"$ref": "#/components/schemas/StreamLineError"}},
+          "errors_truncated": {"type": "boolean"}
+        }
+      },
+      "RateLimiterStats": {
+        "type": "object",
+        "required": ["name", "rate", "burst", "total_allowed", "total_throttled", "throttled"],
+        "properties": {
+          "name": {"type": "string"},
+          "rate": {"type": "number"},
+          "burst": {"type": "integer"},
+          "total_allowed": {"type": "integer"},
+          "total_throttled": {"type": "integer"},
+          "throttled": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["key", "allowed", "throttled"],
+              "properties": {
+                "key": {"type": "string"},
+                "allowed": {"type": "integer"},
+                "throttled": {"type": "integer"}
+              }
+            }
+          }
+        }
+      },
+      "RateLimits": {
+        "type": "object",
+        "required": ["limiters"],
+        "properties": {"limiters": {"type": "array", "items": {"$ref": "#/components/schemas/RateLimiterStats"}}}
+      },
+      "Circuits": {
+        "type": "object",
+        "required": ["circuits"],
+        "properties": {
+          "circuits": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["name", "state", "failures", "opened", "changed_at"],
+              "properties": {
+                "name": {"type": "string", "example": "snowflake"},
+                "state": {"type": "string", "enum": ["closed", "open", "half_open"]},
+                "failures": {"type": "integer", "description": "Consecutive failed attempts."},
+                "opened": {"type": "integer", "description": "Times the circuit opened since the start."},
+                "changed_at": {"type": "string", "format": "date-time"}
+              }
+            }
+          }
+        }
+      },
+      "Health": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {"status": {"type": "string", "enum": ["ok"]}}
+      },
+      "Readiness": {
+        "type": "object",
+        "required": ["status", "checks"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unavailable"]},
+          "checks": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["name", "status", "duration_ms"],
+              "properties": {
+                "name": {"type": "string", "example": "consumer/postgres"},
+                "status": {"type": "string", "enum": ["ok", "failed"]},
+                "error": {"type": "string"},
+                "duration_ms": {"type": "integer"}
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
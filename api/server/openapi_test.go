@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/health"
+	"event-delivery-kafka/api/idempotency"
+	"event-delivery-kafka/api/ratelimit"
+	"event-delivery-kafka/api/tracking"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/delivery/circuitbreaker"
+	"event-delivery-kafka/kafka/components"
+	"event-delivery-kafka/metrics"
+	"event-delivery-kafka/models"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xeipuuv/gojsonschema"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type openAPICase struct {
+	name           string
+	path           string // path of the operation in the spec
+	server         *Server
+	request        *http.Request
+	invalidRequest bool // the request body is expected to violate the request schema
+}
+
+/*
+Sends requests to the real handlers and checks them against the spec:
+every registered route is documented, every documented operation and status code is returned by some request,
+request bodies match the request schemas and response bodies and content types match the documented responses.
+*/
+func TestHandlersMatchOpenAPISpec(t *testing.T) {
+	var spec map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(openAPISpec), &spec))
+
+	plain := newSpecServer(t, &KafkaWriterSuccessMock{})
+	failing := newSpecServer(t, &KafkaWriterFailureMock{})
+	authenticated := newSpecServer(t, &KafkaWriterSuccessMock{})
+	authenticated.Authenticator = auth.APIKeyAuthenticator{}.New(map[string]string{"mobile_sdk": "key_1"})
+	signed := newSpecServer(t, &KafkaWriterSuccessMock{})
+	signed.Authenticator = auth.HMACAuthenticator{}.New(map[string]string{"billing_service": "secret_1"}, 5*time.Minute, 1<<20)
+	inProgress := newSpecServer(t, &KafkaWriterSuccessMock{})
+	inProgress.inFlight.Store("user_test_1/key_1", struct{}{})
+	limited := newSpecServer(t, &KafkaWriterSuccessMock{})
+	limited.CredentialRateLimiter = ratelimit.Limiter{}.New("credential", ratelimit.Config{Rate: 0.001, Burst: 0})
+	full := newSpecServer(t, &KafkaWriterSuccessMock{})
+	for _, server := range []*Server{plain, failing, authenticated, limited} {
+		server.initializeAsync()
+	}
+	full.asyncQueue = make(chan models.KafkaMessage) // without workers, so the queue is always full
+	unready := newSpecServer(t, &KafkaWriterSuccessMock{})
+	unready.Readiness = health.Checker{}.New(1*time.Second, health.Check{Name: "broker", Check: func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}})
+	metered := newSpecServer(t, &KafkaWriterSuccessMock{})
+	metered.Metrics = metrics.Metrics{}.New()
+	breakers := newSpecServer(t, &KafkaWriterSuccessMock{})
+	breakers.Circuits = circuitbreaker.Registry{}.New(circuitbreaker.Config{FailureThreshold: 1})
+	breakers.Circuits.Breaker("snowflake")
+	plain.Tracker.Track("event_1", "")
+
+	event := `{"user_id": "user_test_1", "payload": "event click !!!!"}`
+	structuredCloudEvent := `{"specversion": "1.0", "id": "event_3", "source": "/web", "type": "click.v1", "subject": "user_test_1", "data": {"x": 1}}`
+	largeEvent := `{"user_id": "user_test_1", "payload": "` + strings.Repeat("a", 2048) + `"}`
+	largeStream := strings.Repeat(event+"\n", streamBatchSize+1)
+	cases := []openAPICase{
+		{name: "produce event", path: "/events", server: plain, request: specRequest("PUT", "/events", "application/json", event)},
+		{name: "produce event async", path: "/events", server: plain, request: withHeader(specRequest("PUT", "/events", "application/json", event), "Prefer", "respond-async")},
+		{name: "produce cloudevent", path: "/events", server: plain, request: specRequest("PUT", "/events", "application/cloudevents+json", structuredCloudEvent)},
+		{name: "produce binary cloudevent", path: "/events", server: plain, request: binaryCloudEvent(specRequest("PUT", "/events", "text/plain", "click"))},
+		{name: "invalid cloudevent", path: "/events", server: plain, request: specRequest("PUT", "/events", "application/cloudevents+json", `{"specversion": "0.3"}`)},
+		{name: "invalid json", path: "/events", server: plain, request: specRequest("PUT", "/events", "application/json", `{"user_id":`), invalidRequest: true},
+		{name: "missing credentials", path: "/events", server: authenticated, request: specRequest("PUT", "/events", "application/json", event)},
+		{name: "idempotency key in progress", path: "/events", server: inProgress, request: withHeader(specRequest("PUT", "/events", "application/json", event), "Idempotency-Key", "key_1")},
+		{name: "event too large", path: "/events", server: plain, request: specRequest("PUT", "/events", "application/json", largeEvent)},
+		{name: "wrong content type", path: "/events", server: plain, request: specRequest("PUT", "/events", "text/plain", event)},
+		{name: "schema violation", path: "/events", server: plain, request: specRequest("PUT", "/events", "application/json", `{"user_id": "user_test_1", "event_type": "click", "payload": "{\"x\": \"1\"}"}`)},
+		{name: "rate limited event", path: "/events", server: limited, request: specRequest("PUT", "/events", "application/json", event)},
+		{name: "produce fail", path: "/events", server: failing, request: specRequest("PUT", "/events", "application/json", event)},
+		{name: "async queue full", path: "/events", server: full, request: withHeader(specRequest("PUT", "/events", "application/json", event), "Prefer", "respond-async")},
+
+		{name: "produce batch", path: "/events/batch", server: plain, request: specRequest("POST", "/events/batch", "application/json", "["+event+"]")},
+		{name: "batch with invalid event", path: "/events/batch", server: plain, request: specRequest("POST", "/events/batch", "application/json", `[`+event+`, {"user_id": "", "payload": "click"}]`), invalidRequest: true},
+		{name: "empty batch", path: "/events/batch", server: plain, request: specRequest("POST", "/events/batch", "application/json", "[]"), invalidRequest: true},
+		{name: "batch without credentials", path: "/events/batch", server: authenticated, request: specRequest("POST", "/events/batch", "application/json", "["+event+"]")},
+		{name: "batch too large", path: "/events/batch", server: plain, request: specRequest("POST", "/events/batch", "application/json", "["+strings.Repeat(event+",", 100)+event+"]")},
+		{name: "batch with wrong content type", path: "/events/batch", server: plain, request: specRequest("POST", "/events/batch", "text/plain", "["+event+"]")},
+		{name: "rate limited batch", path: "/events/batch", server: limited, request: specRequest("POST", "/events/batch", "application/json", "["+event+"]")},
+
+		{name: "produce stream", path: "/events/stream", server: plain, request: specRequest("POST", "/events/stream", "application/x-ndjson", event+"\n"+event)},
+		{name: "stream with invalid line", path: "/events/stream", server: plain, request: specRequest("POST", "/events/stream", "application/x-ndjson", event+"\n{")},
+		{name: "stream with invalid encoding", path: "/events/stream", server: plain, request: withHeader(specRequest("POST", "/events/stream", "application/x-ndjson", event), "Content-Encoding", "gzip")},
+		{name: "truncated stream", path: "/events/stream", server: plain, request: withHeader(specRequest("POST", "/events/stream", "application/x-ndjson", truncatedGzip(event+"\n"+event)), "Content-Encoding", "gzip")},
+		{name: "signed stream too large", path: "/events/stream", server: signed, request: signedStreamRequest("nonce_1", largeStream, largeStream)},
+		{name: "stream without credentials", path: "/events/stream", server: authenticated, request: specRequest("POST", "/events/stream", "application/x-ndjson", event)},
+		{name: "stream with wrong content type", path: "/events/stream", server: plain, request: specRequest("POST", "/events/stream", "application/json", event)},
+		{name: "rate limited stream", path: "/events/stream", server: limited, request: specRequest("POST", "/events/stream", "application/x-ndjson", event)},
+
+		{name: "event status", path: "/events/{event_id}", server: plain, request: specRequest("GET", "/events/event_1", "", "")},
+		{name: "event status without credentials", path: "/events/{event_id}", server: authenticated, request: specRequest("GET", "/events/event_1", "", "")},
+		{name: "unknown event status", path: "/events/{event_id}", server: plain, request: specRequest("GET", "/events/unknown", "", "")},
+
+		{name: "rate limits", path: "/ratelimits", server: limited, request: specRequest("GET", "/ratelimits", "", "")},
+		{name: "rate limits without credentials", path: "/ratelimits", server: authenticated, request: specRequest("GET", "/ratelimits", "", "")},
+
+		{name: "circuits", path: "/circuits", server: breakers, request: specRequest("GET", "/circuits", "", "")},
+		{name: "circuits without credentials", path: "/circuits", server: authenticated, request: specRequest("GET", "/circuits", "", "")},
+		{name: "circuits disabled", path: "/circuits", server: plain, request: specRequest("GET", "/circuits", "", "")},
+
+		{name: "openapi", path: "/openapi.json", server: plain, request: specRequest("GET", "/openapi.json", "", "")},
+
+		{name: "health", path: "/healthz", server: authenticated, request: specRequest("GET", "/healthz", "", "")},
+		{name: "ready", path: "/readyz", server: authenticated, request: specRequest("GET", "/readyz", "", "")},
+		{name: "not ready", path: "/readyz", server: unready, request: specRequest("GET", "/readyz", "", "")},
+
+		{name: "metrics", path: "/metrics", server: metered, request: specRequest("GET", "/metrics", "", "")},
+		{name: "metrics disabled", path: "/metrics", server: plain, request: specRequest("GET", "/metrics", "", "")},
+	}
+
+	covered := map[string]bool{}
+	for _, c := range cases {
+		method := strings.ToLower(c.request.Method)
+		operation, ok := specLookup(spec, "paths", c.path, method).(map[string]interface{})
+		if !assert.True(t, ok, "%s: %s %s is not documented", c.name, method, c.path) {
+			continue
+		}
+
+		if requestSchema := specLookup(spec, "paths", c.path, method, "requestBody", "content", "application/json", "schema"); requestSchema != nil && c.request.Header.Get("content-type") == "application/json" {
+			body, _ := c.request.GetBody()
+			var buf bytes.Buffer
+			buf.ReadFrom(body)
+			errs := validateAgainstSpec(spec, requestSchema, buf.Bytes())
+			assert.Equal(t, c.invalidRequest, len(errs) > 0, "%s: request body does not match the spec as expected: %v", c.name, errs)
+		}
+
+		recorder := newRequestRecorder(c.request, c.server.Mux)
+		status := strconv.Itoa(recorder.Code)
+		covered[c.path+" "+method+" "+status] = true
+
+		response, ok := resolveRef(spec, specLookup(operation, "responses", status)).(map[string]interface{})
+		if !assert.True(t, ok, "%s: status %s of %s %s is not documented", c.name, status, method, c.path) {
+			continue
+		}
+		assert.NotEqual(t, "", recorder.Header().Get("X-Request-ID"), c.name)
+
+		contentType := recorder.Header().Get("content-type")
+		mediaType, ok := specLookup(response, "content", contentType).(map[string]interface{})
+		if !assert.True(t, ok, "%s: content type %s of status %s is not documented", c.name, contentType, status) {
+			continue
+		}
+		if contentType == "application/json" {
+			errs := validateAgainstSpec(spec, mediaType["schema"], recorder.Body.Bytes())
+			assert.Equal(t, 0, len(errs), "%s: response %s does not match the spec: %v", c.name, recorder.Body.String(), errs)
+		}
+	}
+
+	// every documented operation and status code is returned by the handlers
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method, operation := range item.(map[string]interface{}) {
+			for status := range operation.(map[string]interface{})["responses"].(map[string]interface{}) {
+				assert.True(t, covered[path+" "+method+" "+status], "%s %s %s is documented but never returned", method, path, status)
+			}
+		}
+	}
+
+	// every registered route is documented, "/" only returns not_found
+	for _, pattern := range plain.patterns {
+		if pattern == "/" {
+			continue
+		}
+		path := pattern
+		if strings.HasSuffix(pattern, "/") {
+			path = pattern + "{event_id}"
+		}
+		assert.NotNil(t, specLookup(spec, "paths", path), "route %s is not documented", pattern)
+	}
+}
+
+func newSpecServer(t *testing.T, writer components.KafkaWriter) *Server {
+	registry := validation.SchemaRegistry{}.New()
+	assert.Nil(t, registry.Register("click", []byte(clickSchema)))
+
+	server := &Server{
+		Mux:              http.NewServeMux(),
+		Producer:         &components.Producer{Writer: writer},
+		IdempotencyStore: idempotency.MemoryStore{}.New(1 * time.Minute),
+		SchemaRegistry:   registry,
+		Tracker:          tracking.Tracker{}.New(1 * time.Minute),
+		MaxEventBytes:    1024,
+		MaxBodyBytes:     4096,
+	}
+	server.initializeRoutes()
+	return server
+}
+
+func specRequest(method string, target string, contentType string, body string) *http.Request {
+	request, _ := http.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	return request
+}
+
+func withHeader(request *http.Request, name string, value string) *http.Request {
+	request.Header.Set(name, value)
+	return request
+}
+
+// gzips body without the trailer, so it fails to decompress only at its end
+func truncatedGzip(body string) string {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	gzipWriter.Write([]byte(body))
+	gzipWriter.Close()
+	return string(buf.Bytes()[:buf.Len()-8])
+}
+
+// walks the spec with the given keys, following $ref. Returns nil when a key is missing
+func specLookup(node interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = object[key]
+	}
+	return node
+}
+
+func resolveRef(spec map[string]interface{}, node interface{}) interface{} {
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return node
+	}
+	ref, ok := object["$ref"].(string)
+	if !ok {
+		return node
+	}
+	return specLookup(spec, strings.Split(strings.TrimPrefix(ref, "#/"), "/")...)
+}
+
+// validates the document against a schema of the spec, resolving the references to components of the spec
+func validateAgainstSpec(spec map[string]interface{}, schema interface{}, document []byte) []string {
+	root := map[string]interface{}{
+		"components":  spec["components"],
+		"definitions": map[string]interface{}{"target": schema},
+		"$ref":        "#/definitions/target",
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(root), gojsonschema.NewBytesLoader(document))
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var errs []string
+	for _, resultErr := range result.Errors() {
+		errs = append(errs, fmt.Sprintf("%s: %s", resultErr.Field(), resultErr.Description()))
+	}
+	sort.Strings(errs)
+	return errs
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/ratelimit"
+	"event-delivery-kafka/api/utils"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RateLimitsResponse struct {
+	Limiters []ratelimit.Stats `json:"limiters"`
+}
+
+/*
+Limits the requests of every credential (authenticated principal). When authentication is disabled, requests are
+limited by the address of the client. Disabled when s.CredentialRateLimiter is nil.
+*/
+func (s *Server) limitCredential(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if s.CredentialRateLimiter == nil {
+			next(writer, request)
+			return
+		}
+
+		key := credentialKey(request)
+		if allowed, retryAfter := s.CredentialRateLimiter.Allow(key); !allowed {
+			constructRateLimitedResponse(writer, request, retryAfter, "too many requests for credential "+key)
+			return
+		}
+		next(writer, request)
+	}
+}
+
+// Limits the events of every user. Always allowed when s.UserRateLimiter is nil.
+func (s *Server) allowUser(userID string) (bool, time.Duration) {
+	if s.UserRateLimiter == nil {
+		return true, 0
+	}
+	return s.UserRateLimiter.Allow(userID)
+}
+
+func credentialKey(request *http.Request) string {
+	if principal := auth.PrincipalFromContext(request.Context()); principal != nil {
+		return principal.ID
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func constructRateLimitedResponse(writer http.ResponseWriter, request *http.Request, retryAfter time.Duration, message string) {
+	setRetryAfter(writer, retryAfter)
+	utils.ConstructErrorResponseWithDetails(writer, request, utils.ErrorCodeRateLimited, message, http.StatusTooManyRequests, map[string]float64{
+		"retry_after_seconds": retryAfter.Seconds(),
+	})
+}
+
+// Retry-After is in whole seconds, so it is rounded up to never ask clients to retry too early
+func setRetryAfter(writer http.ResponseWriter, retryAfter time.Duration) {
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+/*
+Handle requests with path "/ratelimits" like
+GET /ratelimits
+Returns the counters of every rate limiter, with the users and credentials that are being throttled.
+*/
+func (s *Server) rateLimits(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := RateLimitsResponse{Limiters: []ratelimit.Stats{}}
+	for _, limiter := range []*ratelimit.Limiter{s.UserRateLimiter, s.CredentialRateLimiter} {
+		if limiter != nil {
+			response.Limiters = append(response.Limiters, limiter.Stats())
+		}
+	}
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.ConstructSuccessfulResponse(writer, http.StatusOK, responseBytes)
+}
@@ -1,5 +1,30 @@
 package server
 
+import (
+	"event-delivery-kafka/api/utils"
+	"net/http"
+)
+
 func (s *Server) initializeRoutes() {
-	s.Mux.HandleFunc("/events", s.events)
-}
\ No newline at end of file
+	s.handle("/events", s.authenticate(s.limitCredential(s.events)))
+	s.handle("/events/batch", s.authenticate(s.limitCredential(s.batch)))
+	s.handle("/events/stream", s.authenticate(s.limitCredential(s.stream)))
+	s.handle("/events/", s.authenticate(s.eventStatus))
+	s.handle("/ratelimits", s.authenticate(s.rateLimits))
+	s.handle("/circuits", s.authenticate(s.circuits))
+	s.handle("/openapi.json", s.openAPI)
+	s.handle("/healthz", s.healthz)
+	s.handle("/readyz", s.readyz)
+	s.handle("/metrics", s.metrics)
+	s.handle("/", s.notFound)
+}
+
+// registers the handler wrapped with the middlewares shared by all routes
+func (s *Server) handle(pattern string, handler http.HandlerFunc) {
+	s.patterns = append(s.patterns, pattern)
+	s.Mux.HandleFunc(pattern, s.withRequestID(s.withMetrics(pattern, handler)))
+}
+
+func (s *Server) notFound(writer http.ResponseWriter, request *http.Request) {
+	utils.ConstructErrorResponse(writer, request, utils.ErrorCodeNotFound, "no route for "+request.URL.Path, http.StatusNotFound)
+}
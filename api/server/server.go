@@ -1,13 +1,31 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/health"
+	"event-delivery-kafka/api/idempotency"
+	"event-delivery-kafka/api/ratelimit"
+	"event-delivery-kafka/api/tracking"
 	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/delivery/circuitbreaker"
 	"event-delivery-kafka/kafka/components"
+	"event-delivery-kafka/logging"
+	"event-delivery-kafka/metrics"
 	"event-delivery-kafka/models"
 	"fmt"
-	"io/ioutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,19 +36,93 @@ Use "mux := http.NewServeMux()" instead
 So as a rule of thumb it's a good idea to avoid the DefaultServeMux, and instead
 use your own locally-scoped ServeMux, like we have been so far.
 Check section "The DefaultServeMux" on article.
+Initialize blocks until Shutdown is called and then returns nil, or returns the error of the listener.
 */
-func (s *Server) Initialize(port string) {
+func (s *Server) Initialize(port string) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil
+	}
 	s.initializeRoutes()
-	err := http.ListenAndServe(port, s.Mux)
-	if err != nil {
-		s.Producer.Close()
-		panic(err)
+	s.initializeAsync()
+	s.httpServer = &http.Server{Addr: port, Handler: s.Mux}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+/*
+Stops accepting requests of the REST and the gRPC API, waits for the requests in progress and then for the events
+accepted asynchronously to be written to Kafka, up to the deadline of ctx. Events still queued at the deadline are
+lost and their status stays pending. The producer is not closed, it belongs to the caller.
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	httpServer, grpcServer := s.httpServer, s.grpcServer
+	s.mu.Unlock()
+
+	var errs []string
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, "http: "+err.Error())
+		}
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+			errs = append(errs, "grpc: "+ctx.Err().Error())
+		}
 	}
+	if err := s.drainAsync(ctx); err != nil {
+		errs = append(errs, "async: "+err.Error())
+	}
+
+	if len(errs) > 0 {
+		return errors.New("failed to shut down server gracefully: " + strings.Join(errs, ", "))
+	}
+	return nil
 }
 
 type Server struct {
-	Mux     *http.ServeMux
-	Producer *components.Producer
+	Mux                   *http.ServeMux
+	Producer              *components.Producer
+	IdempotencyStore      idempotency.Store          // optional, requests are not deduplicated when nil
+	SchemaRegistry        *validation.SchemaRegistry // optional, payloads are not validated against schemas when nil
+	Authenticator         auth.Authenticator         // optional, requests are not authenticated when nil
+	UserRateLimiter       *ratelimit.Limiter         // optional, events of a user are not limited when nil
+	CredentialRateLimiter *ratelimit.Limiter         // optional, requests of a credential are not limited when nil
+	MaxEventBytes         int64                      // max size of a decompressed event, 1MB when 0
+	MaxBodyBytes          int64                      // max size of a decompressed batch request, 10MB when 0
+	Tracker               *tracking.Tracker          // optional, async ingest is disabled when nil
+	AsyncQueueSize        int                        // max events waiting to be written asynchronously, 10000 when 0
+	AsyncWorkers          int                        // goroutines writing the queued events, 4 when 0
+	Readiness             *health.Checker            // optional, /readyz reports ready without checks when nil
+	Metrics               *metrics.Metrics           // optional, requests are not counted and /metrics is not found when nil
+	Circuits              *circuitbreaker.Registry   // optional, /circuits is not found when nil
+	Logger                *zap.Logger                // optional, errors that are not returned to the clients are not logged when nil
+	inFlight              sync.Map                   // idempotency keys of requests that are being processed
+	asyncQueue            chan models.KafkaMessage   // events accepted asynchronously, not yet sent to kafka
+	patterns              []string                   // registered routes, every one of them should be in the OpenAPI spec
+	asyncWorkers          sync.WaitGroup             // goroutines writing the events of asyncQueue
+	asyncMu               sync.RWMutex               // guards sends to asyncQueue against closing it
+	asyncClosed           bool
+	mu                    sync.Mutex                 // guards the listeners and closing
+	httpServer            *http.Server
+	grpcServer            *grpc.Server
+	closing               bool // set by Shutdown, listeners are not started after it
 }
 
 /**
@@ -43,43 +135,161 @@ func (s *Server) events(writer http.ResponseWriter, request *http.Request) {
 		s.ingest(writer, request)
 		return
 	default:
-		utils.ConstructErrorResponse(writer, "method not allowed", http.StatusMethodNotAllowed)
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 }
 
 func (s *Server) ingest(writer http.ResponseWriter, request *http.Request) {
-	bodyBytes, err := ioutil.ReadAll(request.Body)
 	defer request.Body.Close()
-	if err != nil {
-		utils.ConstructErrorResponse(writer, err.Error(), http.StatusInternalServerError)
+	writer, request, endSpan := traceRequest("ingest", "/events", writer, request)
+	defer endSpan()
+	ct := request.Header.Get("content-type")
+	cloudEvent := isCloudEvent(request)
+	if ct != "application/json" && !cloudEvent {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeUnsupportedMediaType, fmt.Sprintf("need content-type 'application/json', but got '%s'", ct), http.StatusUnsupportedMediaType)
 		return
 	}
 
-	ct := request.Header.Get("content-type")
-	if ct != "application/json" {
-		utils.ConstructErrorResponse(writer, fmt.Sprintf("need content-type 'application/json', but got '%s'", ct), http.StatusUnsupportedMediaType)
+	bodyBytes, err := s.readBody(request, s.maxEventBytes())
+	if err != nil {
+		constructBodyErrorResponse(writer, request, err)
 		return
 	}
 
 	var event models.Event
-	err = json.Unmarshal(bodyBytes, &event)
-	if err != nil {
-		utils.ConstructErrorResponse(writer, err.Error(), http.StatusBadRequest)
+	if cloudEvent {
+		parsed, err := cloudEventFromRequest(request, bodyBytes)
+		if err != nil {
+			constructCloudEventErrorResponse(writer, request, err)
+			return
+		}
+		event = *parsed
+	} else if err := json.Unmarshal(bodyBytes, &event); err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidJSON, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if event.UserID == "" {
-		utils.ConstructErrorResponse(writer, "UserID should be provided", http.StatusBadRequest)
+	trace.SpanFromContext(request.Context()).SetAttributes(
+		attribute.String("event.id", event.EventID),
+		attribute.String("event.type", event.EventType),
+	)
+	if err := s.validateEvent(event); err != nil {
+		constructValidationErrorResponse(writer, request, err)
+		return
+	}
+
+	key := idempotencyKey(request, event)
+	if key != "" && s.IdempotencyStore != nil {
+		if response, ok := s.IdempotencyStore.Get(key); ok {
+			writer.Header().Set("Idempotent-Replayed", "true")
+			utils.ConstructSuccessfulResponse(writer, response.StatusCode, response.Body)
+			return
+		}
+
+		// a retry that arrives while the original request is still producing should not produce a second message
+		if _, loaded := s.inFlight.LoadOrStore(key, struct{}{}); loaded {
+			utils.ConstructErrorResponse(writer, request, utils.ErrorCodeIdempotencyKeyInProgress, "a request with the same idempotency key is in progress", http.StatusConflict)
+			return
+		}
+		defer s.inFlight.Delete(key)
+	}
+
+	if allowed, retryAfter := s.allowUser(event.UserID); !allowed {
+		constructRateLimitedResponse(writer, request, retryAfter, "too many events for user "+event.UserID)
+		return
+	}
+
+	if s.respondAsync(request) {
+		s.ingestAsync(writer, request, event, key)
 		return
 	}
 
-	kafkaMessage := models.KafkaMessage{}.New(event.UserID, event.Payload, time.Now())
+	kafkaMessage := s.newKafkaMessage(request.Context(), event, time.Now())
 	err = s.Producer.Send(request.Context(), *kafkaMessage)
 	if err != nil {
-		utils.ConstructErrorResponse(writer, err.Error(), http.StatusInternalServerError)
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeProduceFailed, err.Error(), http.StatusInternalServerError)
 		return
 	} else {
-		utils.ConstructSuccessfulResponse(writer, http.StatusOK, []byte("Message received and stored successfully"))
+		s.storeIdempotencyResponse(key, idempotency.Response{StatusCode: http.StatusOK, Body: ingestedResponseBody})
+		utils.ConstructSuccessfulResponse(writer, http.StatusOK, ingestedResponseBody)
 	}
-}
\ No newline at end of file
+}
+
+const ingestedMessage = "Message received and stored successfully"
+
+/*
+Body of the 200 response of PUT /events, the message as a json string. The gRPC API stores it as its idempotency
+response too, so a retry gets the same response from either API.
+*/
+var ingestedResponseBody = []byte(`"` + ingestedMessage + `"`)
+
+// the response is replayed to retries of the request with the same idempotency key
+func (s *Server) storeIdempotencyResponse(key string, response idempotency.Response) {
+	if key == "" || s.IdempotencyStore == nil {
+		return
+	}
+	if err := s.IdempotencyStore.Set(key, response); err != nil {
+		logging.OrNop(s.Logger).Error("failed to store idempotency key", zap.String("idempotency_key", key), zap.Error(err))
+	}
+}
+
+// builds the message produced for an event, with the metadata of the envelope, the principal that sent the request
+// and the trace context of the request
+func (s *Server) newKafkaMessage(ctx context.Context, event models.Event, timestamp time.Time) *models.KafkaMessage {
+	kafkaMessage := models.KafkaMessage{}.New(event.UserID, event.Payload, timestamp)
+	kafkaMessage.EventID = event.EventID
+	kafkaMessage.EventType = event.EventType
+	kafkaMessage.SchemaVersion = event.SchemaVersion
+	kafkaMessage.Source = event.Source
+	kafkaMessage.ClientTimestamp = event.ClientTimestamp
+	kafkaMessage.SpecVersion = event.SpecVersion
+	kafkaMessage.Subject = event.Subject
+	kafkaMessage.DataContentType = event.DataContentType
+	kafkaMessage.DataSchema = event.DataSchema
+	kafkaMessage.Extensions = event.Extensions
+	if principal := auth.PrincipalFromContext(ctx); principal != nil {
+		kafkaMessage.Principal = principal.ID
+	}
+	kafkaMessage.TraceContext = map[string]string{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(kafkaMessage.TraceContext))
+	return kafkaMessage
+}
+
+/*
+Requests are deduplicated with the Idempotency-Key header or, if it is missing, with the event_id of the event.
+Keys are scoped per user, so two users can never collide on the same key.
+*/
+func idempotencyKey(request *http.Request, event models.Event) string {
+	key := request.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = event.EventID
+	}
+	if key == "" {
+		return ""
+	}
+	return event.UserID + "/" + key
+}
+
+func (s *Server) validateEvent(event models.Event) error {
+	if event.UserID == "" {
+		return errors.New("UserID should be provided")
+	}
+	if s.SchemaRegistry != nil && event.EventType != "" {
+		return s.SchemaRegistry.Validate(event.EventType, event.Payload)
+	}
+	return nil
+}
+
+/*
+Payloads that do not match the schema of their event type are rejected with 422 and the list of violations as details.
+Any other invalid event is a bad request.
+*/
+func constructValidationErrorResponse(writer http.ResponseWriter, request *http.Request, err error) {
+	var validationErr *validation.ValidationError
+	if errors.As(err, &validationErr) {
+		utils.ConstructErrorResponseWithDetails(writer, request, utils.ErrorCodeSchemaViolation, err.Error(), http.StatusUnprocessableEntity, validationErr.Violations)
+		return
+	}
+	utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInvalidEvent, err.Error(), http.StatusBadRequest)
+}
@@ -1,18 +1,36 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/health"
+	"event-delivery-kafka/api/idempotency"
+	"event-delivery-kafka/api/ratelimit"
+	"event-delivery-kafka/api/tracking"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/api/validation"
 	"event-delivery-kafka/kafka/components"
+	"event-delivery-kafka/metrics"
+	"event-delivery-kafka/tracing"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
-type KafkaWriterSuccessMock struct {}
+type KafkaWriterSuccessMock struct{}
 
 func (mock *KafkaWriterSuccessMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
 	return nil
@@ -32,10 +50,10 @@ func TestReceiveEventAndProduceSuccessfully(t *testing.T) {
 	addReq.Header.Add("Content-Type", "application/json")
 	addReqRecorder := newRequestRecorder(addReq, mux)
 	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
-	assert.Equal(t, "Message received and stored successfully", addReqRecorder.Body.String())
+	assert.Equal(t, `"Message received and stored successfully"`, addReqRecorder.Body.String())
 }
 
-type KafkaWriterFailureMock struct {}
+type KafkaWriterFailureMock struct{}
 
 func (mock *KafkaWriterFailureMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
 	return errors.New("kafka.(*Writer): Topic must not be specified for both Writer and Message")
@@ -54,7 +72,9 @@ func TestReceiveEventAndProduceFail(t *testing.T) {
 	addReq.Header.Add("Content-Type", "application/json")
 	addReqRecorder := newRequestRecorder(addReq, mux)
 	assert.Equal(t, http.StatusInternalServerError, addReqRecorder.Code)
-	assert.Equal(t, "kafka.(*Writer): Topic must not be specified for both Writer and Message", addReqRecorder.Body.String())
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeProduceFailed, errorResponse.Error.Code)
+	assert.Equal(t, "kafka.(*Writer): Topic must not be specified for both Writer and Message", errorResponse.Error.Message)
 }
 
 //curl -X PUT -H "Content-Type: application/xml" -d '{"user_id": "user_test_1", "payload": "event click !!!!"}' localhost:8080/events
@@ -67,7 +87,9 @@ func TestReceiveEventWithWrongContentType(t *testing.T) {
 	addReq.Header.Add("Content-Type", "application/xml")
 	addReqRecorder := newRequestRecorder(addReq, mux)
 	assert.Equal(t, http.StatusUnsupportedMediaType, addReqRecorder.Code)
-	assert.Equal(t, "need content-type 'application/json', but got 'application/xml'", addReqRecorder.Body.String())
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeUnsupportedMediaType, errorResponse.Error.Code)
+	assert.Equal(t, "need content-type 'application/json', but got 'application/xml'", errorResponse.Error.Message)
 }
 
 //curl -X PUT -H "Content-Type: application/json" -d '{"book_id": "user_test_1", "payload": "Book 123"}' localhost:8080/events
@@ -80,7 +102,9 @@ func TestReceiveEventWithoutUserId(t *testing.T) {
 	addReq.Header.Add("Content-Type", "application/json")
 	addReqRecorder := newRequestRecorder(addReq, mux)
 	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
-	assert.Equal(t, "UserID should be provided", addReqRecorder.Body.String())
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeInvalidEvent, errorResponse.Error.Code)
+	assert.Equal(t, "UserID should be provided", errorResponse.Error.Message)
 }
 
 //curl -X PUT -H "Content-Type: application/json" -d '{"user_id": "", "payload": "Book 123"}' localhost:8080/events
@@ -93,10 +117,1150 @@ func TestReceiveEventWithEmptyUserId(t *testing.T) {
 	addReq.Header.Add("Content-Type", "application/json")
 	addReqRecorder := newRequestRecorder(addReq, mux)
 	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
-	assert.Equal(t, "UserID should be provided", addReqRecorder.Body.String())
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeInvalidEvent, errorResponse.Error.Code)
+	assert.Equal(t, "UserID should be provided", errorResponse.Error.Message)
+}
+
+func TestReceiveEventWithInvalidJson(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader("{\"user_id\": "))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeInvalidJSON, errorResponse.Error.Code)
+}
+
+func TestErrorResponseWithMethodNotAllowed(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	for _, path := range []string{"/events", "/events/batch", "/events/stream"} {
+		addReq, _ := http.NewRequest("DELETE", path, nil)
+		addReqRecorder := newRequestRecorder(addReq, mux)
+		assert.Equal(t, http.StatusMethodNotAllowed, addReqRecorder.Code)
+		errorResponse := decodeErrorResponse(t, addReqRecorder)
+		assert.Equal(t, utils.ErrorCodeMethodNotAllowed, errorResponse.Error.Code)
+	}
+}
+
+func TestErrorResponseWithUnknownRoute(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	addReq, _ := http.NewRequest("GET", "/unknown", nil)
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusNotFound, addReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeNotFound, errorResponse.Error.Code)
+}
+
+func TestErrorResponseKeepsRequestIdOfClient(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterFailureMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "{\"user_id\": \"\", \"payload\": \"Book 123\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("X-Request-ID", "request_test_1")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, "request_test_1", addReqRecorder.Header().Get("X-Request-ID"))
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, "request_test_1", errorResponse.Error.RequestID)
+}
+
+type KafkaWriterPartialFailureMock struct{}
+
+// fails every second message of the batch
+func (mock *KafkaWriterPartialFailureMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	writeErrors := make(kafka.WriteErrors, len(msgs))
+	for i := range msgs {
+		if i%2 == 1 {
+			writeErrors[i] = errors.New("kafka: leader not available")
+		}
+	}
+	return writeErrors
+}
+
+func (mock *KafkaWriterPartialFailureMock) Close() error {
+	return nil
+}
+
+// curl -X POST -H "Content-Type: application/json" -d '[{"user_id": "user_test_1", "payload": "click 1"}, {"user_id": "user_test_2", "payload": "click 2"}]' localhost:8080/events/batch
+func TestReceiveBatchAndProduceSuccessfully(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "[{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}, {\"user_id\": \"user_test_2\", \"payload\": \"click 2\"}]"
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Accepted)
+	assert.Equal(t, 0, response.Rejected)
+	assert.Equal(t, BatchItemSucceeded, response.Results[0].Status)
+	assert.Equal(t, BatchItemSucceeded, response.Results[1].Status)
+}
+
+func TestReceiveBatchWithInvalidEvent(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "[{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}, {\"user_id\": \"\", \"payload\": \"click 2\"}]"
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Accepted)
+	assert.Equal(t, 1, response.Rejected)
+	assert.Equal(t, BatchItemSucceeded, response.Results[0].Status)
+	assert.Equal(t, 1, response.Results[1].Index)
+	assert.Equal(t, BatchItemValidationError, response.Results[1].Status)
+	assert.Equal(t, "UserID should be provided", response.Results[1].Error)
+}
+
+func TestReceiveBatchAndProducePartially(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterPartialFailureMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "[{\"user_id\": \"\", \"payload\": \"click 0\"}, {\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}, {\"user_id\": \"user_test_2\", \"payload\": \"click 2\"}]"
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Accepted)
+	assert.Equal(t, 2, response.Rejected)
+	assert.Equal(t, BatchItemValidationError, response.Results[0].Status)
+	assert.Equal(t, BatchItemSucceeded, response.Results[1].Status)
+	assert.Equal(t, BatchItemProduceError, response.Results[2].Status)
+	assert.Equal(t, "kafka: leader not available", response.Results[2].Error)
+}
+
+func TestReceiveBatchAndProduceFail(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterFailureMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "[{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}, {\"user_id\": \"user_test_2\", \"payload\": \"click 2\"}]"
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, 0, response.Accepted)
+	assert.Equal(t, 2, response.Rejected)
+	assert.Equal(t, BatchItemProduceError, response.Results[0].Status)
+	assert.Equal(t, BatchItemProduceError, response.Results[1].Status)
+}
+
+type KafkaWriterCountingMock struct {
+	Calls    int
+	Messages int
+}
+
+func (mock *KafkaWriterCountingMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	mock.Calls++
+	mock.Messages += len(msgs)
+	return nil
+}
+
+func (mock *KafkaWriterCountingMock) Close() error {
+	return nil
+}
+
+func TestReceiveStreamAndProduceInMicroBatches(t *testing.T) {
+	writerMock := &KafkaWriterCountingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlers(producerMock)
+
+	var body strings.Builder
+	for i := 0; i < 1200; i++ {
+		body.WriteString(fmt.Sprintf("{\"user_id\": \"user_test_%d\", \"payload\": \"click\"}\n", i))
+	}
+	addReq, _ := http.NewRequest("POST", "/events/stream", strings.NewReader(body.String()))
+	addReq.Header.Add("Content-Type", "application/x-ndjson")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	var summary StreamSummary
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &summary))
+	assert.Equal(t, 1200, summary.Accepted)
+	assert.Equal(t, 0, summary.Rejected)
+	assert.Equal(t, 3, writerMock.Calls)
+	assert.Equal(t, 1200, writerMock.Messages)
+}
+
+func TestReceiveStreamWithRejectedLines(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}\n" +
+		"\n" +
+		"{\"user_id\": \"\", \"payload\": \"click 3\"}\n" +
+		"not json\n" +
+		"{\"user_id\": \"user_test_5\", \"payload\": \"" + strings.Repeat("a", defaultMaxEventBytes) + "\"}\n" +
+		"{\"user_id\": \"user_test_6\", \"payload\": \"click 6\"}"
+	addReq, _ := http.NewRequest("POST", "/events/stream", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/x-ndjson")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var summary StreamSummary
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &summary))
+	assert.Equal(t, 2, summary.Accepted)
+	assert.Equal(t, 3, summary.Rejected)
+	assert.Equal(t, 3, summary.Errors[0].Line)
+	assert.Equal(t, "UserID should be provided", summary.Errors[0].Error)
+	assert.Equal(t, 4, summary.Errors[1].Line)
+	assert.Equal(t, 5, summary.Errors[2].Line)
+	assert.Equal(t, BatchItemTooLarge, summary.Errors[2].Status)
+}
+
+func TestReceiveStreamAndProduceFail(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterFailureMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}\n{\"user_id\": \"user_test_2\", \"payload\": \"click 2\"}\n"
+	addReq, _ := http.NewRequest("POST", "/events/stream", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/x-ndjson")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var summary StreamSummary
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &summary))
+	assert.Equal(t, 0, summary.Accepted)
+	assert.Equal(t, 2, summary.Rejected)
+	assert.Equal(t, BatchItemProduceError, summary.Errors[1].Status)
+}
+
+func TestReceiveTruncatedStream(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	body := truncatedGzip("{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}\n{\"user_id\": \"user_test_2\", \"payload\": \"click 2\"}")
+	addReq, _ := http.NewRequest("POST", "/events/stream", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/x-ndjson")
+	addReq.Header.Add("Content-Encoding", "gzip")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
+
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeInvalidEncoding, errorResponse.Error.Code)
+	assert.Equal(t, "can not decompress request body: unexpected EOF", errorResponse.Error.Message)
+	// the first event is read before the error, but it is not produced
+	summary := errorResponse.Error.Details.(map[string]interface{})
+	assert.Equal(t, float64(0), summary["accepted"])
+	assert.Equal(t, float64(0), summary["rejected"])
+}
+
+func TestReceiveEventWithRepeatedIdempotencyKey(t *testing.T) {
+	writerMock := &KafkaWriterCountingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlersWithIdempotency(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	for i := 0; i < 2; i++ {
+		addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+		addReq.Header.Add("Content-Type", "application/json")
+		addReq.Header.Add("Idempotency-Key", "key_1")
+		addReqRecorder := newRequestRecorder(addReq, mux)
+		assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+		assert.Equal(t, `"Message received and stored successfully"`, addReqRecorder.Body.String())
+		if i == 1 {
+			assert.Equal(t, "true", addReqRecorder.Header().Get("Idempotent-Replayed"))
+		}
+	}
+
+	assert.Equal(t, 1, writerMock.Messages)
+}
+
+func TestReceiveEventWithRepeatedEventId(t *testing.T) {
+	writerMock := &KafkaWriterCountingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlersWithIdempotency(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\", \"event_id\": \"event_1\"}"
+	for i := 0; i < 2; i++ {
+		addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+		addReq.Header.Add("Content-Type", "application/json")
+		addReqRecorder := newRequestRecorder(addReq, mux)
+		assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+	}
+
+	// same event id for another user is a different event
+	body = "{\"user_id\": \"user_test_2\", \"payload\": \"event click !!!!\", \"event_id\": \"event_1\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	assert.Equal(t, 2, writerMock.Messages)
+}
+
+func TestReceiveEventWithIdempotencyKeyAfterProduceFail(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterFailureMock{}}
+	mux := initializeHandlersWithIdempotency(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("Idempotency-Key", "key_1")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusInternalServerError, addReqRecorder.Code)
+
+	// failed requests are not stored, so the retry produces again
+	producerMock.Writer = &KafkaWriterSuccessMock{}
+	addReq, _ = http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("Idempotency-Key", "key_1")
+	addReqRecorder = newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+	assert.Equal(t, "", addReqRecorder.Header().Get("Idempotent-Replayed"))
+}
+
+const clickSchema = `{
+	"type": "object",
+	"properties": {"element_id": {"type": "string"}, "x": {"type": "integer"}},
+	"required": ["element_id"]
+}`
+
+// curl -X PUT -H "Content-Type: application/json" -d '{"user_id": "user_test_1", "event_type": "click", "payload": "{\"x\": \"1\"}"}' localhost:8080/events
+func TestReceiveEventWithPayloadNotMatchingSchema(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithSchemas(t, producerMock)
+
+	body := `{"user_id": "user_test_1", "event_type": "click", "payload": "{\"x\": \"1\"}"}`
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusUnprocessableEntity, addReqRecorder.Code)
+
+	var response struct {
+		Error struct {
+			Code    string                 `json:"code"`
+			Details []validation.Violation `json:"details"`
+		} `json:"error"`
+	}
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, utils.ErrorCodeSchemaViolation, response.Error.Code)
+	assert.Equal(t, 2, len(response.Error.Details))
+	assert.Equal(t, "(root)", response.Error.Details[0].Field)
+	assert.Equal(t, "element_id is required", response.Error.Details[0].Message)
+	assert.Equal(t, "x", response.Error.Details[1].Field)
+}
+
+func TestReceiveEventWithPayloadMatchingSchema(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithSchemas(t, producerMock)
+
+	body := `{"user_id": "user_test_1", "event_type": "click", "payload": "{\"element_id\": \"button\", \"x\": 1}"}`
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	// event types without a registered schema are not validated
+	body = `{"user_id": "user_test_1", "event_type": "scroll", "payload": "not json"}`
+	addReq, _ = http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder = newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+}
+
+func TestReceiveBatchWithPayloadNotMatchingSchema(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithSchemas(t, producerMock)
+
+	body := `[{"user_id": "user_test_1", "event_type": "click", "payload": "{\"element_id\": \"button\"}"}, {"user_id": "user_test_2", "event_type": "click", "payload": "not json"}]`
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, BatchItemSucceeded, response.Results[0].Status)
+	assert.Equal(t, BatchItemValidationError, response.Results[1].Status)
+	assert.Equal(t, "payload", response.Results[1].Violations[0].Field)
+}
+
+type KafkaWriterCapturingMock struct {
+	Messages []kafka.Message
+}
+
+func (mock *KafkaWriterCapturingMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	mock.Messages = append(mock.Messages, msgs...)
+	return nil
+}
+
+func (mock *KafkaWriterCapturingMock) Close() error {
+	return nil
+}
+
+func TestReceiveEventWithoutCredentials(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithAuthentication(producerMock)
+
+	for _, path := range []string{"/events", "/events/batch", "/events/stream"} {
+		addReq, _ := http.NewRequest("PUT", path, strings.NewReader("{}"))
+		addReq.Header.Add("Content-Type", "application/json")
+		addReqRecorder := newRequestRecorder(addReq, mux)
+		assert.Equal(t, http.StatusUnauthorized, addReqRecorder.Code)
+		errorResponse := decodeErrorResponse(t, addReqRecorder)
+		assert.Equal(t, utils.ErrorCodeUnauthorized, errorResponse.Error.Code)
+	}
+}
+
+// curl -X PUT -H "Content-Type: application/json" -H "X-API-Key: key_1" -d '{"user_id": "user_test_1", "payload": "event click !!!!"}' localhost:8080/events
+func TestReceiveEventWithAPIKeyAndProduceWithPrincipal(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlersWithAuthentication(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("X-API-Key", "key_1")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	assert.Equal(t, 1, len(writerMock.Messages))
+	assert.Equal(t, "mobile_sdk", components.HeaderValue(writerMock.Messages[0], components.HeaderPrincipal))
+}
+
+func TestReceiveSignedStreamLargerThanMaxBodyBytes(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	server := &Server{
+		Mux:           http.NewServeMux(),
+		Producer:      &components.Producer{Writer: writerMock},
+		Authenticator: auth.HMACAuthenticator{}.New(map[string]string{"billing_service": "secret_1"}, 5*time.Minute, 1024),
+		MaxBodyBytes:  1024,
+	}
+	server.initializeRoutes()
+
+	body := strings.Repeat("{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}\n", 100)
+	addReq := signedStreamRequest("nonce_1", body, body)
+	addReqRecorder := newRequestRecorder(addReq, server.Mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+	var summary StreamSummary
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &summary))
+	assert.Equal(t, 100, summary.Accepted)
+	assert.Equal(t, "billing_service", components.HeaderValue(writerMock.Messages[0], components.HeaderPrincipal))
+
+	// a body that does not match the signed digest is rejected when the stream ends, none of its events is produced
+	writerMock.Messages = nil
+	addReq = signedStreamRequest("nonce_2", body, body+body)
+	addReqRecorder = newRequestRecorder(addReq, server.Mux)
+	assert.Equal(t, http.StatusUnauthorized, addReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeUnauthorized, errorResponse.Error.Code)
+	assert.Equal(t, auth.ErrBodyTampered.Error(), errorResponse.Error.Message)
+	assert.Equal(t, 0, len(writerMock.Messages))
+
+	// the events of a signed stream are held until its end, so it can not be larger than one micro-batch
+	largeBody := strings.Repeat("{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}\n", streamBatchSize+1)
+	addReq = signedStreamRequest("nonce_3", largeBody, largeBody)
+	addReqRecorder = newRequestRecorder(addReq, server.Mux)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, addReqRecorder.Code)
+	errorResponse = decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodePayloadTooLarge, errorResponse.Error.Code)
+	assert.Equal(t, 0, len(writerMock.Messages))
+}
+
+// curl -X PUT -H "Content-Type: application/json" -d '{"user_id": "user_test_1", "payload": "event click !!!!", "event_id": "event_1", "event_type": "click", "schema_version": "2", "source": "web", "client_timestamp": "2022-07-01T10:00:00.5Z"}' localhost:8080/events
+func TestReceiveEventAndProduceEnvelopeAsHeaders(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlers(producerMock)
+
+	body := `{"user_id": "user_test_1", "payload": "event click !!!!", "event_id": "event_1", "event_type": "click", "schema_version": "2", "source": "web", "client_timestamp": "2022-07-01T10:00:00.5Z"}`
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	assert.Equal(t, 1, len(writerMock.Messages))
+	message := writerMock.Messages[0]
+	assert.Equal(t, "click", components.HeaderValue(message, components.HeaderEventType))
+	assert.Equal(t, "2022-07-01T10:00:00.5Z", components.HeaderValue(message, components.HeaderClientTimestamp))
+
+	// consumers rebuild the envelope from the headers
+	event := components.EventFromMessage(message)
+	assert.Equal(t, "user_test_1", event.UserID)
+	assert.Equal(t, "event click !!!!", event.Payload)
+	assert.Equal(t, "event_1", event.EventID)
+	assert.Equal(t, "click", event.EventType)
+	assert.Equal(t, "2", event.SchemaVersion)
+	assert.Equal(t, "web", event.Source)
+	assert.Equal(t, time.Date(2022, 7, 1, 10, 0, 0, 500000000, time.UTC), event.ClientTimestamp.UTC())
+	assert.Equal(t, message.Time, event.ReceivedAt)
+	assert.Equal(t, "", event.Principal)
+}
+
+// curl -X PUT -H "Content-Type: application/cloudevents+json" -d '{"specversion": "1.0", "id": "event_1", "source": "/web", "type": "click.v1", "subject": "user_test_1", "time": "2022-07-01T10:00:00Z", "datacontenttype": "application/json", "data": {"x": 1}, "schemaversion": "2"}' localhost:8080/events
+func TestReceiveStructuredCloudEventAndProduceWithBinding(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlers(producerMock)
+
+	body := `{"specversion": "1.0", "id": "event_1", "source": "/web", "type": "click.v1", "subject": "user_test_1", "time": "2022-07-01T10:00:00Z", "datacontenttype": "application/json", "data": {"x": 1}, "schemaversion": "2"}`
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/cloudevents+json; charset=utf-8")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	assert.Equal(t, 1, len(writerMock.Messages))
+	message := writerMock.Messages[0]
+	assert.Equal(t, "user_test_1", string(message.Key))
+	assert.Equal(t, `{"x": 1}`, string(message.Value))
+	assert.Equal(t, "1.0", components.HeaderValue(message, components.CloudEventsHeaderPrefix+"specversion"))
+	assert.Equal(t, "event_1", components.HeaderValue(message, components.CloudEventsHeaderPrefix+"id"))
+	assert.Equal(t, "2", components.HeaderValue(message, components.CloudEventsHeaderPrefix+"schemaversion"))
+	assert.Equal(t, "application/json", components.HeaderValue(message, components.HeaderContentType))
+	assert.Equal(t, "", components.HeaderValue(message, components.HeaderEventID))
+
+	// destinations of CloudEvents receive the same event
+	cloudEvent := components.CloudEventFromMessage(message)
+	assert.Equal(t, "event_1", cloudEvent.ID)
+	assert.Equal(t, "/web", cloudEvent.Source)
+	assert.Equal(t, "click.v1", cloudEvent.Type)
+	assert.Equal(t, "user_test_1", cloudEvent.Subject)
+	assert.Equal(t, time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC), cloudEvent.Time.UTC())
+	assert.Equal(t, `{"x": 1}`, string(cloudEvent.Data))
+	assert.Equal(t, "2", cloudEvent.Extensions["schemaversion"])
+	assert.Equal(t, "", cloudEvent.Extensions["partitionkey"])
+}
+
+// curl -X PUT -H "Content-Type: text/plain" -H "ce-specversion: 1.0" -H "ce-id: event_2" -H "ce-source: /web" -H "ce-type: click.v1" -H "ce-partitionkey: user_test_1" -d 'click' localhost:8080/events
+func TestReceiveBinaryCloudEventAndProduceWithBinding(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlers(producerMock)
+
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader("click"))
+	addReq.Header.Add("Content-Type", "text/plain")
+	addReq = binaryCloudEvent(addReq)
+	addReq.Header.Add("ce-traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusOK, addReqRecorder.Code)
+
+	assert.Equal(t, 1, len(writerMock.Messages))
+	message := writerMock.Messages[0]
+	assert.Equal(t, "user_test_1", string(message.Key))
+	assert.Equal(t, "click", string(message.Value))
+	assert.Equal(t, "text/plain", components.HeaderValue(message, components.HeaderContentType))
+	assert.Equal(t, "/web site", components.HeaderValue(message, components.CloudEventsHeaderPrefix+"source"))
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", components.HeaderValue(message, components.CloudEventsHeaderPrefix+"traceparent"))
+
+	event := components.EventFromMessage(message)
+	assert.Equal(t, "user_test_1", event.UserID)
+	assert.Equal(t, "event_2", event.EventID)
+	assert.Equal(t, "click.v1", event.EventType)
+
+	cloudEvent := components.CloudEventFromMessage(message)
+	assert.Equal(t, `"click"`, string(cloudEvent.Data))
+	assert.Equal(t, "user_test_1", cloudEvent.Extensions["partitionkey"])
+}
+
+func TestReceiveInvalidCloudEvents(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	cases := []struct {
+		body string
+		code string
+	}{
+		{body: `{"specversion": "1.0", "id": "event_1", "source": "/web"`, code: utils.ErrorCodeInvalidJSON},
+		{body: `["specversion"]`, code: utils.ErrorCodeInvalidJSON},
+		{body: `{"specversion": "0.3", "id": "event_1", "source": "/web", "type": "click.v1", "subject": "user_test_1"}`, code: utils.ErrorCodeInvalidEvent},
+		{body: `{"specversion": "1.0", "source": "/web", "type": "click.v1", "subject": "user_test_1"}`, code: utils.ErrorCodeInvalidEvent},
+		{body: `{"specversion": "1.0", "id": "event_1", "source": "/web", "type": "click.v1"}`, code: utils.ErrorCodeInvalidEvent},
+		{body: `{"specversion": "1.0", "id": "event_1", "source": "/web", "type": "click.v1", "subject": "user_test_1", "time": "yesterday"}`, code: utils.ErrorCodeInvalidEvent},
+		{body: `{"specversion": "1.0", "id": "event_1", "source": "/web", "type": "click.v1", "subject": "user_test_1", "Tenant": "a"}`, code: utils.ErrorCodeInvalidEvent},
+	}
+	for _, c := range cases {
+		addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(c.body))
+		addReq.Header.Add("Content-Type", "application/cloudevents+json")
+		addReqRecorder := newRequestRecorder(addReq, mux)
+		assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code, c.body)
+		assert.Equal(t, c.code, decodeErrorResponse(t, addReqRecorder).Error.Code, c.body)
+	}
+
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader("click"))
+	addReq = binaryCloudEvent(addReq)
+	addReq.Header.Set("ce-time", "yesterday")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
+	assert.Equal(t, utils.ErrorCodeInvalidEvent, decodeErrorResponse(t, addReqRecorder).Error.Code)
+}
+
+func TestReceiveEventWithInvalidAPIKey(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithAuthentication(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("X-API-Key", "key_2")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusUnauthorized, addReqRecorder.Code)
+}
+
+func TestReceiveEventsOverUserRateLimit(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithRateLimits(producerMock)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	codes := make([]int, 3)
+	var lastRecorder *httptest.ResponseRecorder
+	for i := range codes {
+		addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+		addReq.Header.Add("Content-Type", "application/json")
+		lastRecorder = newRequestRecorder(addReq, mux)
+		codes[i] = lastRecorder.Code
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+	assert.NotEqual(t, "", lastRecorder.Header().Get("Retry-After"))
+	errorResponse := decodeErrorResponse(t, lastRecorder)
+	assert.Equal(t, utils.ErrorCodeRateLimited, errorResponse.Error.Code)
+
+	statsReq, _ := http.NewRequest("GET", "/ratelimits", nil)
+	statsRecorder := newRequestRecorder(statsReq, mux)
+	assert.Equal(t, http.StatusOK, statsRecorder.Code)
+	var stats RateLimitsResponse
+	assert.Nil(t, json.Unmarshal(statsRecorder.Body.Bytes(), &stats))
+	assert.Equal(t, "user", stats.Limiters[0].Name)
+	assert.Equal(t, "user_test_1", stats.Limiters[0].Throttled[0].Key)
+	assert.Equal(t, uint64(1), stats.Limiters[0].Throttled[0].Throttled)
+}
+
+func TestReceiveBatchOverUserRateLimit(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithRateLimits(producerMock)
+
+	body := "[{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}, {\"user_id\": \"user_test_1\", \"payload\": \"click 2\"}, {\"user_id\": \"user_test_1\", \"payload\": \"click 3\"}]"
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+	assert.NotEqual(t, "", addReqRecorder.Header().Get("Retry-After"))
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Accepted)
+	assert.Equal(t, BatchItemRateLimited, response.Results[2].Status)
+}
+
+func TestReceiveCompressedEvents(t *testing.T) {
+	writerMock := &KafkaWriterCapturingMock{}
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlers(producerMock)
+
+	body := []byte("{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}")
+	var gzipBody bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipBody)
+	gzipWriter.Write(body)
+	gzipWriter.Close()
+
+	zstdEncoder, _ := zstd.NewWriter(nil)
+	zstdBody := zstdEncoder.EncodeAll(body, nil)
+
+	for encoding, compressed := range map[string][]byte{"gzip": gzipBody.Bytes(), "zstd": zstdBody} {
+		addReq, _ := http.NewRequest("PUT", "/events", bytes.NewReader(compressed))
+		addReq.Header.Add("Content-Type", "application/json")
+		addReq.Header.Add("Content-Encoding", encoding)
+		addReqRecorder := newRequestRecorder(addReq, mux)
+		assert.Equal(t, http.StatusOK, addReqRecorder.Code, encoding)
+	}
+
+	assert.Equal(t, 2, len(writerMock.Messages))
+	assert.Equal(t, "event click !!!!", string(writerMock.Messages[1].Value))
+}
+
+func TestReceiveEventLargerThanMaxEventSize(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithMaxSizes(producerMock, 100, 300)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"" + strings.Repeat("a", 100) + "\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, addReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodePayloadTooLarge, errorResponse.Error.Code)
+}
+
+func TestReceiveCompressedBodyThatExpandsOverLimit(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithMaxSizes(producerMock, 1024, 4096)
+
+	// 10MB of zeros compress to a few KB
+	var gzipBody bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipBody)
+	gzipWriter.Write(make([]byte, 10<<20))
+	gzipWriter.Close()
+
+	addReq, _ := http.NewRequest("PUT", "/events", bytes.NewReader(gzipBody.Bytes()))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("Content-Encoding", "gzip")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, addReqRecorder.Code)
+}
+
+func TestReceiveZstdStreamWithWindowOverLimit(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	var zstdBody bytes.Buffer
+	zstdWriter, _ := zstd.NewWriter(&zstdBody)
+	zstdWriter.Write([]byte("{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}\n"))
+	zstdWriter.Close()
+	// the window descriptor of the frame header claims a 16MB window, that the decoder of a stream would allocate
+	compressed := zstdBody.Bytes()
+	compressed[5] = 14 << 3
+
+	addReq, _ := http.NewRequest("POST", "/events/stream", bytes.NewReader(compressed))
+	addReq.Header.Add("Content-Type", "application/x-ndjson")
+	addReq.Header.Add("Content-Encoding", "zstd")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeInvalidEncoding, errorResponse.Error.Code)
+}
+
+func TestReceiveEventWithUnsupportedEncoding(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlers(producerMock)
+
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader("{}"))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("Content-Encoding", "br")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusUnsupportedMediaType, addReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeUnsupportedEncoding, errorResponse.Error.Code)
+
+	addReq, _ = http.NewRequest("PUT", "/events", strings.NewReader("not gzip"))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("Content-Encoding", "gzip")
+	addReqRecorder = newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusBadRequest, addReqRecorder.Code)
+	errorResponse = decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeInvalidEncoding, errorResponse.Error.Code)
+}
+
+func TestReceiveBatchWithEventLargerThanMaxEventSize(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithMaxSizes(producerMock, 100, 1024)
+
+	body := "[{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"}, {\"user_id\": \"user_test_2\", \"payload\": \"" + strings.Repeat("a", 100) + "\"}]"
+	addReq, _ := http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusMultiStatus, addReqRecorder.Code)
+
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.Equal(t, BatchItemSucceeded, response.Results[0].Status)
+	assert.Equal(t, BatchItemTooLarge, response.Results[1].Status)
+
+	// whole body over the limit
+	body = "[" + strings.Repeat("{\"user_id\": \"user_test_1\", \"payload\": \"click 1\"},", 30) + "{}]"
+	addReq, _ = http.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder = newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, addReqRecorder.Code)
+}
+
+type KafkaWriterReportingMock struct {
+	Producer *components.Producer
+	offset   int64
+}
+
+// reports the partition and offset of every message with an event id, like kafka.Writer.Completion
+func (mock *KafkaWriterReportingMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, message := range msgs {
+		mock.offset++
+		mock.Producer.OnDelivery(components.DeliveryReport{
+			EventID:   components.HeaderValue(message, components.HeaderEventID),
+			Principal: components.HeaderValue(message, components.HeaderPrincipal),
+			Partition: 2,
+			Offset:    mock.offset,
+		})
+	}
+	return nil
+}
+
+func (mock *KafkaWriterReportingMock) Close() error {
+	return nil
+}
+
+// curl -X PUT -H "Content-Type: application/json" -H "Prefer: respond-async" -d '{"user_id": "user_test_1", "payload": "event click !!!!"}' localhost:8080/events
+func TestReceiveEventAsyncAndLookUpStatus(t *testing.T) {
+	producerMock := &components.Producer{}
+	producerMock.Writer = &KafkaWriterReportingMock{Producer: producerMock}
+	mux := initializeHandlersWithAsync(producerMock, 10)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReq.Header.Add("Prefer", "respond-async")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusAccepted, addReqRecorder.Code)
+
+	var response AsyncResponse
+	assert.Nil(t, json.Unmarshal(addReqRecorder.Body.Bytes(), &response))
+	assert.NotEqual(t, "", response.EventID)
+	assert.Equal(t, tracking.StatusPending, response.Status)
+	assert.Equal(t, "/events/"+response.EventID, addReqRecorder.Header().Get("Location"))
+
+	var record tracking.Record
+	assert.Eventually(t, func() bool {
+		getReq, _ := http.NewRequest("GET", "/events/"+response.EventID, nil)
+		getReqRecorder := newRequestRecorder(getReq, mux)
+		assert.Equal(t, http.StatusOK, getReqRecorder.Code)
+		assert.Nil(t, json.Unmarshal(getReqRecorder.Body.Bytes(), &record))
+		return record.Status != tracking.StatusPending
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, tracking.StatusPersisted, record.Status)
+	assert.Equal(t, 2, *record.Partition)
+	assert.Equal(t, int64(1), *record.Offset)
+}
+
+func TestReceiveEventAsyncWithSameEventIDOfTwoPrincipals(t *testing.T) {
+	producerMock := &components.Producer{}
+	producerMock.Writer = &KafkaWriterReportingMock{Producer: producerMock}
+	server := Server{
+		Mux:            http.NewServeMux(),
+		Producer:       producerMock,
+		Authenticator:  auth.APIKeyAuthenticator{}.New(map[string]string{"mobile_sdk": "key_1", "web_sdk": "key_2"}),
+		Tracker:        tracking.Tracker{}.New(1 * time.Minute),
+		AsyncQueueSize: 10,
+		AsyncWorkers:   1,
+	}
+	server.initializeRoutes()
+	server.initializeAsync()
+
+	// event ids are scoped by principal, so the second principal neither conflicts with the first nor learns of it
+	for _, apiKey := range []string{"key_1", "key_2"} {
+		body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\", \"event_id\": \"event_1\"}"
+		addReq, _ := http.NewRequest("PUT", "/events?async=true", strings.NewReader(body))
+		addReq.Header.Add("Content-Type", "application/json")
+		addReq.Header.Add("X-API-Key", apiKey)
+		addReqRecorder := newRequestRecorder(addReq, server.Mux)
+		assert.Equal(t, http.StatusAccepted, addReqRecorder.Code)
+	}
+
+	offsets := map[int64]bool{}
+	for _, apiKey := range []string{"key_1", "key_2"} {
+		var record tracking.Record
+		assert.Eventually(t, func() bool {
+			getReq, _ := http.NewRequest("GET", "/events/event_1", nil)
+			getReq.Header.Add("X-API-Key", apiKey)
+			getReqRecorder := newRequestRecorder(getReq, server.Mux)
+			assert.Equal(t, http.StatusOK, getReqRecorder.Code)
+			assert.Nil(t, json.Unmarshal(getReqRecorder.Body.Bytes(), &record))
+			return record.Status != tracking.StatusPending
+		}, 1*time.Second, 10*time.Millisecond)
+		assert.Equal(t, tracking.StatusPersisted, record.Status)
+		offsets[*record.Offset] = true
+	}
+	assert.Equal(t, 2, len(offsets))
+}
+
+func TestReceiveEventAsyncAndProduceFail(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterFailureMock{}}
+	mux := initializeHandlersWithAsync(producerMock, 10)
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\", \"event_id\": \"event_1\"}"
+	addReq, _ := http.NewRequest("PUT", "/events?async=true", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, mux)
+	assert.Equal(t, http.StatusAccepted, addReqRecorder.Code)
+
+	var record tracking.Record
+	assert.Eventually(t, func() bool {
+		getReq, _ := http.NewRequest("GET", "/events/event_1", nil)
+		getReqRecorder := newRequestRecorder(getReq, mux)
+		assert.Nil(t, json.Unmarshal(getReqRecorder.Body.Bytes(), &record))
+		return record.Status != tracking.StatusPending
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, tracking.StatusFailed, record.Status)
+	assert.Equal(t, "kafka.(*Writer): Topic must not be specified for both Writer and Message", record.Error)
+}
+
+type KafkaWriterBlockingMock struct {
+	Release chan struct{}
+}
+
+func (mock *KafkaWriterBlockingMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	<-mock.Release
+	return nil
+}
+
+func (mock *KafkaWriterBlockingMock) Close() error {
+	return nil
+}
+
+func TestReceiveEventAsyncWithFullQueue(t *testing.T) {
+	writerMock := &KafkaWriterBlockingMock{Release: make(chan struct{})}
+	defer close(writerMock.Release)
+	producerMock := &components.Producer{Writer: writerMock}
+	mux := initializeHandlersWithAsync(producerMock, 1)
+
+	// one event is taken by the blocked worker and one waits in the queue, so the third one is rejected at the latest
+	var addReqRecorder *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+		addReq, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+		addReq.Header.Add("Content-Type", "application/json")
+		addReq.Header.Add("Prefer", "respond-async")
+		addReqRecorder = newRequestRecorder(addReq, mux)
+		if addReqRecorder.Code != http.StatusAccepted {
+			break
+		}
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, addReqRecorder.Code)
+	assert.Equal(t, "1", addReqRecorder.Header().Get("Retry-After"))
+	errorResponse := decodeErrorResponse(t, addReqRecorder)
+	assert.Equal(t, utils.ErrorCodeQueueFull, errorResponse.Error.Code)
+}
+
+func TestShutdownWritesQueuedAsyncEvents(t *testing.T) {
+	writerMock := &KafkaWriterBlockingMock{Release: make(chan struct{})}
+	tracker := tracking.Tracker{}.New(1 * time.Minute)
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: writerMock}, Tracker: tracker, AsyncQueueSize: 10, AsyncWorkers: 1}
+	server.initializeRoutes()
+	server.initializeAsync()
+
+	for i := 0; i < 3; i++ {
+		body := fmt.Sprintf("{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\", \"event_id\": \"event_%d\"}", i)
+		addReq, _ := http.NewRequest("PUT", "/events?async=true", strings.NewReader(body))
+		addReq.Header.Add("Content-Type", "application/json")
+		assert.Equal(t, http.StatusAccepted, newRequestRecorder(addReq, server.Mux).Code)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(writerMock.Release)
+	assert.Nil(t, <-shutdown)
+	for i := 0; i < 3; i++ {
+		record, _ := tracker.Get(fmt.Sprintf("event_%d", i), "")
+		assert.Equal(t, tracking.StatusPersisted, record.Status)
+	}
+
+	// events accepted after shutdown are rejected like with a full queue
+	addReq, _ := http.NewRequest("PUT", "/events?async=true", strings.NewReader("{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"))
+	addReq.Header.Add("Content-Type", "application/json")
+	addReqRecorder := newRequestRecorder(addReq, server.Mux)
+	assert.Equal(t, http.StatusServiceUnavailable, addReqRecorder.Code)
+}
+
+func TestShutdownStopsWaitingAtDeadline(t *testing.T) {
+	writerMock := &KafkaWriterBlockingMock{Release: make(chan struct{})}
+	defer close(writerMock.Release)
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: writerMock}, Tracker: tracking.Tracker{}.New(1 * time.Minute), AsyncWorkers: 1}
+	server.initializeRoutes()
+	server.initializeAsync()
+
+	body := "{\"user_id\": \"user_test_1\", \"payload\": \"event click !!!!\"}"
+	addReq, _ := http.NewRequest("PUT", "/events?async=true", strings.NewReader(body))
+	addReq.Header.Add("Content-Type", "application/json")
+	assert.Equal(t, http.StatusAccepted, newRequestRecorder(addReq, server.Mux).Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+}
+
+func TestInitializeReturnsAfterShutdown(t *testing.T) {
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: &KafkaWriterSuccessMock{}}}
+	served := make(chan error, 2)
+	go func() {
+		served <- server.Initialize("127.0.0.1:0")
+	}()
+	go func() {
+		served <- server.InitializeGRPC("127.0.0.1:0")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, server.Shutdown(context.Background()))
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-served:
+			assert.Nil(t, err)
+		case <-time.After(1 * time.Second):
+			t.Fatal("server did not stop after shutdown")
+		}
+	}
+}
+
+func TestDrainAsyncWritesOnlyTheQueuedEvents(t *testing.T) {
+	writer := &KafkaWriterCapturingMock{}
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: writer}, Tracker: tracking.Tracker{}.New(1 * time.Minute), AsyncWorkers: 1}
+	server.initializeRoutes()
+	server.initializeAsync()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("PUT", "/events?async=true", strings.NewReader(`{"user_id": "user_test_1", "payload": "event click !!!!"}`))
+		req.Header.Set("Content-Type", "application/json")
+		assert.Equal(t, http.StatusAccepted, newRequestRecorder(req, server.Mux).Code)
+	}
+	assert.Nil(t, server.drainAsync(context.Background()))
+
+	// a closed queue yields no empty messages
+	assert.Equal(t, 3, len(writer.Messages))
+	for _, message := range writer.Messages {
+		assert.Equal(t, "user_test_1", string(message.Key))
+	}
+}
+
+// curl localhost:8080/readyz
+func TestReadinessReportsEveryCheck(t *testing.T) {
+	consumerRunning := true
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: &KafkaWriterSuccessMock{}}}
+	server.Readiness = health.Checker{}.New(1*time.Second,
+		health.Check{Name: "producer", Check: server.Producer.Writable},
+		health.Check{Name: "consumer/postgres", Check: func(ctx context.Context) error {
+			if !consumerRunning {
+				return errors.New("consumer of postgres is not running")
+			}
+			return nil
+		}},
+	)
+	server.initializeRoutes()
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	recorder := newRequestRecorder(req, server.Mux)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var report health.Report
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Equal(t, 2, len(report.Checks))
+
+	consumerRunning = false
+	server.Producer.Close()
+	recorder = newRequestRecorder(req, server.Mux)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, health.StatusUnavailable, report.Status)
+	assert.Equal(t, "producer is closed", report.Checks[0].Error)
+	assert.Equal(t, "consumer of postgres is not running", report.Checks[1].Error)
+
+	// liveness does not depend on the checks
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	recorder = newRequestRecorder(req, server.Mux)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"status":"ok"}`, recorder.Body.String())
+}
+
+// curl localhost:8080/metrics
+func TestMetricsCountRequestsAndProduceLatency(t *testing.T) {
+	m := metrics.Metrics{}.New()
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: &KafkaWriterSuccessMock{}, Metrics: m}, Metrics: m}
+	server.initializeRoutes()
+
+	for _, body := range []string{`{"user_id": "user_test_1", "payload": "event click !!!!"}`, `{"user_id": "user_test_1", "payload": "event click !!!!"}`, `{"user_id": ""}`} {
+		req, _ := http.NewRequest("PUT", "/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		newRequestRecorder(req, server.Mux)
+	}
+	req, _ := http.NewRequest("GET", "/events/unknown", nil)
+	newRequestRecorder(req, server.Mux)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	recorder := newRequestRecorder(req, server.Mux)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	body := recorder.Body.String()
+	assert.Contains(t, body, `event_delivery_ingest_requests_total{protocol="http",route="/events",status="200"} 2`)
+	assert.Contains(t, body, `event_delivery_ingest_requests_total{protocol="http",route="/events",status="400"} 1`)
+	assert.Contains(t, body, `event_delivery_ingest_requests_total{protocol="http",route="/events/",status="404"} 1`)
+	assert.Contains(t, body, `event_delivery_produce_duration_seconds_count{result="success"} 2`)
+	assert.Contains(t, body, `event_delivery_produced_messages_total{result="success"} 2`)
+}
+
+// curl -X PUT -H "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" ...
+func TestTraceContextOfRequestIsProducedWithTheMessage(t *testing.T) {
+	_, err := tracing.Provider{}.New(tracing.Config{})
+	assert.Nil(t, err)
+	writer := &KafkaWriterCapturingMock{}
+	server := &Server{Mux: http.NewServeMux(), Producer: &components.Producer{Writer: writer}, Tracker: tracking.Tracker{}.New(1 * time.Minute), AsyncWorkers: 1}
+	server.initializeRoutes()
+	server.initializeAsync()
+
+	for _, prefer := range []string{"", "respond-async"} {
+		req, _ := http.NewRequest("PUT", "/events", strings.NewReader(`{"user_id": "user_test_1", "payload": "event click !!!!"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", prefer)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		recorder := newRequestRecorder(req, server.Mux)
+		assert.True(t, recorder.Code == http.StatusOK || recorder.Code == http.StatusAccepted)
+	}
+	assert.Nil(t, server.drainAsync(context.Background()))
+
+	assert.Equal(t, 2, len(writer.Messages))
+	for _, message := range writer.Messages {
+		traceparent := components.HeaderValue(message, "traceparent")
+		assert.True(t, strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"), traceparent)
+		assert.Nil(t, components.ExtractTraceContext(context.Background(), message).Err())
+	}
+}
+
+func TestEventStatusOfUnknownEvent(t *testing.T) {
+	producerMock := &components.Producer{Writer: &KafkaWriterSuccessMock{}}
+	mux := initializeHandlersWithAsync(producerMock, 10)
+
+	getReq, _ := http.NewRequest("GET", "/events/unknown", nil)
+	getReqRecorder := newRequestRecorder(getReq, mux)
+	assert.Equal(t, http.StatusNotFound, getReqRecorder.Code)
+	errorResponse := decodeErrorResponse(t, getReqRecorder)
+	assert.Equal(t, utils.ErrorCodeNotFound, errorResponse.Error.Code)
+}
+
+// Decodes the json error envelope and checks the fields that every error response should have
+func decodeErrorResponse(t *testing.T, recorder *httptest.ResponseRecorder) utils.ErrorResponse {
+	assert.Equal(t, "application/json", recorder.Header().Get("content-type"))
+
+	var errorResponse utils.ErrorResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &errorResponse))
+	assert.NotEqual(t, "", errorResponse.Error.Message)
+	assert.NotEqual(t, "", errorResponse.Error.RequestID)
+	assert.Equal(t, recorder.Header().Get("X-Request-ID"), errorResponse.Error.RequestID)
+	return errorResponse
 }
 
 // Mocks a handler and returns a httptest.ResponseRecorder
+// adds the required attributes of a binary mode CloudEvent, values are percent-encoded like the HTTP binding
+func binaryCloudEvent(request *http.Request) *http.Request {
+	request.Header.Set("ce-specversion", "1.0")
+	request.Header.Set("ce-id", "event_2")
+	request.Header.Set("ce-source", "/web%20site")
+	request.Header.Set("ce-type", "click.v1")
+	request.Header.Set("ce-partitionkey", "user_test_1")
+	return request
+}
+
 func newRequestRecorder(req *http.Request, mux *http.ServeMux) *httptest.ResponseRecorder {
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
@@ -110,9 +1274,102 @@ func initializeHandlers(producerMock *components.Producer) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	server := Server{
-		Mux:     mux,
+		Mux:      mux,
 		Producer: producerMock,
 	}
-	mux.HandleFunc("/events", server.events)
+	server.initializeRoutes()
+	return mux
+}
+
+func initializeHandlersWithIdempotency(producerMock *components.Producer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	server := Server{
+		Mux:              mux,
+		Producer:         producerMock,
+		IdempotencyStore: idempotency.MemoryStore{}.New(1 * time.Minute),
+	}
+	server.initializeRoutes()
+	return mux
+}
+
+func initializeHandlersWithSchemas(t *testing.T, producerMock *components.Producer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	registry := validation.SchemaRegistry{}.New()
+	assert.Nil(t, registry.Register("click", []byte(clickSchema)))
+
+	server := Server{
+		Mux:            mux,
+		Producer:       producerMock,
+		SchemaRegistry: registry,
+	}
+	server.initializeRoutes()
 	return mux
-}
\ No newline at end of file
+}
+
+func initializeHandlersWithAuthentication(producerMock *components.Producer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	server := Server{
+		Mux:           mux,
+		Producer:      producerMock,
+		Authenticator: auth.APIKeyAuthenticator{}.New(map[string]string{"mobile_sdk": "key_1"}),
+	}
+	server.initializeRoutes()
+	return mux
+}
+
+// signs a stream request with the digest of signedBody and sends body
+func signedStreamRequest(nonce string, signedBody string, body string) *http.Request {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := sha256.Sum256([]byte(signedBody))
+	request, _ := http.NewRequest("POST", "/events/stream", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	request.Header.Set(auth.HMACKeyIDHeader, "billing_service")
+	request.Header.Set(auth.HMACTimestampHeader, timestamp)
+	request.Header.Set(auth.HMACNonceHeader, nonce)
+	request.Header.Set(auth.HMACDigestHeader, hex.EncodeToString(digest[:]))
+	request.Header.Set(auth.HMACSignatureHeader, hex.EncodeToString(auth.Sign([]byte("secret_1"), "POST", "/events/stream", timestamp, nonce, []byte(signedBody))))
+	return request
+}
+
+func initializeHandlersWithRateLimits(producerMock *components.Producer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	server := Server{
+		Mux:             mux,
+		Producer:        producerMock,
+		UserRateLimiter: ratelimit.Limiter{}.New("user", ratelimit.Config{Rate: 0.001, Burst: 2}),
+	}
+	server.initializeRoutes()
+	return mux
+}
+
+func initializeHandlersWithMaxSizes(producerMock *components.Producer, maxEventBytes int64, maxBodyBytes int64) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	server := Server{
+		Mux:           mux,
+		Producer:      producerMock,
+		MaxEventBytes: maxEventBytes,
+		MaxBodyBytes:  maxBodyBytes,
+	}
+	server.initializeRoutes()
+	return mux
+}
+
+func initializeHandlersWithAsync(producerMock *components.Producer, queueSize int) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	server := Server{
+		Mux:            mux,
+		Producer:       producerMock,
+		Tracker:        tracking.Tracker{}.New(1 * time.Minute),
+		AsyncQueueSize: queueSize,
+		AsyncWorkers:   1,
+	}
+	server.initializeRoutes()
+	server.initializeAsync()
+	return mux
+}
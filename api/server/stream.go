@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"event-delivery-kafka/api/auth"
+	"event-delivery-kafka/api/utils"
+	"event-delivery-kafka/api/validation"
+	"event-delivery-kafka/models"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	streamBatchSize         = 500 // max events sent to kafka with one Producer.Send call
+	maxReportedStreamErrors = 100 // only the first rejected lines are reported back to the client
+)
+
+type StreamLineError struct {
+	Line       int                    `json:"line"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error"`
+	Violations []validation.Violation `json:"violations,omitempty"`
+}
+
+type StreamSummary struct {
+	Accepted        int               `json:"accepted"`
+	Rejected        int               `json:"rejected"`
+	Errors          []StreamLineError `json:"errors,omitempty"`
+	ErrorsTruncated bool              `json:"errors_truncated,omitempty"`
+}
+
+/*
+Handle requests with path "/events/stream" like
+POST /events/stream
+*/
+func (s *Server) stream(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "POST":
+		s.ingestStream(writer, request)
+		return
+	default:
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+/*
+Accepts newline-delimited json (one event per line) over a single long-lived request. The body is never read as a
+whole. Lines are decoded one by one and the valid events are sent to Kafka in micro-batches of streamBatchSize events,
+so memory stays bounded by the batch size and the max event size, no matter how large the body is.
+When the body is consumed, a summary with accepted and rejected lines is returned.
+A body with a signed digest is verified only at its end (see auth.VerifiedAtEnd), so its events are held in memory
+until then and such a stream can not have more than streamBatchSize valid events.
+*/
+func (s *Server) ingestStream(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+
+	ct := request.Header.Get("content-type")
+	if ct != "application/x-ndjson" {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeUnsupportedMediaType, fmt.Sprintf("need content-type 'application/x-ndjson', but got '%s'", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// the stream as a whole is not limited, only every line (event) is
+	body, err := s.requestBody(request, 0)
+	if err != nil {
+		constructBodyErrorResponse(writer, request, err)
+		return
+	}
+	defer body.Close()
+
+	ingestor := &streamIngestor{
+		server: s,
+		ctx:    request.Context(),
+		batch:  make([]models.KafkaMessage, 0, streamBatchSize),
+		lines:  make([]int, 0, streamBatchSize),
+		hold:   auth.VerifiedAtEnd(request),
+	}
+
+	reader := bufio.NewReaderSize(body, 64*1024)
+	var buf []byte
+	lineNumber := 0
+	for {
+		var tooLong bool
+		var err error
+		buf, tooLong, err = readLine(reader, buf[:0], int(s.maxEventBytes()))
+		if err != nil && err != io.EOF {
+			// the events of the current micro-batch are not produced, a body with an error may be tampered
+			constructStreamErrorResponse(writer, request, err, ingestor.summary)
+			return
+		}
+
+		if err == nil || len(buf) > 0 || tooLong {
+			lineNumber++
+			line := bytes.TrimSpace(buf)
+			if len(line) > 0 || tooLong { // blank lines are skipped
+				ingestor.add(lineNumber, line, tooLong)
+			}
+		}
+		if ingestor.hold && len(ingestor.batch) > streamBatchSize {
+			utils.ConstructErrorResponseWithDetails(writer, request, utils.ErrorCodePayloadTooLarge, fmt.Sprintf("a stream with a signed digest can not have more than %d events", streamBatchSize), http.StatusRequestEntityTooLarge, ingestor.summary)
+			return
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	if err := auth.VerifyBody(request); err != nil {
+		constructStreamErrorResponse(writer, request, err, ingestor.summary)
+		return
+	}
+	ingestor.flush()
+
+	statusCode := http.StatusOK
+	if ingestor.summary.Rejected > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	constructStreamResponse(writer, request, statusCode, ingestor.summary)
+}
+
+/*
+Validates and produces the events of a stream in micro-batches. Shared by the ndjson stream of the REST API and the
+client-streaming RPC of the gRPC API.
+*/
+type streamIngestor struct {
+	server  *Server
+	ctx     context.Context
+	batch   []models.KafkaMessage
+	lines   []int // line number of each message in batch
+	hold    bool  // the batch is produced only by the last flush, when the body is verified
+	summary StreamSummary
+}
+
+func (ingestor *streamIngestor) add(lineNumber int, line []byte, tooLong bool) {
+	if tooLong {
+		ingestor.reject(lineNumber, BatchItemTooLarge, fmt.Sprintf("line exceeds %d bytes", ingestor.server.maxEventBytes()))
+		return
+	}
+
+	var event models.Event
+	if err := json.Unmarshal(line, &event); err != nil {
+		ingestor.reject(lineNumber, BatchItemValidationError, err.Error())
+		return
+	}
+	ingestor.addEvent(lineNumber, event)
+}
+
+func (ingestor *streamIngestor) addEvent(lineNumber int, event models.Event) {
+	if err := ingestor.server.validateEvent(event); err != nil {
+		ingestor.reject(lineNumber, BatchItemValidationError, err.Error(), violationsOf(err)...)
+		return
+	}
+
+	if allowed, _ := ingestor.server.allowUser(event.UserID); !allowed {
+		ingestor.reject(lineNumber, BatchItemRateLimited, "too many events for user "+event.UserID)
+		return
+	}
+
+	ingestor.batch = append(ingestor.batch, *ingestor.server.newKafkaMessage(ingestor.ctx, event, time.Now()))
+	ingestor.lines = append(ingestor.lines, lineNumber)
+	if len(ingestor.batch) >= streamBatchSize && !ingestor.hold {
+		ingestor.flush()
+	}
+}
+
+func (ingestor *streamIngestor) flush() {
+	if len(ingestor.batch) == 0 {
+		return
+	}
+
+	err := ingestor.server.Producer.Send(ingestor.ctx, ingestor.batch...)
+	results := make([]BatchItemResult, len(ingestor.batch))
+	indexes := make([]int, len(ingestor.batch))
+	for i := range results {
+		results[i] = BatchItemResult{Index: i, Status: BatchItemSucceeded}
+		indexes[i] = i
+	}
+	markProduceErrors(results, indexes, err)
+
+	for i, result := range results {
+		if result.Status == BatchItemSucceeded {
+			ingestor.summary.Accepted++
+		} else {
+			ingestor.reject(ingestor.lines[i], result.Status, result.Error)
+		}
+	}
+
+	ingestor.batch = ingestor.batch[:0]
+	ingestor.lines = ingestor.lines[:0]
+}
+
+func (ingestor *streamIngestor) reject(lineNumber int, status string, reason string, violations ...validation.Violation) {
+	ingestor.summary.Rejected++
+	if len(ingestor.summary.Errors) >= maxReportedStreamErrors {
+		ingestor.summary.ErrorsTruncated = true
+		return
+	}
+	ingestor.summary.Errors = append(ingestor.summary.Errors, StreamLineError{Line: lineNumber, Status: status, Error: reason, Violations: violations})
+}
+
+/*
+Reads the next line into buf, including the trailing newline. If the line is longer than maxBytes, the rest of it is
+discarded and tooLong is true, so a single huge line can not grow the buffer. io.EOF is returned with the last line.
+*/
+func readLine(reader *bufio.Reader, buf []byte, maxBytes int) (line []byte, tooLong bool, err error) {
+	line = buf
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(fragment) > maxBytes+1 { // +1 for the newline
+				tooLong = true
+				line = line[:0]
+			} else {
+				line = append(line, fragment...)
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, tooLong, err
+	}
+}
+
+/*
+Responds with the error envelope when the body can not be read to its end. The micro-batches before the error are
+already produced, so their summary is returned in the details. The events of the last micro-batch are not.
+*/
+func constructStreamErrorResponse(writer http.ResponseWriter, request *http.Request, err error, summary StreamSummary) {
+	if verificationErr := bodyVerificationError(err); verificationErr != nil {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		utils.ConstructErrorResponseWithDetails(writer, request, utils.ErrorCodeUnauthorized, verificationErr.Error(), http.StatusUnauthorized, summary)
+		return
+	}
+
+	code := utils.ErrorCodeInvalidRequest
+	if request.Header.Get("Content-Encoding") != "" {
+		code = utils.ErrorCodeInvalidEncoding
+		err = &invalidEncodingError{err: err}
+	}
+	utils.ConstructErrorResponseWithDetails(writer, request, code, err.Error(), http.StatusBadRequest, summary)
+}
+
+func constructStreamResponse(writer http.ResponseWriter, request *http.Request, statusCode int, summary StreamSummary) {
+	responseBytes, err := json.Marshal(summary)
+	if err != nil {
+		utils.ConstructErrorResponse(writer, request, utils.ErrorCodeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.ConstructSuccessfulResponse(writer, statusCode, responseBytes)
+}
@@ -0,0 +1,147 @@
+package tracking
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"   // accepted, not yet acknowledged by Kafka
+	StatusPersisted = "persisted" // acknowledged by Kafka
+	StatusFailed    = "failed"    // could not be written to Kafka
+)
+
+const sweepInterval = 1 * time.Minute
+
+type Record struct {
+	EventID   string    `json:"event_id"`
+	Status    string    `json:"status"`
+	Partition *int      `json:"partition,omitempty"`
+	Offset    *int64    `json:"offset,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Owner     string    `json:"-"` // principal that sent the event, empty when authentication is disabled
+	expiresAt time.Time
+}
+
+// event ids are chosen by clients, so they are unique only per owner
+type recordKey struct {
+	owner   string
+	eventID string
+}
+
+/*
+Keeps the delivery status of events accepted asynchronously, so clients can ask whether an event reached Kafka.
+Records are kept in memory for ttl after their last update, so they are lost on restart. Records are scoped by their
+owner: the same event id of two owners are two records, and an owner never sees (or learns of) the events of another.
+*/
+type Tracker struct {
+	mu        *sync.Mutex
+	ttl       time.Duration
+	records   map[recordKey]*Record
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+func (Tracker) New(ttl time.Duration) *Tracker {
+	return &Tracker{
+		mu:      &sync.Mutex{},
+		ttl:     ttl,
+		records: make(map[recordKey]*Record),
+		now:     time.Now,
+	}
+}
+
+// starts tracking an event as pending, a tracked event with the same id of the owner is replaced
+func (tracker *Tracker) Track(eventID string, owner string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	now := tracker.now()
+	tracker.sweep(now)
+	tracker.records[recordKey{owner: owner, eventID: eventID}] = &Record{EventID: eventID, Status: StatusPending, Owner: owner, UpdatedAt: now, expiresAt: now.Add(tracker.ttl)}
+}
+
+// stops tracking an event that was never handed to the producer
+func (tracker *Tracker) Forget(eventID string, owner string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	delete(tracker.records, recordKey{owner: owner, eventID: eventID})
+}
+
+func (tracker *Tracker) Persisted(eventID string, owner string, partition int, offset int64) {
+	tracker.update(eventID, owner, func(record *Record) {
+		record.Status = StatusPersisted
+		record.Partition = &partition
+		record.Offset = &offset
+		record.Error = ""
+	})
+}
+
+func (tracker *Tracker) Failed(eventID string, owner string, reason string) {
+	tracker.update(eventID, owner, func(record *Record) {
+		record.Status = StatusFailed
+		record.Error = reason
+	})
+}
+
+/*
+Resolves an event that is still pending after the producer returned, for writers that do not report the partition
+and offset of the written messages.
+*/
+func (tracker *Tracker) Complete(eventID string, owner string, err error) {
+	tracker.update(eventID, owner, func(record *Record) {
+		if record.Status != StatusPending {
+			return
+		}
+		if err != nil {
+			record.Status = StatusFailed
+			record.Error = err.Error()
+		} else {
+			record.Status = StatusPersisted
+		}
+	})
+}
+
+func (tracker *Tracker) Get(eventID string, owner string) (Record, bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	key := recordKey{owner: owner, eventID: eventID}
+	record, ok := tracker.records[key]
+	if !ok {
+		return Record{}, false
+	}
+	if !tracker.now().Before(record.expiresAt) {
+		delete(tracker.records, key)
+		return Record{}, false
+	}
+	return *record, true
+}
+
+// updates of events that are not tracked (or expired) are ignored
+func (tracker *Tracker) update(eventID string, owner string, apply func(record *Record)) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	record, ok := tracker.records[recordKey{owner: owner, eventID: eventID}]
+	now := tracker.now()
+	if !ok || !now.Before(record.expiresAt) {
+		return
+	}
+	apply(record)
+	record.UpdatedAt = now
+	record.expiresAt = now.Add(tracker.ttl)
+}
+
+func (tracker *Tracker) sweep(now time.Time) {
+	if now.Before(tracker.nextSweep) {
+		return
+	}
+	for key, record := range tracker.records {
+		if !now.Before(record.expiresAt) {
+			delete(tracker.records, key)
+		}
+	}
+	tracker.nextSweep = now.Add(sweepInterval)
+}
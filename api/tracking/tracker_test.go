@@ -0,0 +1,76 @@
+package tracking
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTrackerReportsDeliveryOfEvent(t *testing.T) {
+	tracker := Tracker{}.New(1 * time.Minute)
+
+	_, ok := tracker.Get("event_1", "")
+	assert.Equal(t, false, ok)
+
+	tracker.Track("event_1", "")
+	record, ok := tracker.Get("event_1", "")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, StatusPending, record.Status)
+	assert.Nil(t, record.Partition)
+
+	tracker.Persisted("event_1", "", 3, 42)
+	record, _ = tracker.Get("event_1", "")
+	assert.Equal(t, StatusPersisted, record.Status)
+	assert.Equal(t, 3, *record.Partition)
+	assert.Equal(t, int64(42), *record.Offset)
+
+	// the producer result does not overwrite the reported partition and offset
+	tracker.Complete("event_1", "", nil)
+	record, _ = tracker.Get("event_1", "")
+	assert.Equal(t, int64(42), *record.Offset)
+}
+
+func TestTrackerCompletesPendingEvents(t *testing.T) {
+	tracker := Tracker{}.New(1 * time.Minute)
+
+	tracker.Track("event_1", "")
+	tracker.Complete("event_1", "", errors.New("broker not available"))
+	record, _ := tracker.Get("event_1", "")
+	assert.Equal(t, StatusFailed, record.Status)
+	assert.Equal(t, "broker not available", record.Error)
+
+	// reports of untracked events are ignored
+	tracker.Persisted("event_2", "", 0, 1)
+	_, ok := tracker.Get("event_2", "")
+	assert.Equal(t, false, ok)
+}
+
+func TestTrackerScopesEventIDsByOwner(t *testing.T) {
+	tracker := Tracker{}.New(1 * time.Minute)
+
+	tracker.Track("event_1", "client_1")
+	tracker.Track("event_1", "client_2")
+	tracker.Persisted("event_1", "client_2", 3, 42)
+
+	record, ok := tracker.Get("event_1", "client_1")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, StatusPending, record.Status)
+	record, ok = tracker.Get("event_1", "client_2")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, StatusPersisted, record.Status)
+	_, ok = tracker.Get("event_1", "")
+	assert.Equal(t, false, ok)
+}
+
+func TestTrackerExpiresRecords(t *testing.T) {
+	tracker := Tracker{}.New(1 * time.Minute)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Track("event_1", "client_1")
+
+	now = now.Add(2 * time.Minute)
+	_, ok := tracker.Get("event_1", "client_1")
+	assert.Equal(t, false, ok)
+}
@@ -1,10 +1,70 @@
 package utils
 
-import "net/http"
+import (
+	"encoding/json"
+	"net/http"
+)
 
-func ConstructErrorResponse(writer http.ResponseWriter, errorMessage string, serverError int) {
-	writer.WriteHeader(serverError)
-	writer.Write([]byte(errorMessage))
+/*
+Stable, machine-readable error codes. Clients should match on those codes and never on error messages.
+*/
+const (
+	ErrorCodeUnauthorized             = "unauthorized"
+	ErrorCodeNotFound                 = "not_found"
+	ErrorCodeMethodNotAllowed         = "method_not_allowed"
+	ErrorCodeUnsupportedMediaType     = "unsupported_media_type"
+	ErrorCodeUnsupportedEncoding      = "unsupported_content_encoding"
+	ErrorCodeInvalidEncoding          = "invalid_content_encoding"
+	ErrorCodePayloadTooLarge          = "payload_too_large"
+	ErrorCodeInvalidJSON              = "invalid_json"
+	ErrorCodeInvalidEvent             = "invalid_event"
+	ErrorCodeInvalidRequest           = "invalid_request"
+	ErrorCodeSchemaViolation          = "schema_violation"
+	ErrorCodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	ErrorCodeQueueFull                = "queue_full"
+	ErrorCodeRateLimited              = "rate_limited"
+	ErrorCodeProduceFailed            = "produce_failed"
+	ErrorCodeInternal                 = "internal_error"
+)
+
+type Error struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+/*
+Every error of the API is returned with this envelope, like
+{"error": {"code": "invalid_event", "message": "UserID should be provided", "request_id": "..."}}
+*/
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+func ConstructErrorResponse(writer http.ResponseWriter, request *http.Request, code string, errorMessage string, statusCode int) {
+	ConstructErrorResponseWithDetails(writer, request, code, errorMessage, statusCode, nil)
+}
+
+func ConstructErrorResponseWithDetails(writer http.ResponseWriter, request *http.Request, code string, errorMessage string, statusCode int, details interface{}) {
+	jsonBytes, err := json.Marshal(ErrorResponse{Error: Error{
+		Code:      code,
+		Message:   errorMessage,
+		Details:   details,
+		RequestID: RequestID(request),
+	}})
+	if err != nil {
+		jsonBytes, _ = json.Marshal(ErrorResponse{Error: Error{
+			Code:      ErrorCodeInternal,
+			Message:   err.Error(),
+			RequestID: RequestID(request),
+		}})
+		statusCode = http.StatusInternalServerError
+	}
+
+	writer.Header().Add("content-type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(jsonBytes)
 }
 
 func ConstructSuccessfulResponse(writer http.ResponseWriter, statusCode int, jsonBytes []byte) {
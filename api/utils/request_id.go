@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+/*
+Returns the id assigned to the request by the server middleware, or the X-Request-ID header sent by the client if
+the request did not pass through the middleware.
+*/
+func RequestID(request *http.Request) string {
+	if requestID, ok := request.Context().Value(requestIDKey{}).(string); ok {
+		return requestID
+	}
+	return request.Header.Get(RequestIDHeader)
+}
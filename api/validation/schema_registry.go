@@ -0,0 +1,109 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/xeipuuv/gojsonschema"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+/*
+Returned when the payload of an event does not match the json schema registered for its event type.
+*/
+type ValidationError struct {
+	EventType  string
+	Violations []Violation
+}
+
+func (err *ValidationError) Error() string {
+	messages := make([]string, len(err.Violations))
+	for i, violation := range err.Violations {
+		messages[i] = violation.Field + ": " + violation.Message
+	}
+	return fmt.Sprintf("payload does not match schema of event type '%s': %s", err.EventType, strings.Join(messages, "; "))
+}
+
+/*
+Local registry of json schemas, one per event type. Schemas are loaded from a directory where every file
+<event_type>.json contains the schema of the payload for that event type. Events with an event type that has
+no registered schema are not validated.
+*/
+type SchemaRegistry struct {
+	mu      *sync.RWMutex
+	schemas map[string]*gojsonschema.Schema
+}
+
+func (SchemaRegistry) New() *SchemaRegistry {
+	return &SchemaRegistry{
+		mu:      &sync.RWMutex{},
+		schemas: make(map[string]*gojsonschema.Schema),
+	}
+}
+
+func (registry *SchemaRegistry) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		schemaBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		eventType := strings.TrimSuffix(filepath.Base(file), ".json")
+		if err := registry.Register(eventType, schemaBytes); err != nil {
+			return fmt.Errorf("invalid schema %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+func (registry *SchemaRegistry) Register(eventType string, schema []byte) error {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return err
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.schemas[eventType] = compiled
+	return nil
+}
+
+/*
+Validates the payload (a json document) against the schema of the event type.
+Returns a *ValidationError that lists every violation when the payload does not match.
+*/
+func (registry *SchemaRegistry) Validate(eventType string, payload string) error {
+	registry.mu.RLock()
+	schema, ok := registry.schemas[eventType]
+	registry.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	result, err := schema.Validate(gojsonschema.NewStringLoader(payload))
+	if err != nil {
+		return &ValidationError{
+			EventType:  eventType,
+			Violations: []Violation{{Field: "payload", Message: "payload is not valid json: " + err.Error()}},
+		}
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	violations := make([]Violation, len(result.Errors()))
+	for i, resultError := range result.Errors() {
+		violations[i] = Violation{Field: resultError.Field(), Message: resultError.Description()}
+	}
+	return &ValidationError{EventType: eventType, Violations: violations}
+}
@@ -0,0 +1,29 @@
+package validation
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLoadSchemasFromDirectory(t *testing.T) {
+	registry := SchemaRegistry{}.New()
+	assert.Nil(t, registry.LoadDir("../../config/schemas"))
+
+	assert.Nil(t, registry.Validate("click", `{"element_id": "buy_button", "page": "/checkout", "x": 10, "y": 20}`))
+
+	err := registry.Validate("click", `{"element_id": "", "x": -1}`)
+	validationErr, ok := err.(*ValidationError)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "click", validationErr.EventType)
+	assert.Equal(t, 3, len(validationErr.Violations))
+}
+
+func TestEventTypeWithoutSchemaIsNotValidated(t *testing.T) {
+	registry := SchemaRegistry{}.New()
+	assert.Nil(t, registry.Validate("unknown", "not json"))
+}
+
+func TestRegisterInvalidSchema(t *testing.T) {
+	registry := SchemaRegistry{}.New()
+	assert.NotNil(t, registry.Register("click", []byte(`{"type": 12}`)))
+}
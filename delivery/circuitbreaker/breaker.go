@@ -0,0 +1,259 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/logging"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// states of a circuit
+const (
+	StateClosed   = "closed"    // attempts are let through
+	StateOpen     = "open"      // attempts are rejected with ErrOpen until OpenTimeout has passed
+	StateHalfOpen = "half_open" // trial attempts are let through one at a time, they close the circuit or open it again
+)
+
+// returned instead of attempting the destination while its circuit is open
+var ErrOpen = errors.New("circuit is open")
+
+type Config struct {
+	FailureThreshold int           // consecutive failed attempts that open the circuit, breakers are disabled when 0
+	OpenTimeout      time.Duration // how long the circuit stays open before trial attempts, 30s when 0
+	SuccessThreshold int           // successful trial attempts that close the circuit, 1 when 0
+	Logger           *zap.Logger   // optional, state changes are not logged when nil
+}
+
+type Snapshot struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"` // consecutive failed attempts
+	Opened    uint64    `json:"opened"`   // times the circuit opened since the start
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+/*
+Circuit breaker of a destination. The circuit opens after FailureThreshold consecutive failed attempts, then attempts
+are rejected with ErrOpen for OpenTimeout, so a destination that is down is not attempted for every event. After it,
+the circuit is half-open and lets a single trial attempt through at a time, the others are rejected with ErrOpen
+until it is recorded: SuccessThreshold successes close it, a failure opens it again. Permanent errors (see
+delivery.Classify) are not failures, the destination answered. It is shared by the consumers of the destination, and
+a nil breaker lets every attempt through.
+*/
+type Breaker struct {
+	name      string
+	config    Config
+	logger    *zap.Logger
+	mu        *sync.Mutex
+	state     string
+	failures  int
+	successes int  // trial attempts that succeeded while half-open
+	trial     bool // a trial attempt is let through and not recorded yet
+	opened    uint64
+	changedAt time.Time
+	changed   chan struct{} // closed at every state change and recorded trial, wakes up Wait
+	now       func() time.Time
+}
+
+func (Breaker) New(name string, config Config) *Breaker {
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 30 * time.Second
+	}
+	if config.SuccessThreshold <= 0 {
+		config.SuccessThreshold = 1
+	}
+	return &Breaker{
+		name:      name,
+		config:    config,
+		logger:    logging.OrNop(config.Logger),
+		mu:        &sync.Mutex{},
+		state:     StateClosed,
+		changedAt: time.Now(),
+		changed:   make(chan struct{}),
+		now:       time.Now,
+	}
+}
+
+// runs the operation when the circuit lets it through and records its result, returns ErrOpen otherwise
+func (b *Breaker) Execute(operation func() error) error {
+	if !b.Allow() {
+		return ErrOpen
+	}
+	err := operation()
+	b.Record(err)
+	return err
+}
+
+/*
+true when an attempt is let through, its result has to be recorded with Record. An open circuit turns half-open here,
+once OpenTimeout has passed, and a half-open circuit lets only one trial attempt through until it is recorded.
+*/
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ready() {
+		return false
+	}
+	if b.state == StateHalfOpen {
+		b.trial = true
+	}
+	return true
+}
+
+// true when an attempt would be let through, without taking the trial of a half-open circuit
+func (b *Breaker) ready() bool {
+	if b.state == StateOpen && !b.now().Before(b.changedAt.Add(b.config.OpenTimeout)) {
+		b.setState(StateHalfOpen)
+	}
+	return b.state == StateClosed || (b.state == StateHalfOpen && !b.trial)
+}
+
+// records the result of an attempt that was let through
+func (b *Breaker) Record(err error) {
+	if b == nil {
+		return
+	}
+	class, _ := delivery.Classify(err)
+	failed := err != nil && class != delivery.ClassPermanent
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen {
+		b.trial = false
+	}
+	if !failed {
+		b.failures = 0
+		if b.state == StateHalfOpen {
+			b.successes++
+			if b.successes >= b.config.SuccessThreshold {
+				b.setState(StateClosed)
+			} else {
+				b.notify() // the next trial can be let through
+			}
+		}
+		return
+	}
+
+	b.failures++
+	switch b.state {
+	case StateClosed:
+		if b.failures >= b.config.FailureThreshold {
+			b.setState(StateOpen)
+		}
+	case StateHalfOpen:
+		b.setState(StateOpen)
+	}
+}
+
+/*
+Waits until the circuit lets attempts through, returns false when ctx is done first. Consumers wait here instead of
+fetching the next messages while the circuit of their destination is open.
+*/
+func (b *Breaker) Wait(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		b.mu.Lock()
+		if b.ready() {
+			b.mu.Unlock()
+			return true
+		}
+		wait := b.changedAt.Add(b.config.OpenTimeout).Sub(b.now())
+		if b.state == StateHalfOpen {
+			wait = b.config.OpenTimeout // the trial in flight wakes up Wait when it is recorded
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+func (b *Breaker) State() Snapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Snapshot{Name: b.name, State: b.state, Failures: b.failures, Opened: b.opened, ChangedAt: b.changedAt}
+}
+
+func (b *Breaker) setState(state string) {
+	previous := b.state
+	b.state = state
+	b.changedAt = b.now()
+	b.successes = 0
+	b.trial = false
+	b.notify()
+
+	fields := []zap.Field{zap.String("destination", b.name), zap.String("state", state), zap.String("previous_state", previous), zap.Int("failures", b.failures)}
+	switch state {
+	case StateOpen:
+		b.opened++
+		b.logger.Warn("circuit opened, deliveries are paused", append(fields, zap.Duration("open_timeout", b.config.OpenTimeout))...)
+	case StateHalfOpen:
+		b.logger.Info("circuit half-open, trying deliveries", fields...)
+	case StateClosed:
+		b.logger.Info("circuit closed, deliveries resumed", fields...)
+	}
+}
+
+// wakes up the consumers waiting in Wait
+func (b *Breaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// breakers of the destinations by name, shared by the consumers and the API
+type Registry struct {
+	config   Config
+	mu       *sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func (Registry) New(config Config) *Registry {
+	return &Registry{
+		config:   config,
+		mu:       &sync.Mutex{},
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+// breaker of the destination, created on first use
+func (r *Registry) Breaker(name string) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breaker, ok := r.breakers[name]
+	if !ok {
+		breaker = Breaker{}.New(name, r.config)
+		r.breakers[name] = breaker
+	}
+	return breaker
+}
+
+// state of every breaker, by name
+func (r *Registry) Snapshots() []Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshots := make([]Snapshot, 0, len(r.breakers))
+	for _, breaker := range r.breakers {
+		snapshots = append(snapshots, breaker.State())
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots
+}
@@ -0,0 +1,120 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"event-delivery-kafka/delivery"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensHalfOpensAndCloses(t *testing.T) {
+	breaker := Breaker{}.New("snowflake", Config{FailureThreshold: 2, OpenTimeout: time.Minute, SuccessThreshold: 2})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	unavailable := errors.New("snowflake is unavailable")
+
+	// permanent errors are not failures of the destination
+	assert.NotNil(t, breaker.Execute(func() error { return delivery.Permanent(errors.New("invalid payload")) }))
+	assert.Equal(t, unavailable, breaker.Execute(func() error { return unavailable }))
+	assert.Equal(t, StateClosed, breaker.State().State)
+	assert.Equal(t, unavailable, breaker.Execute(func() error { return unavailable }))
+	assert.Equal(t, StateOpen, breaker.State().State)
+
+	attempted := false
+	assert.Equal(t, ErrOpen, breaker.Execute(func() error {
+		attempted = true
+		return nil
+	}))
+	assert.False(t, attempted)
+
+	// a failed trial opens the circuit again
+	now = now.Add(time.Minute)
+	assert.Equal(t, unavailable, breaker.Execute(func() error { return unavailable }))
+	assert.Equal(t, StateOpen, breaker.State().State)
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, breaker.Execute(func() error { return nil }))
+	assert.Equal(t, StateHalfOpen, breaker.State().State)
+	assert.Nil(t, breaker.Execute(func() error { return nil }))
+	assert.Equal(t, Snapshot{Name: "snowflake", State: StateClosed, Failures: 0, Opened: 2, ChangedAt: now}, breaker.State())
+}
+
+func TestHalfOpenCircuitLetsOneTrialThroughAtATime(t *testing.T) {
+	breaker := Breaker{}.New("snowflake", Config{FailureThreshold: 1, OpenTimeout: time.Minute, SuccessThreshold: 2})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	breaker.Record(errors.New("snowflake is unavailable"))
+	now = now.Add(time.Minute)
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if breaker.Allow() {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), allowed)
+	assert.Equal(t, StateHalfOpen, breaker.State().State)
+
+	// consumers wait for the result of the trial in flight
+	waited := make(chan bool)
+	go func() {
+		waited <- breaker.Wait(context.Background())
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a trial is in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	breaker.Record(nil)
+	assert.True(t, <-waited)
+
+	// the next trial is let through once the previous one is recorded
+	assert.True(t, breaker.Allow())
+	assert.False(t, breaker.Allow())
+	breaker.Record(nil)
+	assert.Equal(t, StateClosed, breaker.State().State)
+	assert.True(t, breaker.Allow())
+	assert.True(t, breaker.Allow())
+}
+
+func TestWaitReturnsWhenTheCircuitLetsAttemptsThrough(t *testing.T) {
+	breaker := Breaker{}.New("snowflake", Config{FailureThreshold: 1, OpenTimeout: 50 * time.Millisecond})
+	assert.True(t, breaker.Wait(context.Background()))
+
+	breaker.Record(errors.New("snowflake is unavailable"))
+	start := time.Now()
+	assert.True(t, breaker.Wait(context.Background()))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, StateHalfOpen, breaker.State().State)
+
+	breaker.Record(errors.New("snowflake is unavailable"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, breaker.Wait(ctx))
+
+	var disabled *Breaker
+	assert.True(t, disabled.Wait(ctx))
+}
+
+func TestRegistrySnapshots(t *testing.T) {
+	registry := Registry{}.New(Config{FailureThreshold: 1})
+	assert.Equal(t, registry.Breaker("snowflake"), registry.Breaker("snowflake"))
+	registry.Breaker("bigquery").Record(errors.New("bigquery is unavailable"))
+
+	snapshots := registry.Snapshots()
+	assert.Equal(t, 2, len(snapshots))
+	assert.Equal(t, "bigquery", snapshots[0].Name)
+	assert.Equal(t, StateOpen, snapshots[0].State)
+	assert.Equal(t, "snowflake", snapshots[1].Name)
+	assert.Equal(t, StateClosed, snapshots[1].State)
+}
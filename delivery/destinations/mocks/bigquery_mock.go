@@ -1,27 +1,32 @@
 package mocks
 
 import (
+	"event-delivery-kafka/logging"
 	"event-delivery-kafka/models"
-	"fmt"
-	"log"
+	"go.uber.org/zap"
 )
 
 type BigqueryMock struct {
 	warehouse string
 	database  string
 	user      string
+	logger    *zap.Logger
 }
 
-func (BigqueryMock) New() *BigqueryMock {
+// logger is optional, nothing is logged when it is nil
+func (BigqueryMock) New(logger *zap.Logger) *BigqueryMock {
 	return &BigqueryMock{
 		warehouse: "BIGQUERY_WAREHOUSE",
 		database:  "BIGQUERY_DATABASE",
 		user:      "BIGQUERY_USER",
+		logger:    logging.OrNop(logger),
 	}
 }
 
 func (bigqueryMock *BigqueryMock) Receive(event ...models.Event) error {
-	log.Println(fmt.Sprintf("bigquery: Received event successfully for userId %v ", event[0].UserID))
+	for i := range event {
+		bigqueryMock.logger.Info("received event successfully", zap.String("destination", "bigquery"), zap.String("user_id", event[i].UserID))
+	}
 	return nil
 }
 
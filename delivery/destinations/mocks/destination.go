@@ -4,7 +4,20 @@ import (
 	"event-delivery-kafka/models"
 )
 
+/*
+Receive returns the errors of delivery.Retryable, Permanent, RateLimited or Throttled to tell the consumers whether
+and when to retry, other errors are retryable.
+*/
 type Destination interface {
 	Receive(event ...models.Event) error
 	Name() string
-}
\ No newline at end of file
+}
+
+/*
+Destinations that consume CloudEvents (like webhooks or event routers) receive the events as CloudEvents 1.0
+instead of calling Receive. Events that were not ingested as CloudEvents get default id, source and type.
+*/
+type CloudEventsDestination interface {
+	Destination
+	ReceiveCloudEvents(event ...models.CloudEvent) error
+}
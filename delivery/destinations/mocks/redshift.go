@@ -2,9 +2,11 @@ package mocks
 
 import (
 	"errors"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/logging"
 	"event-delivery-kafka/models"
 	"fmt"
-	"log"
+	"go.uber.org/zap"
 	"math/rand"
 	"time"
 )
@@ -13,28 +15,41 @@ type RedshiftMock struct {
 	warehouse string
 	database  string
 	user      string
+	logger    *zap.Logger
 }
 
-func (RedshiftMock) New() *RedshiftMock {
+// logger is optional, nothing is logged when it is nil
+func (RedshiftMock) New(logger *zap.Logger) *RedshiftMock {
 	rand.Seed(time.Now().UnixNano())
 	return &RedshiftMock{
 		warehouse: "REDSHIFT_WAREHOUSE",
 		database:  "REDSHIFT_DATABASE",
 		user:      "REDSHIFT_USER",
+		logger:    logging.OrNop(logger),
 	}
 }
 
+// every event of a batch fails on its own, so batches fail partially
 func (redshiftMock *RedshiftMock) Receive(event ...models.Event) error {
 	min := 0
 	max := 10
-	randomNum := rand.Intn(max-min) + min //between 0 and 9
+	failed := map[int]error{}
+	for i := range event {
+		randomNum := rand.Intn(max-min) + min //between 0 and 9
+		if randomNum < 7 {
+			failed[i] = errors.New(fmt.Sprintf("redshift: Can't receive event for userId %v ", event[i].UserID))
+		}
+	}
 
-	if randomNum >= 7 {
-		log.Println(fmt.Sprintf("redshift: Received event successfully for userId %v ", event[0].UserID))
-	} else {
-		return errors.New(fmt.Sprintf("redshift: Can't receive event for userId %v ", event[0].UserID))
+	for i := range event {
+		if _, ok := failed[i]; !ok {
+			redshiftMock.logger.Info("received event successfully", zap.String("destination", "redshift"), zap.String("user_id", event[i].UserID))
+		}
 	}
 
+	if len(failed) > 0 {
+		return delivery.PartiallyFailed(failed)
+	}
 	return nil
 }
 
@@ -0,0 +1,138 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// classes of the errors of the destinations
+const (
+	ClassRetryable   = "retryable"    // retried with the retry policy of the destination, errors without class too
+	ClassPermanent   = "permanent"    // retrying can not help (rejected payload, bad credentials), never retried
+	ClassRateLimited = "rate_limited" // retried after RetryAfter, when it is longer than the interval of the policy
+	ClassThrottled   = "throttled"    // the destination is overloaded, retried after twice the interval of the policy
+)
+
+/*
+Error of a destination with its class, so the consumers know whether and when to retry. Destinations return it with
+Retryable, Permanent, RateLimited or Throttled, errors.As finds it in wrapped errors too.
+*/
+type Error struct {
+	Class      string
+	RetryAfter time.Duration // of rate limited errors, 0 when the destination did not tell
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func Retryable(err error) error {
+	return &Error{Class: ClassRetryable, Err: err}
+}
+
+func Permanent(err error) error {
+	return &Error{Class: ClassPermanent, Err: err}
+}
+
+func RateLimited(err error, retryAfter time.Duration) error {
+	return &Error{Class: ClassRateLimited, RetryAfter: retryAfter, Err: err}
+}
+
+func Throttled(err error) error {
+	return &Error{Class: ClassThrottled, Err: err}
+}
+
+/*
+Error of a batch of which only some events failed, with the error of every failed event by its index in the batch.
+The other events of the batch were delivered. Destinations that fail the whole batch return the error as it is.
+*/
+type BatchError struct {
+	Failed map[int]error
+}
+
+func (e *BatchError) Error() string {
+	indexes := e.indexes()
+	if len(indexes) == 0 {
+		return "no event of the batch failed"
+	}
+	return fmt.Sprintf("%d events of the batch failed, first at %d: %v", len(indexes), indexes[0], e.Failed[indexes[0]])
+}
+
+// indexes of the failed events, in order
+func (e *BatchError) indexes() []int {
+	indexes := make([]int, 0, len(e.Failed))
+	for i, err := range e.Failed {
+		if err != nil {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func PartiallyFailed(failed map[int]error) error {
+	return &BatchError{Failed: failed}
+}
+
+/*
+Error of every event of a batch of size events, nil for the delivered ones. Any error other than a BatchError fails
+every event. So does a BatchError that fails no event or an index outside of the batch, as it can not tell which
+events were delivered: then every event fails with a retryable error.
+*/
+func EventErrors(err error, size int) []error {
+	errs := make([]error, size)
+	if err == nil {
+		return errs
+	}
+
+	var batch *BatchError
+	if errors.As(err, &batch) {
+		indexes := batch.indexes()
+		if len(indexes) > 0 && indexes[0] >= 0 && indexes[len(indexes)-1] < size {
+			for _, i := range indexes {
+				errs[i] = batch.Failed[i]
+			}
+			return errs
+		}
+		err = Retryable(fmt.Errorf("invalid error of a batch of %d events: %v", size, err))
+	}
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+/*
+Class of the error and the time to wait before the next attempt, errors without class are retryable. A batch error is
+permanent when all its errors are, otherwise it has the class of its first error that is not permanent. A batch error
+without failed events is retryable, see EventErrors.
+*/
+func Classify(err error) (class string, retryAfter time.Duration) {
+	var batch *BatchError
+	if errors.As(err, &batch) {
+		indexes := batch.indexes()
+		if len(indexes) == 0 {
+			return ClassRetryable, 0
+		}
+		class = ClassPermanent
+		for _, i := range indexes {
+			if class, retryAfter = Classify(batch.Failed[i]); class != ClassPermanent {
+				return class, retryAfter
+			}
+		}
+		return class, 0
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Class, classified.RetryAfter
+	}
+	return ClassRetryable, 0
+}
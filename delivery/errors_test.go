@@ -0,0 +1,75 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	class, retryAfter := Classify(errors.New("postgres is unavailable"))
+	assert.Equal(t, ClassRetryable, class)
+	assert.Equal(t, time.Duration(0), retryAfter)
+
+	class, _ = Classify(Permanent(errors.New("bigquery: invalid credentials")))
+	assert.Equal(t, ClassPermanent, class)
+
+	// classified errors wrapped by the destinations keep their class
+	wrapped := fmt.Errorf("snowflake: %w", RateLimited(errors.New("429 too many requests"), 30*time.Second))
+	class, retryAfter = Classify(wrapped)
+	assert.Equal(t, ClassRateLimited, class)
+	assert.Equal(t, 30*time.Second, retryAfter)
+	assert.Equal(t, "snowflake: 429 too many requests", wrapped.Error())
+
+	class, _ = Classify(Throttled(errors.New("503 slow down")))
+	assert.Equal(t, ClassThrottled, class)
+
+	timedOut := errors.New("postgres : timed out")
+	assert.True(t, errors.Is(Retryable(timedOut), timedOut))
+}
+
+func TestClassifyBatchErrors(t *testing.T) {
+	invalid := Permanent(errors.New("redshift: invalid row"))
+	class, _ := Classify(PartiallyFailed(map[int]error{4: invalid, 7: invalid}))
+	assert.Equal(t, ClassPermanent, class)
+
+	// the first error that is not permanent, by index
+	err := PartiallyFailed(map[int]error{
+		9: Throttled(errors.New("redshift: slow down")),
+		2: invalid,
+		5: RateLimited(errors.New("redshift: too many requests"), 10*time.Second),
+	})
+	class, retryAfter := Classify(err)
+	assert.Equal(t, ClassRateLimited, class)
+	assert.Equal(t, 10*time.Second, retryAfter)
+	assert.Equal(t, "3 events of the batch failed, first at 2: redshift: invalid row", err.Error())
+}
+
+func TestEventErrors(t *testing.T) {
+	assert.Equal(t, []error{nil, nil}, EventErrors(nil, 2))
+
+	unavailable := errors.New("redshift is unavailable")
+	assert.Equal(t, []error{unavailable, unavailable}, EventErrors(unavailable, 2))
+
+	invalid := Permanent(errors.New("redshift: invalid row"))
+	assert.Equal(t, []error{nil, invalid, nil}, EventErrors(PartiallyFailed(map[int]error{1: invalid, 2: nil}), 3))
+
+	// a batch error that does not tell which events failed fails the whole batch, so no event counts as delivered
+	for _, err := range []error{
+		PartiallyFailed(map[int]error{}),
+		PartiallyFailed(map[int]error{0: nil}),
+		PartiallyFailed(map[int]error{1: invalid, 3: invalid}),
+		PartiallyFailed(map[int]error{-1: invalid}),
+	} {
+		errs := EventErrors(err, 3)
+		for _, eventErr := range errs {
+			assert.NotNil(t, eventErr, err.Error())
+			class, _ := Classify(eventErr)
+			assert.Equal(t, ClassRetryable, class, err.Error())
+		}
+	}
+	class, _ := Classify(PartiallyFailed(map[int]error{}))
+	assert.Equal(t, ClassRetryable, class)
+}
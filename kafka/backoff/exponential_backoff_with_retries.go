@@ -1,10 +1,10 @@
 package backoff
 
 import (
-	"fmt"
+	"context"
+	"event-delivery-kafka/logging"
 	"github.com/cenkalti/backoff/v4"
-	"log"
-	"os"
+	"go.uber.org/zap"
 	"time"
 )
 
@@ -16,12 +16,13 @@ type ExponentialBackOffWithRetriesConfig struct {
 	MaxElapsedTime      time.Duration
 	Stop                time.Duration
 	Clock               backoff.Clock
+	Logger              *zap.Logger // optional, retries are not logged when nil
 }
 
 type ExponentialBackOffWithRetries struct {
 	backoffImpl *backoff.ExponentialBackOff
 	maxRetries  uint64
-	logger      *log.Logger
+	logger      *zap.Logger
 }
 
 func (ExponentialBackOffWithRetries) New(maxRetries uint64, config ExponentialBackOffWithRetriesConfig) *ExponentialBackOffWithRetries {
@@ -36,18 +37,17 @@ func (ExponentialBackOffWithRetries) New(maxRetries uint64, config ExponentialBa
 	}
 	backoffImpl.Reset()
 
-	logger := log.New(os.Stdout, "custom exponential backoff runner: ", 0)
-
 	return &ExponentialBackOffWithRetries{
 		backoffImpl: backoffImpl,
 		maxRetries:  maxRetries,
-		logger:      logger,
+		logger:      logging.OrNop(config.Logger),
 	}
 }
 
-func (expBackoff *ExponentialBackOffWithRetries) Run(operation backoff.Operation) error {
-	backoffWithMaxRetry := backoff.WithMaxRetries(expBackoff.backoffImpl, expBackoff.maxRetries)
-	return backoff.RetryNotify(operation, backoffWithMaxRetry, func(err error, t time.Duration) {
-		expBackoff.logger.Println(fmt.Sprintf("error: %v, retrying after %v seconds \n", err.Error(), t.Seconds()))
-	})
+/*
+Runs the operation until it succeeds or the retries are exhausted. Retries stop when ctx is done.
+Every failed attempt that is retried is logged at warn with fields, the failure of the last attempt is returned.
+*/
+func (expBackoff *ExponentialBackOffWithRetries) Run(ctx context.Context, operation backoff.Operation, fields ...zap.Field) error {
+	return runWithRetries(ctx, expBackoff.backoffImpl, expBackoff.maxRetries, expBackoff.logger, operation, fields...)
 }
@@ -0,0 +1,310 @@
+package backoff
+
+import (
+	"context"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/logging"
+	"fmt"
+	"github.com/cenkalti/backoff/v4"
+	"go.uber.org/zap"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// types of the retry policies
+const (
+	PolicyExponential        = "exponential"
+	PolicyConstant           = "constant"
+	PolicyLinear             = "linear"
+	PolicyDecorrelatedJitter = "decorrelated_jitter"
+	PolicyFibonacci          = "fibonacci"
+	PolicyNoRetry            = "none"
+)
+
+/*
+Retry policy of the deliveries of a destination. Run runs the operation until it succeeds, the retries of the policy
+are exhausted or ctx is done, and returns the error of the last attempt. Every failed attempt that is retried is
+logged at warn with fields. The intervals follow the class of the errors of the destinations, see classifiedBackOff.
+*/
+type RetryPolicy interface {
+	Run(ctx context.Context, operation backoff.Operation, fields ...zap.Field) error
+}
+
+/*
+Type and parameters of a retry policy. Parameters that do not apply to the type are ignored, zero values are the
+defaults of the current exponential curve:
+- exponential: Interval 250ms, Multiplier 1.5, RandomizationFactor 0.5, MaxInterval 900ms, MaxElapsedTime 4s
+- constant: Interval between every attempt
+- linear: Interval, then Interval+Increment, Interval+2*Increment... up to MaxInterval, Increment is Interval when 0
+- decorrelated_jitter: random between Interval and 3 times the previous interval, up to MaxInterval
+- fibonacci: Interval, Interval, 2*Interval, 3*Interval, 5*Interval... up to MaxInterval
+- none: a single attempt
+*/
+type PolicyConfig struct {
+	Type                string        // exponential (default), constant, linear, decorrelated_jitter, fibonacci or none
+	MaxRetries          int           // retries after the first attempt, 3 when 0
+	Interval            time.Duration // first interval, 250ms when 0
+	MaxInterval         time.Duration // cap of the intervals, 900ms for exponential, no cap for the others when 0
+	Multiplier          float64       // exponential only
+	RandomizationFactor float64       // exponential only
+	MaxElapsedTime      time.Duration // exponential only, retries stop after it
+	Increment           time.Duration // linear only
+	Logger              *zap.Logger   // optional, retries are not logged when nil
+}
+
+const (
+	defaultMaxRetries = 3
+	defaultInterval   = 250 * time.Millisecond
+)
+
+/*
+Retry policy of the config. Without a type, it is the exponential backoff with the curve the consumers always had:
+[0.125sec , 0.375sec]	1st retry
+[0.1875sec , 0.5625sec]	2nd retry
+[0.2812sec , 0.843sec]	3rd retry
+For more information, check documentation in github.com/cenkalti/backoff/v4@v4.1.3/exponential.go:16
+*/
+func ForConfig(config PolicyConfig) (RetryPolicy, error) {
+	maxRetries := config.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	switch config.Type {
+	case "", PolicyExponential:
+		exponentialConfig := ExponentialBackOffWithRetriesConfig{
+			InitialInterval:     interval,
+			RandomizationFactor: config.RandomizationFactor,
+			Multiplier:          config.Multiplier,
+			MaxInterval:         config.MaxInterval,
+			MaxElapsedTime:      config.MaxElapsedTime,
+			Stop:                backoff.Stop,
+			Clock:               backoff.SystemClock,
+			Logger:              config.Logger,
+		}
+		if exponentialConfig.RandomizationFactor == 0 {
+			exponentialConfig.RandomizationFactor = 0.5
+		}
+		if exponentialConfig.Multiplier == 0 {
+			exponentialConfig.Multiplier = 1.5
+		}
+		if exponentialConfig.MaxInterval == 0 {
+			exponentialConfig.MaxInterval = 900 * time.Millisecond
+		}
+		if exponentialConfig.MaxElapsedTime == 0 {
+			exponentialConfig.MaxElapsedTime = 4 * time.Second
+		}
+		return ExponentialBackOffWithRetries{}.New(uint64(maxRetries), exponentialConfig), nil
+	case PolicyConstant:
+		return BackOffWithRetries{}.New(uint64(maxRetries), backoff.NewConstantBackOff(interval), config.Logger), nil
+	case PolicyLinear:
+		increment := config.Increment
+		if increment <= 0 {
+			increment = interval
+		}
+		return BackOffWithRetries{}.New(uint64(maxRetries), &LinearBackOff{Interval: interval, Increment: increment, MaxInterval: config.MaxInterval}, config.Logger), nil
+	case PolicyDecorrelatedJitter:
+		return BackOffWithRetries{}.New(uint64(maxRetries), &DecorrelatedJitterBackOff{Interval: interval, MaxInterval: config.MaxInterval}, config.Logger), nil
+	case PolicyFibonacci:
+		return BackOffWithRetries{}.New(uint64(maxRetries), &FibonacciBackOff{Interval: interval, MaxInterval: config.MaxInterval}, config.Logger), nil
+	case PolicyNoRetry:
+		return BackOffWithRetries{}.New(0, &backoff.StopBackOff{}, config.Logger), nil
+	default:
+		return nil, fmt.Errorf("unknown retry policy %s", config.Type)
+	}
+}
+
+// the exponential backoff of a config without type, which never fails
+func Default(logger *zap.Logger) RetryPolicy {
+	policy, _ := ForConfig(PolicyConfig{Logger: logger})
+	return policy
+}
+
+/*
+Parses a policy written as its type followed by its parameters separated by spaces, like
+"constant interval=500ms retries=5" or "decorrelated_jitter interval=100ms max_interval=5s". Parameters are retries,
+interval, max_interval, multiplier, randomization, max_elapsed and increment.
+*/
+func ParsePolicy(spec string) (PolicyConfig, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return PolicyConfig{}, nil
+	}
+
+	config := PolicyConfig{Type: fields[0]}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return PolicyConfig{}, fmt.Errorf("invalid parameter %s of retry policy, expected name=value", field)
+		}
+		var err error
+		switch name, value := parts[0], parts[1]; name {
+		case "retries":
+			config.MaxRetries, err = strconv.Atoi(value)
+		case "interval":
+			config.Interval, err = time.ParseDuration(value)
+		case "max_interval":
+			config.MaxInterval, err = time.ParseDuration(value)
+		case "multiplier":
+			config.Multiplier, err = strconv.ParseFloat(value, 64)
+		case "randomization":
+			config.RandomizationFactor, err = strconv.ParseFloat(value, 64)
+		case "max_elapsed":
+			config.MaxElapsedTime, err = time.ParseDuration(value)
+		case "increment":
+			config.Increment, err = time.ParseDuration(value)
+		default:
+			return PolicyConfig{}, fmt.Errorf("unknown parameter %s of retry policy", name)
+		}
+		if err != nil {
+			return PolicyConfig{}, fmt.Errorf("invalid value of parameter %s of retry policy: %w", parts[0], err)
+		}
+	}
+
+	// validates the type too
+	if _, err := ForConfig(config); err != nil {
+		return PolicyConfig{}, err
+	}
+	return config, nil
+}
+
+// retry policy with the intervals of a backoff.BackOff, up to max retries
+type BackOffWithRetries struct {
+	backoffImpl backoff.BackOff
+	maxRetries  uint64
+	logger      *zap.Logger
+}
+
+func (BackOffWithRetries) New(maxRetries uint64, backoffImpl backoff.BackOff, logger *zap.Logger) *BackOffWithRetries {
+	return &BackOffWithRetries{
+		backoffImpl: backoffImpl,
+		maxRetries:  maxRetries,
+		logger:      logging.OrNop(logger),
+	}
+}
+
+func (policy *BackOffWithRetries) Run(ctx context.Context, operation backoff.Operation, fields ...zap.Field) error {
+	return runWithRetries(ctx, policy.backoffImpl, policy.maxRetries, policy.logger, operation, fields...)
+}
+
+// the backoff is reset by every run, so it should not be shared by concurrent runs
+func runWithRetries(ctx context.Context, backoffImpl backoff.BackOff, maxRetries uint64, logger *zap.Logger, operation backoff.Operation, fields ...zap.Field) error {
+	classified := &classifiedBackOff{BackOff: backoff.WithMaxRetries(backoffImpl, maxRetries)}
+	backoffWithMaxRetry := backoff.WithContext(classified, ctx)
+	logger = logger.With(fields...)
+	attempt := 0
+	return backoff.RetryNotify(func() error {
+		classified.err = operation()
+		return classified.err
+	}, backoffWithMaxRetry, func(err error, t time.Duration) {
+		attempt++
+		class, _ := delivery.Classify(err)
+		logger.Warn("attempt failed, retrying", zap.Int("attempt", attempt), zap.Error(err), zap.String("error_class", class), zap.Duration("retry_in", t))
+	})
+}
+
+/*
+Follows the class of the error of the last attempt (see delivery.Classify): permanent errors are not retried, rate
+limited errors are retried after their retry-after when it is longer than the next interval, throttled errors after
+twice the next interval. Retries of every class count against the max retries.
+*/
+type classifiedBackOff struct {
+	backoff.BackOff
+	err error // of the last attempt
+}
+
+func (b *classifiedBackOff) NextBackOff() time.Duration {
+	class, retryAfter := delivery.Classify(b.err)
+	if class == delivery.ClassPermanent {
+		return backoff.Stop
+	}
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop {
+		return next
+	}
+	switch class {
+	case delivery.ClassRateLimited:
+		if retryAfter > next {
+			next = retryAfter
+		}
+	case delivery.ClassThrottled:
+		next *= 2
+	}
+	return next
+}
+
+// Interval, Interval+Increment, Interval+2*Increment... up to MaxInterval (no cap when 0)
+type LinearBackOff struct {
+	Interval    time.Duration
+	Increment   time.Duration
+	MaxInterval time.Duration
+	retries     int64
+}
+
+func (b *LinearBackOff) NextBackOff() time.Duration {
+	next := b.Interval + time.Duration(b.retries)*b.Increment
+	b.retries++
+	return capInterval(next, b.MaxInterval)
+}
+
+func (b *LinearBackOff) Reset() {
+	b.retries = 0
+}
+
+/*
+"Decorrelated jitter" of https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/: every interval is
+random between Interval and 3 times the previous interval, up to MaxInterval (no cap when 0).
+*/
+type DecorrelatedJitterBackOff struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+	previous    time.Duration
+}
+
+func (b *DecorrelatedJitterBackOff) NextBackOff() time.Duration {
+	previous := b.previous
+	if previous < b.Interval {
+		previous = b.Interval
+	}
+	next := b.Interval + time.Duration(rand.Int63n(int64(3*previous-b.Interval)+1))
+	b.previous = capInterval(next, b.MaxInterval)
+	return b.previous
+}
+
+func (b *DecorrelatedJitterBackOff) Reset() {
+	b.previous = 0
+}
+
+// Interval times the fibonacci numbers: Interval, Interval, 2*Interval, 3*Interval, 5*Interval... up to MaxInterval
+type FibonacciBackOff struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+	current     time.Duration
+	next        time.Duration
+}
+
+func (b *FibonacciBackOff) NextBackOff() time.Duration {
+	if b.current == 0 {
+		b.current, b.next = b.Interval, b.Interval
+	} else {
+		b.current, b.next = b.next, b.current+b.next
+	}
+	return capInterval(b.current, b.MaxInterval)
+}
+
+func (b *FibonacciBackOff) Reset() {
+	b.current, b.next = 0, 0
+}
+
+func capInterval(interval time.Duration, maxInterval time.Duration) time.Duration {
+	if maxInterval > 0 && interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
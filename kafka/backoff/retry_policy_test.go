@@ -0,0 +1,124 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"event-delivery-kafka/delivery"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIntervalsOfThePolicies(t *testing.T) {
+	linear := &LinearBackOff{Interval: 100 * time.Millisecond, Increment: 50 * time.Millisecond, MaxInterval: 220 * time.Millisecond}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 150 * time.Millisecond, 200 * time.Millisecond, 220 * time.Millisecond}, intervals(linear, 4))
+
+	fibonacci := &FibonacciBackOff{Interval: 100 * time.Millisecond, MaxInterval: 400 * time.Millisecond}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 400 * time.Millisecond}, intervals(fibonacci, 5))
+	fibonacci.Reset()
+	assert.Equal(t, 100*time.Millisecond, fibonacci.NextBackOff())
+
+	jitter := &DecorrelatedJitterBackOff{Interval: 100 * time.Millisecond, MaxInterval: time.Second}
+	previous := jitter.Interval
+	for _, interval := range intervals(jitter, 20) {
+		assert.True(t, interval >= jitter.Interval, interval)
+		assert.True(t, interval <= 3*previous && interval <= jitter.MaxInterval, interval)
+		previous = interval
+	}
+}
+
+func TestAttemptsOfThePolicies(t *testing.T) {
+	for _, config := range []PolicyConfig{
+		{Type: PolicyExponential, MaxRetries: 2, Interval: time.Millisecond},
+		{Type: PolicyConstant, MaxRetries: 2, Interval: time.Millisecond},
+		{Type: PolicyLinear, MaxRetries: 2, Interval: time.Millisecond},
+		{Type: PolicyDecorrelatedJitter, MaxRetries: 2, Interval: time.Millisecond},
+		{Type: PolicyFibonacci, MaxRetries: 2, Interval: time.Millisecond},
+		{Type: PolicyNoRetry, MaxRetries: 2},
+	} {
+		policy, err := ForConfig(config)
+		assert.Nil(t, err)
+
+		// every run starts from the first interval, like for the next message
+		for run := 0; run < 2; run++ {
+			attempts := 0
+			err = policy.Run(context.Background(), func() error {
+				attempts++
+				return errors.New("postgres is unavailable")
+			})
+			assert.EqualError(t, err, "postgres is unavailable")
+			if config.Type == PolicyNoRetry {
+				assert.Equal(t, 1, attempts, config.Type)
+			} else {
+				assert.Equal(t, 3, attempts, config.Type)
+			}
+		}
+	}
+
+	_, err := ForConfig(PolicyConfig{Type: "random"})
+	assert.EqualError(t, err, "unknown retry policy random")
+}
+
+func TestPoliciesFollowTheClassOfTheErrors(t *testing.T) {
+	policy, err := ForConfig(PolicyConfig{Type: PolicyConstant, MaxRetries: 3, Interval: time.Millisecond})
+	assert.Nil(t, err)
+
+	attempts := 0
+	err = policy.Run(context.Background(), func() error {
+		attempts++
+		return delivery.Permanent(errors.New("bigquery: invalid credentials"))
+	})
+	assert.Equal(t, 1, attempts)
+	class, _ := delivery.Classify(err)
+	assert.Equal(t, delivery.ClassPermanent, class)
+
+	attempts = 0
+	start := time.Now()
+	err = policy.Run(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return delivery.RateLimited(errors.New("snowflake: too many requests"), 50*time.Millisecond)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	throttled := &classifiedBackOff{BackOff: backoff.NewConstantBackOff(100 * time.Millisecond), err: delivery.Throttled(errors.New("redshift: slow down"))}
+	assert.Equal(t, 200*time.Millisecond, throttled.NextBackOff())
+	throttled.err = errors.New("redshift: unavailable")
+	assert.Equal(t, 100*time.Millisecond, throttled.NextBackOff())
+}
+
+func TestParsePolicy(t *testing.T) {
+	config, err := ParsePolicy("decorrelated_jitter interval=100ms max_interval=5s retries=6")
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyConfig{Type: PolicyDecorrelatedJitter, Interval: 100 * time.Millisecond, MaxInterval: 5 * time.Second, MaxRetries: 6}, config)
+
+	config, err = ParsePolicy("exponential multiplier=2 randomization=0.2 max_elapsed=10s")
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyConfig{Type: PolicyExponential, Multiplier: 2, RandomizationFactor: 0.2, MaxElapsedTime: 10 * time.Second}, config)
+
+	config, err = ParsePolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyConfig{}, config)
+
+	_, err = ParsePolicy("constant interval")
+	assert.EqualError(t, err, "invalid parameter interval of retry policy, expected name=value")
+	_, err = ParsePolicy("constant delay=1s")
+	assert.EqualError(t, err, "unknown parameter delay of retry policy")
+	_, err = ParsePolicy("linear increment=fast")
+	assert.Contains(t, err.Error(), "invalid value of parameter increment of retry policy")
+	_, err = ParsePolicy("quadratic")
+	assert.EqualError(t, err, "unknown retry policy quadratic")
+}
+
+func intervals(backoffImpl interface{ NextBackOff() time.Duration }, n int) []time.Duration {
+	result := make([]time.Duration, n)
+	for i := range result {
+		result[i] = backoffImpl.NextBackOff()
+	}
+	return result
+}
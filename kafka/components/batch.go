@@ -0,0 +1,235 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/delivery/circuitbreaker"
+	"event-delivery-kafka/metrics"
+	"event-delivery-kafka/tracing"
+	cenkalti "github.com/cenkalti/backoff/v4"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+type BatchConfig struct {
+	MaxSize   int           // max messages of a batch, messages are delivered one at a time when 0 or 1
+	MaxLinger time.Duration // max time a batch waits for more messages after its first one, 100ms when 0
+}
+
+// a message of a batch, with the attempts it was part of and the error of its last attempt
+type batchEntry struct {
+	message  kafka.Message
+	attempts int
+	err      error
+}
+
+/*
+Only the consumer of the topic of the events delivers batches, the consumers of the retry topics wait for the delay of
+every message and deliver one message at a time.
+*/
+func (c *Consumer) batching() bool {
+	return c.batch.MaxSize > 1 && c.delay <= 0 && c.processor.BatchAction != nil
+}
+
+/*
+Fetches and delivers batches until ctx is done, like Consume. The offsets of a batch are committed together, only after
+every message of the batch was delivered or written to the next topic. Messages fetched for a batch when ctx is done
+are not delivered nor committed, they are fetched again after restart.
+*/
+func (c *Consumer) consumeBatches(ctx context.Context) {
+	for {
+		messages, err := c.fetchBatch(ctx)
+		if err != nil {
+			break
+		}
+
+		entries := make([]*batchEntry, len(messages))
+		for i := range messages {
+			entries[i] = &batchEntry{message: messages[i]}
+		}
+		outcome, pending := c.deliverBatch(entries)
+		for outcome == deliveryPaused {
+			if !c.breaker.Wait(ctx) {
+				c.logger.Info("consumer stopped while the circuit was open, offsets of the batch are not committed", c.batchFields(pending)...)
+				return
+			}
+			outcome, pending = c.deliverBatch(pending)
+		}
+
+		if outcome == metrics.DeliveryAborted {
+			c.logger.Warn("delivery of batch aborted, offsets of the batch are not committed", c.batchFields(entries)...)
+			return
+		}
+
+		if err := c.reader.CommitMessages(context.Background(), messages...); err != nil {
+			c.metrics.CommitFailed(c.destination)
+			c.logger.Error("failed to commit offsets of batch", append(c.batchFields(entries), zap.Error(err))...)
+		}
+	}
+}
+
+// the next message and the messages fetched after it within MaxLinger, up to MaxSize
+func (c *Consumer) fetchBatch(ctx context.Context) ([]kafka.Message, error) {
+	m, err := c.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	messages := []kafka.Message{m}
+
+	linger := c.batch.MaxLinger
+	if linger <= 0 {
+		linger = 100 * time.Millisecond
+	}
+	lingerCtx, cancel := context.WithTimeout(ctx, linger)
+	defer cancel()
+	for len(messages) < c.batch.MaxSize {
+		m, err := c.reader.FetchMessage(lingerCtx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// the linger time is over, errors of the reader are returned by the next fetch
+			break
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+/*
+Runs the batch action of the processor with the entries and the retry policy, or only once with retry topics. Every
+retry sends only the entries that failed, and the entries of the same users after them, see splitBatch. The span of the
+batch links the traces of the producers of the messages. Entries are finished one by one like single messages, see
+finish, and the outcome is aborted when any of them is aborted, otherwise delivered, then the offsets of the batch can
+be committed. When the circuit of the destination opens, the outcome is paused and the entries that are not finished
+yet are returned, to be delivered again when the circuit lets attempts through.
+*/
+func (c *Consumer) deliverBatch(entries []*batchEntry) (string, []*batchEntry) {
+	links := make([]trace.Link, len(entries))
+	for i, entry := range entries {
+		links[i] = trace.LinkFromContext(ExtractTraceContext(c.delivery, entry.message))
+	}
+	topic := entries[0].message.Topic
+	ctx, span := tracing.Tracer().Start(c.delivery, topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("kafka"),
+			semconv.MessagingDestinationKey.String(topic),
+			semconv.MessagingOperationProcess,
+			attribute.Int("messaging.batch.message_count", len(entries)),
+			attribute.String("destination", c.destination),
+		),
+	)
+
+	pending := entries
+	var finished []*batchEntry
+	attempts := 0
+	operation := func() error {
+		attempts++
+		attemptCtx, attemptSpan := tracing.Tracer().Start(ctx, "delivery attempt", trace.WithAttributes(
+			attribute.Int("attempt", attempts),
+			attribute.Int("messaging.batch.message_count", len(pending)),
+		))
+		messages := make([]kafka.Message, len(pending))
+		for i, entry := range pending {
+			messages[i] = entry.message
+		}
+		err := c.processor.BatchAction(attemptCtx, messages)
+		if errors.Is(err, circuitbreaker.ErrOpen) {
+			// the destination was not attempted, the retries stop and the delivery waits for the circuit
+			attempts--
+			attemptSpan.SetAttributes(attribute.String("outcome", deliveryPaused))
+			attemptSpan.End()
+			return cenkalti.Permanent(err)
+		}
+		c.metrics.DeliveryBatch(c.destination, len(pending))
+		if err != nil {
+			class, _ := delivery.Classify(err)
+			attemptSpan.SetAttributes(attribute.String("error_class", class))
+		}
+		tracing.End(attemptSpan, err)
+
+		retry, done := splitBatch(pending, err)
+		for _, entry := range pending {
+			entry.attempts++
+			if entry.err != nil {
+				class, _ := delivery.Classify(entry.err)
+				c.metrics.DeliveryError(c.destination, class)
+			}
+		}
+		pending, finished = retry, append(finished, done...)
+		if len(pending) == 0 {
+			return nil
+		}
+		return err
+	}
+
+	var err error
+	if c.retryTopics() {
+		err = operation()
+	} else {
+		err = c.retryPolicy.Run(c.delivery, operation, c.batchFields(entries)...)
+	}
+
+	outcome := metrics.DeliveryDelivered
+	paused := errors.Is(err, circuitbreaker.ErrOpen)
+	if !paused {
+		// retries exhausted or aborted, the pending entries failed with the error of their last attempt
+		finished, pending = append(finished, pending...), nil
+	}
+	for _, entry := range finished {
+		if c.finish(ctx, entry.message, entry.attempts, entry.err) == metrics.DeliveryAborted {
+			outcome = metrics.DeliveryAborted
+		}
+	}
+	if paused && outcome != metrics.DeliveryAborted {
+		c.logger.Info("circuit is open, delivery of batch paused", c.batchFields(pending)...)
+		outcome = deliveryPaused
+		err = nil
+	}
+
+	span.SetAttributes(attribute.Int("attempts", attempts), attribute.String("outcome", outcome))
+	tracing.End(span, err)
+	return outcome, pending
+}
+
+/*
+Splits the entries of a batch attempt by the error of the attempt: the entries to retry, which failed with an error that
+is not permanent, and the entries that are done, delivered or failed with a permanent error. The error of every entry
+is set with delivery.EventErrors, from the delivery.BatchError of a partially failed batch, or the error of the whole
+batch. Entries after a retried entry of the same user (key) are retried with it even when they were delivered, so the
+events of a user are delivered again in their order (a destination can get them twice, like with any retry).
+*/
+func splitBatch(entries []*batchEntry, err error) (retry []*batchEntry, done []*batchEntry) {
+	errs := delivery.EventErrors(err, len(entries))
+	retriedKeys := map[string]bool{}
+	for i, entry := range entries {
+		entry.err = errs[i]
+		class, _ := delivery.Classify(entry.err)
+		switch key := string(entry.message.Key); {
+		case entry.err != nil && class != delivery.ClassPermanent:
+			retriedKeys[key] = true
+			retry = append(retry, entry)
+		case retriedKeys[key]:
+			retry = append(retry, entry)
+		default:
+			done = append(done, entry)
+		}
+	}
+	return retry, done
+}
+
+// fields of the log lines of a batch
+func (c *Consumer) batchFields(entries []*batchEntry) []zap.Field {
+	fields := []zap.Field{zap.String("destination", c.destination), zap.Int("batch_size", len(entries))}
+	if len(entries) > 0 {
+		fields = append(fields, zap.String("topic", entries[0].message.Topic))
+	}
+	return fields
+}
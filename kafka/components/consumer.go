@@ -2,13 +2,22 @@ package components
 
 import (
 	"context"
+	"errors"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/delivery/circuitbreaker"
 	"event-delivery-kafka/kafka/backoff"
 	"event-delivery-kafka/kafka/processors"
+	"event-delivery-kafka/logging"
+	"event-delivery-kafka/metrics"
+	"event-delivery-kafka/tracing"
+	"fmt"
+	cenkalti "github.com/cenkalti/backoff/v4"
 	"github.com/segmentio/kafka-go"
-	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"strconv"
 	"time"
 )
 
@@ -17,17 +26,42 @@ type ConsumerConfig struct {
 	MinBytes    int
 	MaxBytes    int
 	StartOffset int64
-	Logger      kafka.Logger
+	Logger      *zap.Logger      // optional, logger of the deliveries
+	KafkaLogger *zap.Logger      // optional, logger of the internal logs of the reader
+	Destination string           // label of the metrics and field of the logs of the consumer
+	Metrics     *metrics.Metrics // optional, deliveries are not counted when nil
+	DeadLetter  *Producer        // optional, producer of the dead-letter topic, messages whose retries are exhausted are skipped when nil
+	Retry       *Producer        // optional, producer of the next retry topic, failed messages are written to it instead of being retried in place
+	Delay       time.Duration    // delay of the retry topic read by the consumer, 0 for the topic of the events
+
+	Breaker *circuitbreaker.Breaker // optional, circuit breaker of the action of the destination, fetching is never paused when nil
+	Batch   BatchConfig             // batches delivered with the batch action of the processor, by the consumer of the topic of the events only
 }
 
+// a delivery stopped by the open circuit of the destination, the message is delivered again when the circuit lets it
+const deliveryPaused = "paused"
+
 type Consumer struct {
-	reader                        *kafka.Reader
-	processor                     processors.Processor
-	exponentialBackOffWithRetries backoff.ExponentialBackOffWithRetries
+	reader        *kafka.Reader
+	processor     processors.Processor
+	retryPolicy   backoff.RetryPolicy
+	writePolicy   backoff.RetryPolicy // retries of the writes to the retry and dead-letter topics
+	delivery      context.Context     // canceled by Shutdown to abort the retries of the current message
+	abortDelivery context.CancelFunc
+	done          chan struct{} // closed when Consume returns
+	destination   string
+	metrics       *metrics.Metrics
+	logger        *zap.Logger
+	deadLetter    *Producer
+	retry         *Producer
+	delay         time.Duration
+	breaker       *circuitbreaker.Breaker
+	batch         BatchConfig
 }
 
-func (Consumer) New(topic string, brokerAddress string, config ConsumerConfig, processor *processors.Processor, backoffStrategy backoff.ExponentialBackOffWithRetries) *Consumer {
-	c := &Consumer{
+func (Consumer) New(topic string, brokerAddress string, config ConsumerConfig, processor *processors.Processor, retryPolicy backoff.RetryPolicy) *Consumer {
+	delivery, abortDelivery := context.WithCancel(context.Background())
+	return &Consumer{
 		reader: kafka.NewReader(kafka.ReaderConfig{
 			Brokers:     []string{brokerAddress},
 			GroupID:     config.GroupID,
@@ -35,56 +69,342 @@ func (Consumer) New(topic string, brokerAddress string, config ConsumerConfig, p
 			MinBytes:    config.MinBytes,
 			MaxBytes:    config.MaxBytes,
 			StartOffset: config.StartOffset,
-			Logger:      config.Logger,
+			Logger:      logging.KafkaLogger(config.KafkaLogger),
+			ErrorLogger: logging.KafkaErrorLogger(config.KafkaLogger),
 		}),
-		processor:                     *processor,
-		exponentialBackOffWithRetries: backoffStrategy,
+		processor:     *processor,
+		retryPolicy:   retryPolicy,
+		writePolicy:   backoff.Default(config.Logger),
+		delivery:      delivery,
+		abortDelivery: abortDelivery,
+		done:          make(chan struct{}),
+		destination:   config.Destination,
+		metrics:       config.Metrics,
+		logger:        logging.OrNop(config.Logger),
+		deadLetter:    config.DeadLetter,
+		retry:         config.Retry,
+		delay:         config.Delay,
+		breaker:       config.Breaker,
+		batch:         config.Batch,
 	}
+}
 
-	c.Close(config.GroupID)
-	return c
+// destination of the consumer, with the delay of its retry topic for the consumers of retry topics (postgres/retry-1m)
+func (c *Consumer) Name() string {
+	if c.delay > 0 {
+		return c.destination + "/retry-" + FormatDelay(c.delay)
+	}
+	return c.destination
 }
 
 /*
-According to documentation
-Note that it is important to call Close() on a Reader when a process exits. The kafka server needs a graceful
-disconnect to stop it from continuing to attempt to send messages to the connected clients. The given example will
-not call Close() if the process is terminated with SIGINT (ctrl-c at the shell) or SIGTERM (as docker stop or a
-kubernetes restart does). This can result in a delay when a new reader on the same topic connects (e.g. new process
-started or new container running). Use a signal.Notify handler to close the reader on process shutdown.
- */
-func (c *Consumer) Close(groupId string) {
-	signalHandler := make(chan os.Signal, 1)
-	signal.Notify(signalHandler, os.Interrupt)
-	signal.Notify(signalHandler, syscall.SIGTERM)
-	go func() {
-		<-signalHandler
-		if err := c.reader.Close(); err != nil {
-			log.Fatalf("failed to close reader with groupdId %s with error %s \n", groupId, err.Error())
-		}
-		log.Printf("Consumer reader for groupId %s closed \n", groupId)
-		time.Sleep(1 * time.Second)
-		os.Exit(1)
-	}()
+Consumers of the tiered retry topics attempt every message once, and the message moves on to the next retry topic
+(or to the dead-letter topic after the last one), so the partition is never blocked by the backoff of a message.
+*/
+func (c *Consumer) retryTopics() bool {
+	return c.retry != nil || c.delay > 0
 }
 
+/*
+Fetches and delivers messages until ctx is done. The message being delivered when ctx is done is still retried and
+committed, Consume returns after it. Offsets are committed synchronously after every message, with a context of
+their own, so they are committed during shutdown too. While the circuit of the destination is open, the current message
+waits for it and the next messages are not fetched.
+*/
 func (c *Consumer) Consume(ctx context.Context) {
+	defer close(c.done)
+	if c.batching() {
+		c.consumeBatches(ctx)
+		return
+	}
 	for {
 		m, err := c.reader.FetchMessage(ctx)
 		if err != nil {
 			break
 		}
 
-		operation := func() error {
-			return c.processor.Action(m)
+		if !c.waitUntilDue(ctx, m) {
+			// not attempted yet, the message is fetched again after restart
+			c.logger.Info("consumer stopped before the retry of the event was due, offset is not committed", c.messageFields(m)...)
+			return
 		}
 
-		if err := c.exponentialBackOffWithRetries.Run(operation); err != nil {
-			log.Printf("failed to run operation using exponential backoff strategy: %v for key %s \n", err.Error(), string(m.Key))
+		outcome := c.deliver(m)
+		for outcome == deliveryPaused {
+			if !c.breaker.Wait(ctx) {
+				// not attempted since the circuit opened, the message is fetched again after restart
+				c.logger.Info("consumer stopped while the circuit was open, offset is not committed", c.messageFields(m)...)
+				return
+			}
+			outcome = c.deliver(m)
 		}
 
-		if err := c.reader.CommitMessages(ctx, m); err != nil {
-			log.Printf("failed to commit messages: %v for key %s \n", err.Error(), string(m.Key))
+		if outcome == metrics.DeliveryAborted {
+			// not committed, so the message is delivered again after restart
+			c.logger.Warn("delivery aborted, offset is not committed", c.messageFields(m)...)
+			return
+		}
+
+		if err := c.reader.CommitMessages(context.Background(), m); err != nil {
+			c.metrics.CommitFailed(c.destination)
+			c.logger.Error("failed to commit offset", append(c.messageFields(m), zap.Error(err))...)
+		}
+	}
+}
+
+/*
+Waits until the delay of the retry topic has passed since the message failed. Messages of a retry topic failed in the
+order of their offsets, so the following messages are not due before this one. Returns false when ctx is done first.
+*/
+func (c *Consumer) waitUntilDue(ctx context.Context, m kafka.Message) bool {
+	failedAt, err := time.Parse(time.RFC3339Nano, HeaderValue(m, HeaderRetryFailedAt))
+	if c.delay <= 0 || err != nil {
+		return true
+	}
+	wait := time.Until(failedAt.Add(c.delay))
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.delivery.Done():
+		return false
+	}
+}
+
+/*
+Runs the action of the processor with the retry policy, or only once with retry topics. The delivery continues
+the trace of the producer of the message, with a child span for every attempt. Returns the outcome of finish, or paused
+when the circuit of the destination opened before the retries were exhausted, then the message is neither committed
+nor written to the next topic, and it is delivered again when the circuit lets attempts through.
+*/
+func (c *Consumer) deliver(m kafka.Message) string {
+	ctx, span := tracing.Tracer().Start(ExtractTraceContext(c.delivery, m), m.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("kafka"),
+			semconv.MessagingDestinationKey.String(m.Topic),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingKafkaMessageKeyKey.String(string(m.Key)),
+			semconv.MessagingKafkaPartitionKey.Int(m.Partition),
+			attribute.Int64("messaging.kafka.offset", m.Offset),
+			attribute.String("destination", c.destination),
+		),
+	)
+
+	attempts := 0
+	operation := func() error {
+		attempts++
+		attemptCtx, attemptSpan := tracing.Tracer().Start(ctx, "delivery attempt", trace.WithAttributes(attribute.Int("attempt", attempts)))
+		err := c.processor.Action(attemptCtx, m)
+		if errors.Is(err, circuitbreaker.ErrOpen) {
+			// the destination was not attempted, the retries stop and the delivery waits for the circuit
+			attempts--
+			attemptSpan.SetAttributes(attribute.String("outcome", deliveryPaused))
+			attemptSpan.End()
+			return cenkalti.Permanent(err)
+		}
+		if err != nil {
+			class, _ := delivery.Classify(err)
+			attemptSpan.SetAttributes(attribute.String("error_class", class))
+			c.metrics.DeliveryError(c.destination, class)
+		}
+		tracing.End(attemptSpan, err)
+		return err
+	}
+
+	var err error
+	if c.retryTopics() {
+		err = operation()
+	} else {
+		err = c.retryPolicy.Run(c.delivery, operation, c.messageFields(m)...)
+	}
+
+	if errors.Is(err, circuitbreaker.ErrOpen) {
+		c.logger.Info("circuit is open, delivery paused", append(c.messageFields(m), zap.Int("attempt", attempts))...)
+		span.SetAttributes(attribute.Int("attempts", attempts), attribute.String("outcome", deliveryPaused))
+		tracing.End(span, nil)
+		return deliveryPaused
+	}
+
+	outcome := c.finish(ctx, m, attempts, err)
+	span.SetAttributes(attribute.Int("attempts", attempts), attribute.String("outcome", outcome))
+	tracing.End(span, err)
+	return outcome
+}
+
+/*
+Ends the delivery of a message after its attempts, with err of the last one: a failed message is written to the next
+retry topic, or to the dead-letter topic when the retries are exhausted or the error is permanent. Returns the outcome,
+aborted when the retries were aborted by shutdown or the message could not be written to the next topic, then the
+message should not be committed and the consumer stops, so the message is delivered again after restart.
+*/
+func (c *Consumer) finish(ctx context.Context, m kafka.Message, attempts int, err error) string {
+	// attempts of the previous consumers of the message, with retry topics
+	previousAttempts, _ := strconv.Atoi(HeaderValue(m, HeaderRetryAttempts))
+	totalAttempts := previousAttempts + attempts
+
+	outcome := metrics.DeliveryDelivered
+	class, _ := delivery.Classify(err)
+	failureFields := append(c.messageFields(m), zap.Int("attempt", totalAttempts), zap.Error(err), zap.String("error_class", class))
+	switch {
+	case err == nil:
+		c.logger.Info("event delivered", append(c.messageFields(m), zap.Int("attempt", totalAttempts))...)
+	case c.delivery.Err() != nil:
+		outcome = metrics.DeliveryAborted
+	case c.retry != nil && class != delivery.ClassPermanent:
+		outcome = metrics.DeliveryRetried
+		c.logger.Warn("delivery failed, retrying with retry topic", append(failureFields, zap.String("next_topic", c.retry.Topic))...)
+		if !c.writeRetry(ctx, m, totalAttempts, err) {
+			outcome = metrics.DeliveryAborted
+		}
+	default:
+		outcome = metrics.DeliveryFailed
+		if class == delivery.ClassPermanent {
+			c.logger.Error("delivery failed with permanent error, not retried", failureFields...)
+		} else {
+			c.logger.Error("delivery failed, retries exhausted", failureFields...)
+		}
+		if !c.writeDeadLetter(ctx, m, totalAttempts, err) {
+			outcome = metrics.DeliveryAborted
+		}
+	}
+	c.metrics.Delivery(c.destination, attempts, outcome, m.Time)
+	return outcome
+}
+
+/*
+Writes the message to the next retry topic with its key, value and headers, and headers with the attempts so far, the
+last error, the failure time (the delay of the next topic starts from it) and the origin of the message.
+*/
+func (c *Consumer) writeRetry(ctx context.Context, m kafka.Message, attempts int, cause error) bool {
+	topic, partition, offset := origin(m)
+	return c.forward(ctx, m, c.retry,
+		kafka.Header{Key: HeaderRetryAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderRetryError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderRetryFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+		kafka.Header{Key: HeaderRetryTopic, Value: []byte(topic)},
+		kafka.Header{Key: HeaderRetryPartition, Value: []byte(partition)},
+		kafka.Header{Key: HeaderRetryOffset, Value: []byte(offset)},
+	)
+}
+
+/*
+Writes the message to the dead-letter topic of the destination with its key, value and headers, and headers with the
+destination, the last error and its class, the attempts, the origin of the message and the failure time. Returns true
+without writing when the consumer has no dead-letter topic.
+*/
+func (c *Consumer) writeDeadLetter(ctx context.Context, m kafka.Message, attempts int, cause error) bool {
+	if c.deadLetter == nil {
+		return true
+	}
+	class, _ := delivery.Classify(cause)
+
+	topic, partition, offset := origin(m)
+	if !c.forward(ctx, m, c.deadLetter,
+		kafka.Header{Key: HeaderDeadLetterDestination, Value: []byte(c.destination)},
+		kafka.Header{Key: HeaderDeadLetterError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderDeadLetterErrorClass, Value: []byte(class)},
+		kafka.Header{Key: HeaderDeadLetterAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderDeadLetterTopic, Value: []byte(topic)},
+		kafka.Header{Key: HeaderDeadLetterPartition, Value: []byte(partition)},
+		kafka.Header{Key: HeaderDeadLetterOffset, Value: []byte(offset)},
+		kafka.Header{Key: HeaderDeadLetterFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	) {
+		return false
+	}
+	c.metrics.DeadLettered(c.destination)
+	c.logger.Warn("event written to dead-letter topic", append(c.messageFields(m), zap.String("next_topic", c.deadLetter.Topic))...)
+	return true
+}
+
+/*
+Writes the message with the producer, with the given headers replacing the headers of the message with the same key,
+and the trace context of the delivery. The write is retried with the default exponential backoff, whatever the retry
+policy of the destination is.
+*/
+func (c *Consumer) forward(ctx context.Context, m kafka.Message, producer *Producer, headers ...kafka.Header) bool {
+	forwarded := m
+	forwarded.Headers = append([]kafka.Header{}, m.Headers...)
+	carrier := headerCarrier{headers: &forwarded.Headers}
+	for _, header := range headers {
+		carrier.Set(header.Key, string(header.Value))
+	}
+	forwarded.Headers = injectTraceContext(ctx, forwarded.Headers)
+
+	fields := append(c.messageFields(m), zap.String("next_topic", producer.Topic))
+	err := c.writePolicy.Run(c.delivery, func() error {
+		return producer.Write(ctx, forwarded)
+	}, fields...)
+	if err != nil {
+		c.logger.Error("failed to write event to next topic", append(fields, zap.Error(err))...)
+		return false
+	}
+	return true
+}
+
+// fields of every delivery log line of the message
+func (c *Consumer) messageFields(m kafka.Message) []zap.Field {
+	return []zap.Field{
+		zap.String("destination", c.destination),
+		zap.String("topic", m.Topic),
+		zap.String("key", string(m.Key)),
+		zap.Int("partition", m.Partition),
+		zap.Int64("offset", m.Offset),
+	}
+}
+
+// false after Consume returned, because it was stopped or the reader failed
+func (c *Consumer) Running() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+/*
+Waits until Consume returns, after its ctx is done. When ctx of Shutdown is done first, the retries of the current
+message are aborted and Shutdown waits only for the attempt in progress.
+*/
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.abortDelivery()
+		<-c.done
+		return ctx.Err()
+	}
+}
+
+/*
+According to documentation
+Note that it is important to call Close() on a Reader when a process exits. The kafka server needs a graceful
+disconnect to stop it from continuing to attempt to send messages to the connected clients.
+Close should be called after Shutdown, so the reader is not closed while offsets are committed.
+*/
+func (c *Consumer) Close() error {
+	c.abortDelivery()
+	groupID := c.reader.Config().GroupID
+	if err := c.reader.Close(); err != nil {
+		return fmt.Errorf("failed to close reader with groupId %s: %w", groupID, err)
+	}
+	for _, producer := range []*Producer{c.deadLetter, c.retry} {
+		if producer == nil {
+			continue
+		}
+		if err := producer.Close(); err != nil {
+			return fmt.Errorf("failed to close producer of topic %s of groupId %s: %w", producer.Topic, groupID, err)
 		}
 	}
+	c.logger.Info("consumer reader closed", zap.String("destination", c.destination), zap.String("group_id", groupID))
+	return nil
 }
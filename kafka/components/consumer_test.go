@@ -0,0 +1,443 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"event-delivery-kafka/delivery"
+	"event-delivery-kafka/delivery/circuitbreaker"
+	"event-delivery-kafka/kafka/backoff"
+	"event-delivery-kafka/kafka/processors"
+	"event-delivery-kafka/metrics"
+	"event-delivery-kafka/models"
+	"event-delivery-kafka/tracing"
+	cenkalti "github.com/cenkalti/backoff/v4"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+	"time"
+)
+
+func TestConsumerStopsFetchingAndCloses(t *testing.T) {
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error { return nil })
+	backoffStrategy := backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig())
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{GroupID: "event-delivery-kafka-test"}, processor, backoffStrategy)
+
+	ctx, stopConsuming := context.WithCancel(context.Background())
+	go consumer.Consume(ctx)
+	stopConsuming()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, consumer.Shutdown(shutdownCtx))
+	assert.Nil(t, consumer.Close())
+}
+
+func TestBackoffStopsRetryingWhenContextIsDone(t *testing.T) {
+	backoffStrategy := backoff.ExponentialBackOffWithRetries{}.New(100, retryConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	err := backoffStrategy.Run(ctx, func() error {
+		attempts++
+		if attempts == 2 {
+			cancel()
+		}
+		return context.DeadlineExceeded
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestDeliveryContinuesTraceOfProducer(t *testing.T) {
+	spans := recordSpans(t)
+	writer := &capturingWriter{}
+	producer := &Producer{Writer: writer, Topic: "event-log"}
+
+	// the trace context of the request is kept with the message, like for events accepted asynchronously
+	requestCtx, requestSpan := tracing.Tracer().Start(context.Background(), "ingest")
+	message := models.KafkaMessage{Key: "user_test_1", Value: "event click !!!!", TraceContext: map[string]string{}}
+	otel.GetTextMapPropagator().Inject(requestCtx, propagation.MapCarrier(message.TraceContext))
+	assert.Nil(t, producer.Send(context.Background(), message))
+	requestSpan.End()
+	assert.NotEqual(t, "", HeaderValue(writer.messages[0], "traceparent"))
+
+	calls := 0
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		calls++
+		_, span := tracing.Tracer().Start(ctx, "postgres receive")
+		defer span.End()
+		if calls < 3 {
+			return errors.New("postgres is unavailable")
+		}
+		return nil
+	})
+	backoffStrategy := backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig())
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{GroupID: "event-delivery-kafka-test", Destination: "postgres"}, processor, backoffStrategy)
+	defer consumer.Close()
+	consumed := writer.messages[0]
+	consumed.Topic = "event-log"
+	assert.Equal(t, metrics.DeliveryDelivered, consumer.deliver(consumed))
+
+	byName := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range spans.Ended() {
+		assert.Equal(t, requestSpan.SpanContext().TraceID(), span.SpanContext().TraceID(), span.Name())
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+	send, process := byName["event-log send"][0], byName["event-log process"][0]
+	assert.Equal(t, requestSpan.SpanContext().SpanID(), send.Parent().SpanID())
+	assert.Equal(t, send.SpanContext().SpanID(), process.Parent().SpanID())
+	assert.Equal(t, 3, len(byName["delivery attempt"]))
+	assert.Equal(t, 3, len(byName["postgres receive"]))
+	for i, attempt := range byName["delivery attempt"] {
+		assert.Equal(t, process.SpanContext().SpanID(), attempt.Parent().SpanID())
+		assert.Equal(t, attempt.SpanContext().SpanID(), byName["postgres receive"][i].Parent().SpanID())
+	}
+}
+
+func TestDeliveryLogsCarryMessageFields(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		return errors.New("snowflake is unavailable")
+	})
+	config := retryConfig()
+	config.Logger = logger
+	backoffStrategy := backoff.ExponentialBackOffWithRetries{}.New(2, config)
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{GroupID: "event-delivery-kafka-test", Destination: "snowflake", Logger: logger}, processor, backoffStrategy)
+	defer consumer.Close()
+
+	assert.Equal(t, metrics.DeliveryFailed, consumer.deliver(kafka.Message{Topic: "event-log", Key: []byte("user_test_1"), Partition: 2, Offset: 42}))
+
+	retries := logs.FilterMessage("attempt failed, retrying").AllUntimed()
+	assert.Equal(t, 2, len(retries))
+	failed := logs.FilterMessage("delivery failed, retries exhausted").AllUntimed()
+	assert.Equal(t, 1, len(failed))
+	for _, entry := range append(retries, failed...) {
+		fields := entry.ContextMap()
+		assert.Equal(t, "snowflake", fields["destination"])
+		assert.Equal(t, "user_test_1", fields["key"])
+		assert.Equal(t, int64(2), fields["partition"])
+		assert.Equal(t, int64(42), fields["offset"])
+		assert.Equal(t, "snowflake is unavailable", fields["error"])
+	}
+	assert.Equal(t, int64(1), retries[0].ContextMap()["attempt"])
+	assert.Equal(t, int64(3), failed[0].ContextMap()["attempt"])
+	assert.Equal(t, zap.ErrorLevel, failed[0].Level)
+}
+
+func TestExhaustedMessageIsWrittenToDeadLetterTopic(t *testing.T) {
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		return errors.New("postgres is unavailable")
+	})
+	writer := &capturingWriter{}
+	backoffStrategy := backoff.ExponentialBackOffWithRetries{}.New(2, retryConfig())
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-test",
+		Destination: "postgres",
+		DeadLetter:  &Producer{Writer: writer, Topic: DeadLetterTopic("event-log", "postgres")},
+	}, processor, backoffStrategy)
+	defer consumer.Close()
+
+	timestamp := time.Now().Add(-time.Minute)
+	message := kafka.Message{
+		Topic:     "event-log",
+		Partition: 3,
+		Offset:    17,
+		Key:       []byte("user_test_1"),
+		Value:     []byte("event click !!!!"),
+		Time:      timestamp,
+		Headers:   []kafka.Header{{Key: HeaderEventID, Value: []byte("2b1c5c5e-5d1a-4a5e-9b0a-6d1f1f0c9e11")}},
+	}
+	assert.Equal(t, metrics.DeliveryFailed, consumer.deliver(message))
+
+	assert.Equal(t, "event-log.postgres.dlq", consumer.deadLetter.Topic)
+	assert.Equal(t, 1, len(writer.messages))
+	deadLetter := writer.messages[0]
+	assert.Equal(t, "", deadLetter.Topic)
+	assert.Equal(t, "user_test_1", string(deadLetter.Key))
+	assert.Equal(t, "event click !!!!", string(deadLetter.Value))
+	assert.Equal(t, timestamp, deadLetter.Time)
+	assert.Equal(t, "2b1c5c5e-5d1a-4a5e-9b0a-6d1f1f0c9e11", HeaderValue(deadLetter, HeaderEventID))
+	assert.Equal(t, "postgres", HeaderValue(deadLetter, HeaderDeadLetterDestination))
+	assert.Equal(t, "postgres is unavailable", HeaderValue(deadLetter, HeaderDeadLetterError))
+	assert.Equal(t, "3", HeaderValue(deadLetter, HeaderDeadLetterAttempts))
+	assert.Equal(t, "event-log", HeaderValue(deadLetter, HeaderDeadLetterTopic))
+	assert.Equal(t, "3", HeaderValue(deadLetter, HeaderDeadLetterPartition))
+	assert.Equal(t, "17", HeaderValue(deadLetter, HeaderDeadLetterOffset))
+	failedAt, err := time.Parse(time.RFC3339Nano, HeaderValue(deadLetter, HeaderDeadLetterFailedAt))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), failedAt, time.Minute)
+	// the consumed message is not changed
+	assert.Equal(t, 1, len(message.Headers))
+}
+
+func TestDeadLetterThatCanNotBeWrittenIsNotCommitted(t *testing.T) {
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		return errors.New("postgres is unavailable")
+	})
+	backoffStrategy := backoff.ExponentialBackOffWithRetries{}.New(1, retryConfig())
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-test",
+		Destination: "postgres",
+		DeadLetter:  &Producer{Writer: failingWriter{}, Topic: DeadLetterTopic("event-log", "postgres")},
+	}, processor, backoffStrategy)
+	defer consumer.Close()
+
+	assert.Equal(t, metrics.DeliveryAborted, consumer.deliver(kafka.Message{Topic: "event-log", Key: []byte("user_test_1")}))
+}
+
+func TestFailedMessageMovesThroughRetryTopicsToDeadLetterTopic(t *testing.T) {
+	calls := 0
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		calls++
+		return errors.New("snowflake is unavailable")
+	})
+	retryWriter, deadLetterWriter := &capturingWriter{}, &capturingWriter{}
+	delay := 100 * time.Millisecond
+
+	// the consumer of the events attempts once and moves the message to the retry topic
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-snowflake",
+		Destination: "snowflake",
+		Retry:       &Producer{Writer: retryWriter, Topic: RetryTopic("event-log", "snowflake", delay)},
+	}, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+	defer consumer.Close()
+	assert.Equal(t, metrics.DeliveryRetried, consumer.deliver(kafka.Message{Topic: "event-log", Partition: 4, Offset: 8, Key: []byte("user_test_1"), Value: []byte("event click !!!!")}))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, len(retryWriter.messages))
+	retried := retryWriter.messages[0]
+	assert.Equal(t, "1", HeaderValue(retried, HeaderRetryAttempts))
+	assert.Equal(t, "snowflake is unavailable", HeaderValue(retried, HeaderRetryError))
+	assert.Equal(t, "event-log", HeaderValue(retried, HeaderRetryTopic))
+	assert.Equal(t, "4", HeaderValue(retried, HeaderRetryPartition))
+	assert.Equal(t, "8", HeaderValue(retried, HeaderRetryOffset))
+
+	// the consumer of the last retry topic waits for the delay, attempts once and writes the dead letter
+	retryConsumer := Consumer{}.New(RetryTopic("event-log", "snowflake", delay), "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-snowflake-retry-100ms",
+		Destination: "snowflake",
+		DeadLetter:  &Producer{Writer: deadLetterWriter, Topic: DeadLetterTopic("event-log", "snowflake")},
+		Delay:       delay,
+	}, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+	defer retryConsumer.Close()
+	assert.Equal(t, "snowflake/retry-100ms", retryConsumer.Name())
+
+	retried.Topic, retried.Partition, retried.Offset = RetryTopic("event-log", "snowflake", delay), 0, 1
+	failedAt, err := time.Parse(time.RFC3339Nano, HeaderValue(retried, HeaderRetryFailedAt))
+	assert.Nil(t, err)
+	assert.True(t, retryConsumer.waitUntilDue(context.Background(), retried))
+	assert.False(t, time.Now().Before(failedAt.Add(delay)))
+	assert.Equal(t, metrics.DeliveryFailed, retryConsumer.deliver(retried))
+	assert.Equal(t, 2, calls)
+
+	assert.Equal(t, 1, len(deadLetterWriter.messages))
+	deadLetter := deadLetterWriter.messages[0]
+	assert.Equal(t, "user_test_1", string(deadLetter.Key))
+	assert.Equal(t, "2", HeaderValue(deadLetter, HeaderDeadLetterAttempts))
+	assert.Equal(t, "event-log", HeaderValue(deadLetter, HeaderDeadLetterTopic))
+	assert.Equal(t, "4", HeaderValue(deadLetter, HeaderDeadLetterPartition))
+	assert.Equal(t, "8", HeaderValue(deadLetter, HeaderDeadLetterOffset))
+}
+
+func TestPermanentErrorSkipsRetriesAndRetryTopics(t *testing.T) {
+	calls := 0
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		calls++
+		return delivery.Permanent(errors.New("eventGrid: rejected cloudevent"))
+	})
+	retryWriter, deadLetterWriter := &capturingWriter{}, &capturingWriter{}
+	for _, config := range []ConsumerConfig{
+		{GroupID: "event-delivery-kafka-eventGrid", Destination: "eventGrid"},
+		{GroupID: "event-delivery-kafka-eventGrid", Destination: "eventGrid", Retry: &Producer{Writer: retryWriter, Topic: RetryTopic("event-log", "eventGrid", time.Minute)}},
+	} {
+		config.DeadLetter = &Producer{Writer: deadLetterWriter, Topic: DeadLetterTopic("event-log", "eventGrid")}
+		consumer := Consumer{}.New("event-log", "127.0.0.1:1", config, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+		assert.Equal(t, metrics.DeliveryFailed, consumer.deliver(kafka.Message{Topic: "event-log", Key: []byte("user_test_1")}))
+		consumer.Close()
+	}
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 0, len(retryWriter.messages))
+	assert.Equal(t, 2, len(deadLetterWriter.messages))
+	for _, deadLetter := range deadLetterWriter.messages {
+		assert.Equal(t, "1", HeaderValue(deadLetter, HeaderDeadLetterAttempts))
+		assert.Equal(t, delivery.ClassPermanent, HeaderValue(deadLetter, HeaderDeadLetterErrorClass))
+	}
+}
+
+func TestOpenCircuitPausesDeliveryWithoutDeadLetter(t *testing.T) {
+	breaker := circuitbreaker.Breaker{}.New("snowflake", circuitbreaker.Config{FailureThreshold: 2, OpenTimeout: 100 * time.Millisecond})
+	calls := 0
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error {
+		return breaker.Execute(func() error {
+			calls++
+			if calls <= 2 {
+				return errors.New("snowflake is unavailable")
+			}
+			return nil
+		})
+	})
+	deadLetterWriter := &capturingWriter{}
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-snowflake",
+		Destination: "snowflake",
+		DeadLetter:  &Producer{Writer: deadLetterWriter, Topic: DeadLetterTopic("event-log", "snowflake")},
+		Breaker:     breaker,
+	}, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+	defer consumer.Close()
+
+	// the circuit opens after the second attempt, so the third one is not made and the message is not dead-lettered
+	message := kafka.Message{Topic: "event-log", Key: []byte("user_test_1")}
+	assert.Equal(t, deliveryPaused, consumer.deliver(message))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 0, len(deadLetterWriter.messages))
+	assert.Equal(t, circuitbreaker.StateOpen, breaker.State().State)
+
+	assert.True(t, breaker.Wait(context.Background()))
+	assert.Equal(t, metrics.DeliveryDelivered, consumer.deliver(message))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, circuitbreaker.StateClosed, breaker.State().State)
+}
+
+func TestConsumerStopsWaitingForRetryWhenStopped(t *testing.T) {
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error { return nil })
+	consumer := Consumer{}.New(RetryTopic("event-log", "postgres", time.Hour), "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-postgres-retry-1h",
+		Destination: "postgres",
+		Delay:       time.Hour,
+	}, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+	defer consumer.Close()
+
+	message := kafka.Message{Headers: []kafka.Header{{Key: HeaderRetryFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.False(t, consumer.waitUntilDue(ctx, message))
+}
+
+func TestRetryTopicNames(t *testing.T) {
+	assert.Equal(t, "event-log.postgres.retry-1m", RetryTopic("event-log", "postgres", time.Minute))
+	assert.Equal(t, "event-log.postgres.retry-10m", RetryTopic("event-log", "postgres", 10*time.Minute))
+	assert.Equal(t, "event-log.postgres.retry-1h", RetryTopic("event-log", "postgres", time.Hour))
+	assert.Equal(t, "1h30m", FormatDelay(90*time.Minute))
+	assert.Equal(t, "45s", FormatDelay(45*time.Second))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return errors.New("leader not available")
+}
+
+func (failingWriter) Close() error {
+	return nil
+}
+
+// records the spans of the global tracer provider until the end of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func retryConfig() backoff.ExponentialBackOffWithRetriesConfig {
+	return backoff.ExponentialBackOffWithRetriesConfig{
+		InitialInterval: 10 * time.Millisecond,
+		Multiplier:      1,
+		MaxInterval:     10 * time.Millisecond,
+		Stop:            -1,
+		Clock:           cenkalti.SystemClock,
+	}
+}
+
+func TestPartiallyFailedBatchRetriesFailedEventsInOrderOfUsers(t *testing.T) {
+	var calls [][]int64
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error { return nil })
+	processor.BatchAction = func(ctx context.Context, messages []kafka.Message) error {
+		var offsets []int64
+		for _, m := range messages {
+			offsets = append(offsets, m.Offset)
+		}
+		calls = append(calls, offsets)
+		if len(calls) == 1 {
+			return delivery.PartiallyFailed(map[int]error{
+				0: errors.New("redshift: Can't receive event for userId user_test_1"),
+				3: delivery.Permanent(errors.New("redshift: invalid row")),
+			})
+		}
+		return nil
+	}
+	deadLetterWriter := &capturingWriter{}
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-redshift",
+		Destination: "redshift",
+		DeadLetter:  &Producer{Writer: deadLetterWriter, Topic: DeadLetterTopic("event-log", "redshift")},
+		Batch:       BatchConfig{MaxSize: 4},
+	}, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+	defer consumer.Close()
+	assert.True(t, consumer.batching())
+
+	var entries []*batchEntry
+	for offset, key := range []string{"user_test_1", "user_test_2", "user_test_1", "user_test_3"} {
+		entries = append(entries, &batchEntry{message: kafka.Message{Topic: "event-log", Key: []byte(key), Offset: int64(offset)}})
+	}
+	outcome, pending := consumer.deliverBatch(entries)
+	assert.Equal(t, metrics.DeliveryDelivered, outcome)
+	assert.Equal(t, 0, len(pending))
+
+	// the failed event of user_test_1 is retried with the next event of the user, the permanent failure is not retried
+	assert.Equal(t, [][]int64{{0, 1, 2, 3}, {0, 2}}, calls)
+	assert.Equal(t, 1, len(deadLetterWriter.messages))
+	assert.Equal(t, "user_test_3", string(deadLetterWriter.messages[0].Key))
+	assert.Equal(t, delivery.ClassPermanent, HeaderValue(deadLetterWriter.messages[0], HeaderDeadLetterErrorClass))
+	assert.Equal(t, 2, entries[0].attempts)
+	assert.Equal(t, 1, entries[1].attempts)
+}
+
+func TestBatchErrorOutsideOfTheBatchFailsTheWholeBatch(t *testing.T) {
+	var calls [][]int64
+	processor := processors.Processor{}.New(func(ctx context.Context, message kafka.Message) error { return nil })
+	processor.BatchAction = func(ctx context.Context, messages []kafka.Message) error {
+		var offsets []int64
+		for _, m := range messages {
+			offsets = append(offsets, m.Offset)
+		}
+		calls = append(calls, offsets)
+		switch len(calls) {
+		case 1:
+			return delivery.PartiallyFailed(map[int]error{7: errors.New("redshift: Can't receive event for userId user_test_1")})
+		case 2:
+			return delivery.PartiallyFailed(map[int]error{})
+		}
+		return nil
+	}
+	consumer := Consumer{}.New("event-log", "127.0.0.1:1", ConsumerConfig{
+		GroupID:     "event-delivery-kafka-redshift",
+		Destination: "redshift",
+		Batch:       BatchConfig{MaxSize: 2},
+	}, processor, backoff.ExponentialBackOffWithRetries{}.New(3, retryConfig()))
+	defer consumer.Close()
+
+	var entries []*batchEntry
+	for offset, key := range []string{"user_test_1", "user_test_2"} {
+		entries = append(entries, &batchEntry{message: kafka.Message{Topic: "event-log", Key: []byte(key), Offset: int64(offset)}})
+	}
+	outcome, _ := consumer.deliverBatch(entries)
+	assert.Equal(t, metrics.DeliveryDelivered, outcome)
+
+	// neither an index outside of the batch nor an empty batch error tells which events were delivered
+	assert.Equal(t, [][]int64{{0, 1}, {0, 1}, {0, 1}}, calls)
+	assert.Equal(t, 3, entries[0].attempts)
+	assert.Equal(t, 3, entries[1].attempts)
+}
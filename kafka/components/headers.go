@@ -0,0 +1,269 @@
+package components
+
+import (
+	"context"
+	"event-delivery-kafka/kafka/serde"
+	"event-delivery-kafka/models"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kafka message headers set by the producer. Empty values are never set.
+const (
+	HeaderEventID         = "event_id"
+	HeaderEventType       = "event_type"
+	HeaderSchemaVersion   = "schema_version"
+	HeaderSource          = "source"
+	HeaderClientTimestamp = "client_timestamp" // RFC 3339 with nanoseconds
+	HeaderPrincipal       = "principal"
+	HeaderValueFormat     = "value_format" // format of the value when it is serialized, see serde.Serializer
+)
+
+/*
+Headers added to the messages written to the dead-letter topic of a destination, next to the headers of the original
+message. Partition and offset are decimal, the failure time is RFC 3339 with nanoseconds.
+*/
+const (
+	HeaderDeadLetterDestination = "dlq_destination"
+	HeaderDeadLetterError       = "dlq_error"
+	HeaderDeadLetterErrorClass  = "dlq_error_class" // see delivery.Classify
+	HeaderDeadLetterAttempts    = "dlq_attempts"
+	HeaderDeadLetterTopic       = "dlq_original_topic"
+	HeaderDeadLetterPartition   = "dlq_original_partition"
+	HeaderDeadLetterOffset      = "dlq_original_offset"
+	HeaderDeadLetterFailedAt    = "dlq_failed_at"
+)
+
+/*
+Headers added to the messages written to a retry topic. The attempts are the attempts of all the consumers of the
+message so far, the origin is the topic, partition and offset of the message before the first retry topic.
+*/
+const (
+	HeaderRetryAttempts  = "retry_attempts"
+	HeaderRetryError     = "retry_error"
+	HeaderRetryFailedAt  = "retry_failed_at" // RFC 3339 with nanoseconds, the delay of the retry topic starts from it
+	HeaderRetryTopic     = "retry_original_topic"
+	HeaderRetryPartition = "retry_original_partition"
+	HeaderRetryOffset    = "retry_original_offset"
+)
+
+// topic, partition and offset of the message before it was written to the first retry topic
+func origin(message kafka.Message) (topic string, partition string, offset string) {
+	if topic := HeaderValue(message, HeaderRetryTopic); topic != "" {
+		return topic, HeaderValue(message, HeaderRetryPartition), HeaderValue(message, HeaderRetryOffset)
+	}
+	return message.Topic, strconv.Itoa(message.Partition), strconv.FormatInt(message.Offset, 10)
+}
+
+// returns the value of the first header with the given key, or empty string if the message does not have it
+func HeaderValue(message kafka.Message, key string) string {
+	for _, header := range message.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+/*
+Carries the trace context in the headers of a message, with the header names of the W3C trace context
+(traceparent, tracestate), like the http headers of the requests.
+*/
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (carrier headerCarrier) Get(key string) string {
+	return HeaderValue(kafka.Message{Headers: *carrier.headers}, key)
+}
+
+func (carrier headerCarrier) Set(key string, value string) {
+	for i := range *carrier.headers {
+		if (*carrier.headers)[i].Key == key {
+			(*carrier.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*carrier.headers = append(*carrier.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (carrier headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(*carrier.headers))
+	for _, header := range *carrier.headers {
+		keys = append(keys, header.Key)
+	}
+	return keys
+}
+
+// adds the trace context of ctx to the headers
+func injectTraceContext(ctx context.Context, headers []kafka.Header) []kafka.Header {
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier{headers: &headers})
+	return headers
+}
+
+// context with the trace context of the headers of the message, ctx when the message has none
+func ExtractTraceContext(ctx context.Context, message kafka.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier{headers: &message.Headers})
+}
+
+/*
+Headers of the Kafka protocol binding of CloudEvents, binary content mode
+(https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/kafka-protocol-binding.md).
+Every attribute and extension is a header with prefix "ce_", except datacontenttype, which is "content-type".
+*/
+const (
+	CloudEventsHeaderPrefix = "ce_"
+	HeaderContentType       = "content-type"
+)
+
+// maps the metadata of the envelope onto headers, CloudEvents with the Kafka protocol binding
+func envelopeHeaders(msg models.KafkaMessage) []kafka.Header {
+	var headers []kafka.Header
+	add := func(key string, value string) {
+		if value != "" {
+			headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+	}
+
+	if msg.SpecVersion != "" {
+		add(CloudEventsHeaderPrefix+"specversion", msg.SpecVersion)
+		add(CloudEventsHeaderPrefix+"id", msg.EventID)
+		add(CloudEventsHeaderPrefix+"source", msg.Source)
+		add(CloudEventsHeaderPrefix+"type", msg.EventType)
+		add(CloudEventsHeaderPrefix+"subject", msg.Subject)
+		add(CloudEventsHeaderPrefix+"dataschema", msg.DataSchema)
+		if !msg.ClientTimestamp.IsZero() {
+			add(CloudEventsHeaderPrefix+"time", msg.ClientTimestamp.Format(time.RFC3339Nano))
+		}
+		add(HeaderContentType, msg.DataContentType)
+		for name, value := range msg.Extensions {
+			add(CloudEventsHeaderPrefix+name, value)
+		}
+		add(HeaderPrincipal, msg.Principal)
+		return headers
+	}
+
+	add(HeaderEventID, msg.EventID)
+	add(HeaderEventType, msg.EventType)
+	add(HeaderSchemaVersion, msg.SchemaVersion)
+	add(HeaderSource, msg.Source)
+	if !msg.ClientTimestamp.IsZero() {
+		add(HeaderClientTimestamp, msg.ClientTimestamp.Format(time.RFC3339Nano))
+	}
+	add(HeaderPrincipal, msg.Principal)
+	return headers
+}
+
+/*
+Rebuilds the envelope of the event from a consumed message. Messages produced before the envelope was introduced
+have no headers, so only UserID, Payload and ReceivedAt are set for them.
+*/
+func EventFromMessage(message kafka.Message) *models.Event {
+	if HeaderValue(message, CloudEventsHeaderPrefix+"specversion") != "" {
+		return cloudEventFromMessage(message)
+	}
+
+	event := models.Event{}.New(string(message.Key), string(message.Value))
+	event.EventID = HeaderValue(message, HeaderEventID)
+	event.EventType = HeaderValue(message, HeaderEventType)
+	event.SchemaVersion = HeaderValue(message, HeaderSchemaVersion)
+	event.Source = HeaderValue(message, HeaderSource)
+	if clientTimestamp, err := time.Parse(time.RFC3339Nano, HeaderValue(message, HeaderClientTimestamp)); err == nil {
+		event.ClientTimestamp = clientTimestamp
+	}
+	event.ReceivedAt = message.Time
+	event.Principal = HeaderValue(message, HeaderPrincipal)
+	return event
+}
+
+func cloudEventFromMessage(message kafka.Message) *models.Event {
+	event := models.Event{}.New(string(message.Key), string(message.Value))
+	event.Extensions = map[string]string{}
+	for _, header := range message.Headers {
+		if !strings.HasPrefix(header.Key, CloudEventsHeaderPrefix) {
+			continue
+		}
+		value := string(header.Value)
+		switch name := strings.TrimPrefix(header.Key, CloudEventsHeaderPrefix); name {
+		case "specversion":
+			event.SpecVersion = value
+		case "id":
+			event.EventID = value
+		case "source":
+			event.Source = value
+		case "type":
+			event.EventType = value
+		case "subject":
+			event.Subject = value
+		case "dataschema":
+			event.DataSchema = value
+		case "time":
+			if clientTimestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				event.ClientTimestamp = clientTimestamp
+			}
+		default:
+			event.Extensions[name] = value
+		}
+	}
+	event.SchemaVersion = event.Extensions["schemaversion"]
+	event.DataContentType = HeaderValue(message, HeaderContentType)
+	event.ReceivedAt = message.Time
+	event.Principal = HeaderValue(message, HeaderPrincipal)
+	return event
+}
+
+/*
+Rebuilds the event of a consumed message as a CloudEvent, for destinations that receive CloudEvents.
+Events that were not sent as CloudEvents get the topic, partition and offset of the message as id (so redeliveries
+of the same message keep their id), this app as source and a generic type when they have no event_type.
+*/
+func CloudEventFromMessage(message kafka.Message) models.CloudEvent {
+	return CloudEventFromEvent(message, *EventFromMessage(message))
+}
+
+// CloudEvent of an event already rebuilt from the message, like with DecodeEvent
+func CloudEventFromEvent(message kafka.Message, event models.Event) models.CloudEvent {
+	defaultID := fmt.Sprintf("%s-%d-%d", message.Topic, message.Partition, message.Offset)
+	return event.ToCloudEvent(defaultID, "/event-delivery-kafka", "event-delivery-kafka.event")
+}
+
+// id of the event of the message, set by the producer with the envelope or the CloudEvents headers
+func messageEventID(message kafka.Message) string {
+	if eventID := HeaderValue(message, HeaderEventID); eventID != "" {
+		return eventID
+	}
+	return HeaderValue(message, CloudEventsHeaderPrefix+"id")
+}
+
+/*
+Rebuilds the event of a consumed message like EventFromMessage, decoding the record of serialized values with the
+serializer of their format. Values without format are the raw payload.
+*/
+func DecodeEvent(message kafka.Message, serializers map[string]serde.Serializer) (*models.Event, error) {
+	event := EventFromMessage(message)
+	format := HeaderValue(message, HeaderValueFormat)
+	if format == "" {
+		return event, nil
+	}
+	serializer, ok := serializers[format]
+	if !ok {
+		return nil, fmt.Errorf("no serializer for value format %s", format)
+	}
+
+	record, err := serializer.Deserialize(message.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s value: %w", format, err)
+	}
+	event.UserID = record.UserID
+	event.Payload = record.Payload
+	event.EventID = record.EventID
+	event.EventType = record.EventType
+	event.SchemaVersion = record.SchemaVersion
+	event.Source = record.Source
+	event.ClientTimestamp = record.ClientTimestamp
+	return event, nil
+}
@@ -2,9 +2,20 @@ package components
 
 import (
 	"context"
+	"errors"
+	"event-delivery-kafka/kafka/serde"
+	"event-delivery-kafka/logging"
+	"event-delivery-kafka/metrics"
 	"event-delivery-kafka/models"
+	"event-delivery-kafka/tracing"
+	"fmt"
 	"github.com/segmentio/kafka-go"
-	"log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,44 +29,210 @@ type ProducerConfig struct {
 	WriteTimeout time.Duration
 	ReadTimeout  time.Duration
 	RequiredAcks kafka.RequiredAcks
-	Logger       kafka.Logger
+	Logger       *zap.Logger // optional, logger of the failed writes
+	KafkaLogger  *zap.Logger // optional, logger of the internal logs of the writer
+}
+
+/*
+Result of writing a message with an event id to Kafka. Partition and Offset are set only when Err is nil.
+*/
+type DeliveryReport struct {
+	EventID   string
+	Principal string // principal of the message, event ids are unique only per principal
+	Partition int
+	Offset    int64
+	Err       error
 }
 
 type Producer struct {
-	Writer KafkaWriter
+	Writer     KafkaWriter
+	Topic      string                          // subject of the schemas of the serializer
+	Serializer serde.Serializer                // optional, values are the raw payload when nil
+	OnDelivery func(reports ...DeliveryReport) // optional, called when messages with an event id are written (or failed)
+	Metrics    *metrics.Metrics                // optional, latency of the writes is not observed when nil
+	Logger     *zap.Logger                     // optional, failed writes are not logged when nil
+	closed     int32                           // set by Close, read atomically
 }
 
 func (Producer) New(topic string, brokerAddress string, config ProducerConfig) *Producer {
-	return &Producer{
-		Writer: &kafka.Writer{
-			Addr:                   kafka.TCP(brokerAddress),
-			Topic:                  topic,
-			Balancer:               config.Balancer,
-			WriteTimeout:           config.WriteTimeout,
-			ReadTimeout:            config.ReadTimeout,
-			RequiredAcks:           config.RequiredAcks,
-			AllowAutoTopicCreation: true,
-		},
+	producer := &Producer{Topic: topic, Logger: config.Logger}
+	producer.Writer = &kafka.Writer{
+		Addr:                   kafka.TCP(brokerAddress),
+		Topic:                  topic,
+		Balancer:               config.Balancer,
+		WriteTimeout:           config.WriteTimeout,
+		ReadTimeout:            config.ReadTimeout,
+		RequiredAcks:           config.RequiredAcks,
+		AllowAutoTopicCreation: true,
+		Completion:             producer.complete,
+		Logger:                 logging.KafkaLogger(config.KafkaLogger),
+		ErrorLogger:            logging.KafkaErrorLogger(config.KafkaLogger),
 	}
+	return producer
 }
 
+/*
+Called by kafka.Writer for every batch written to a partition, with partition and offset set on the messages
+from the produce response.
+*/
+func (producer *Producer) complete(messages []kafka.Message, err error) {
+	if producer.OnDelivery == nil {
+		return
+	}
+
+	reports := make([]DeliveryReport, 0, len(messages))
+	for _, message := range messages {
+		eventID := messageEventID(message)
+		if eventID == "" {
+			continue
+		}
+		report := DeliveryReport{EventID: eventID, Principal: HeaderValue(message, HeaderPrincipal), Err: err}
+		if err == nil {
+			report.Partition = message.Partition
+			report.Offset = message.Offset
+		}
+		reports = append(reports, report)
+	}
+	if len(reports) > 0 {
+		producer.OnDelivery(reports...)
+	}
+}
+
+/*
+Every message gets a span of its own, child of the trace context of the message (set by the request that produced
+it) or else of ctx. The context of the span is sent with the headers of the message, so consumers continue the trace.
+*/
 func (producer *Producer) Send(ctx context.Context, msgs ...models.KafkaMessage) error {
+	messages := make([]kafka.Message, len(msgs))
+	for i := range msgs {
+		value, headers, err := producer.encode(msgs[i])
+		if err != nil {
+			return err
+		}
+		messages[i] = kafka.Message{
+			Key:     []byte(msgs[i].Key),
+			Value:   value,
+			Time:    msgs[i].Timestamp,
+			Headers: headers,
+		}
+	}
+
+	spans := make([]trace.Span, len(msgs))
+	for i := range msgs {
+		parent := ctx
+		if len(msgs[i].TraceContext) > 0 {
+			parent = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msgs[i].TraceContext))
+		}
+		spanCtx, span := tracing.Tracer().Start(parent, producer.Topic+" send",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("kafka"),
+				semconv.MessagingDestinationKey.String(producer.Topic),
+				semconv.MessagingKafkaMessageKeyKey.String(msgs[i].Key),
+				semconv.MessagingMessageIDKey.String(msgs[i].EventID),
+			),
+		)
+		messages[i].Headers = injectTraceContext(spanCtx, messages[i].Headers)
+		spans[i] = span
+	}
+
+	start := time.Now()
+	err := producer.Writer.WriteMessages(ctx, messages...)
+	producer.Metrics.Produced(time.Since(start), len(messages), err)
+	if err != nil {
+		logging.OrNop(producer.Logger).Error("failed to write messages", zap.String("topic", producer.Topic), zap.Int("messages", len(messages)), zap.Error(err))
+	}
+	for _, span := range spans {
+		tracing.End(span, err)
+	}
+	return err
+}
+
+/*
+Writes messages that are already encoded, like consumed messages forwarded to another topic, with their key, value,
+headers and timestamp. Topic, partition and offset of consumed messages are not kept, the writer sets its own.
+*/
+func (producer *Producer) Write(ctx context.Context, msgs ...kafka.Message) error {
 	messages := make([]kafka.Message, len(msgs))
 	for i := range msgs {
 		messages[i] = kafka.Message{
-			Key:   []byte(msgs[i].Key),
-			Value: []byte(msgs[i].Value),
-			Time:  msgs[i].Timestamp,
+			Key:     msgs[i].Key,
+			Value:   msgs[i].Value,
+			Time:    msgs[i].Time,
+			Headers: msgs[i].Headers,
 		}
 	}
 
-	return producer.Writer.WriteMessages(ctx, messages...)
+	start := time.Now()
+	err := producer.Writer.WriteMessages(ctx, messages...)
+	producer.Metrics.Produced(time.Since(start), len(messages), err)
+	if err != nil {
+		logging.OrNop(producer.Logger).Error("failed to write messages", zap.String("topic", producer.Topic), zap.Int("messages", len(messages)), zap.Error(err))
+	}
+	return err
+}
+
+/*
+Value and headers of the message. CloudEvents already have a contract (the Kafka binding of CloudEvents), so their
+data is never serialized.
+*/
+func (producer *Producer) encode(msg models.KafkaMessage) ([]byte, []kafka.Header, error) {
+	headers := envelopeHeaders(msg)
+	if producer.Serializer == nil || msg.SpecVersion != "" {
+		return []byte(msg.Value), headers, nil
+	}
+
+	value, err := producer.Serializer.Serialize(producer.Topic, models.Event{
+		UserID:          msg.Key,
+		Payload:         msg.Value,
+		EventID:         msg.EventID,
+		EventType:       msg.EventType,
+		SchemaVersion:   msg.SchemaVersion,
+		Source:          msg.Source,
+		ClientTimestamp: msg.ClientTimestamp,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to serialize event for key %s: %w", msg.Key, err)
+	}
+	return value, append(headers, kafka.Header{Key: HeaderValueFormat, Value: []byte(producer.Serializer.Format())}), nil
+}
+
+/*
+Checks that writes can succeed: the producer is not closed and every partition of the topic of the writer has a leader.
+Writers other than kafka.Writer (like mocks of tests) are always writable.
+*/
+func (producer *Producer) Writable(ctx context.Context) error {
+	if atomic.LoadInt32(&producer.closed) == 1 {
+		return errors.New("producer is closed")
+	}
+	writer, ok := producer.Writer.(*kafka.Writer)
+	if !ok {
+		return nil
+	}
+
+	partitions, err := readPartitions(ctx, writer.Addr.String(), writer.Topic)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no partitions", writer.Topic)
+	}
+	for _, partition := range partitions {
+		if partition.Error != nil {
+			return fmt.Errorf("partition %d of topic %s: %w", partition.ID, writer.Topic, partition.Error)
+		}
+		if partition.Leader.Host == "" {
+			return fmt.Errorf("partition %d of topic %s has no leader", partition.ID, writer.Topic)
+		}
+	}
+	return nil
 }
 
+// flushes the messages buffered by the writer and closes it
 func (producer *Producer) Close() error {
+	atomic.StoreInt32(&producer.closed, 1)
 	if err := producer.Writer.Close(); err != nil {
-		log.Fatal("failed to close writer:", err)
-		return err
+		return fmt.Errorf("failed to close writer: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,65 @@
+package components
+
+import (
+	"context"
+	"event-delivery-kafka/kafka/serde"
+	"event-delivery-kafka/models"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type capturingWriter struct {
+	messages []kafka.Message
+}
+
+func (writer *capturingWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	writer.messages = append(writer.messages, msgs...)
+	return nil
+}
+
+func (writer *capturingWriter) Close() error {
+	return nil
+}
+
+func TestSendSerializedEventAndDecode(t *testing.T) {
+	registry := serde.MemoryRegistry{}.New()
+	writer := &capturingWriter{}
+	producer := &Producer{Writer: writer, Topic: "event-log", Serializer: serde.AvroSerializer{}.New(registry)}
+
+	message := models.KafkaMessage{Key: "user_test_1", Value: "event click !!!!", Timestamp: time.Now(), EventID: "event_1", EventType: "click"}
+	assert.Nil(t, producer.Send(context.Background(), message))
+	assert.Equal(t, 1, len(writer.messages))
+	written := writer.messages[0]
+	assert.Equal(t, serde.FormatAvro, HeaderValue(written, HeaderValueFormat))
+	assert.NotEqual(t, "event click !!!!", string(written.Value))
+
+	// the event is decoded with the serializer of its format, whatever the format of the producer is
+	event, err := DecodeEvent(written, serde.Serializers(registry))
+	assert.Nil(t, err)
+	assert.Equal(t, "user_test_1", event.UserID)
+	assert.Equal(t, "event click !!!!", event.Payload)
+	assert.Equal(t, "event_1", event.EventID)
+	assert.Equal(t, "click", event.EventType)
+	assert.Equal(t, written.Time, event.ReceivedAt)
+
+	_, err = DecodeEvent(written, map[string]serde.Serializer{})
+	assert.EqualError(t, err, "no serializer for value format avro")
+}
+
+func TestSendRawAndCloudEventsWithoutSerializing(t *testing.T) {
+	writer := &capturingWriter{}
+	raw := &Producer{Writer: writer}
+	serialized := &Producer{Writer: writer, Topic: "event-log", Serializer: serde.JSONSerializer{}.New(serde.MemoryRegistry{}.New())}
+
+	assert.Nil(t, raw.Send(context.Background(), models.KafkaMessage{Key: "user_test_1", Value: "event click !!!!"}))
+	assert.Nil(t, serialized.Send(context.Background(), models.KafkaMessage{Key: "user_test_1", Value: `{"x": 1}`, SpecVersion: "1.0", EventID: "event_1", Source: "/web", EventType: "click.v1"}))
+
+	for _, written := range writer.messages {
+		assert.Equal(t, "", HeaderValue(written, HeaderValueFormat))
+		event, err := DecodeEvent(written, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, string(written.Value), event.Payload)
+	}
+}
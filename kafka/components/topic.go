@@ -1,9 +1,12 @@
 package components
 
 import (
+	"context"
 	"github.com/segmentio/kafka-go"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type TopicConfig struct {
@@ -23,6 +26,32 @@ func (Topic) New(config TopicConfig) (p *Topic) {
 	}
 }
 
+func (topic *Topic) Name() string {
+	return topic.config.Topic
+}
+
+// topic of the messages of topic whose delivery to the destination failed after all retries
+func DeadLetterTopic(topic string, destination string) string {
+	return topic + "." + destination + ".dlq"
+}
+
+// topic of the messages of topic whose delivery to the destination failed, retried after the delay
+func RetryTopic(topic string, destination string, delay time.Duration) string {
+	return topic + "." + destination + ".retry-" + FormatDelay(delay)
+}
+
+// the delay without its zero units, like 1m, 10m or 1h30m
+func FormatDelay(delay time.Duration) string {
+	formatted := delay.String()
+	if strings.HasSuffix(formatted, "m0s") {
+		formatted = strings.TrimSuffix(formatted, "0s")
+	}
+	if strings.HasSuffix(formatted, "h0m") {
+		formatted = strings.TrimSuffix(formatted, "0m")
+	}
+	return formatted
+}
+
 /*
 App can not work if topic can not be created in Kafka.
 I such a case, app should stop working (panic)
@@ -61,15 +90,22 @@ func (topic *Topic) CreateTopic(brokerAddress string) {
 }
 
 func (topic *Topic) TopicExists(topicName string, brokerAddress string) bool {
-	conn, err := kafka.Dial("tcp", brokerAddress)
+	exists, err := topicExists(context.Background(), topicName, brokerAddress)
 	if err != nil {
 		panic(err.Error())
 	}
-	defer conn.Close()
+	return exists
+}
 
-	partitions, err := conn.ReadPartitions()
+// like TopicExists for the topic of the config, returning errors instead of panics, used by the readiness check
+func (topic *Topic) Exists(ctx context.Context, brokerAddress string) (bool, error) {
+	return topicExists(ctx, topic.config.Topic, brokerAddress)
+}
+
+func topicExists(ctx context.Context, topicName string, brokerAddress string) (bool, error) {
+	partitions, err := readPartitions(ctx, brokerAddress)
 	if err != nil {
-		panic(err.Error())
+		return false, err
 	}
 
 	m := map[string]struct{}{}
@@ -79,8 +115,43 @@ func (topic *Topic) TopicExists(topicName string, brokerAddress string) bool {
 	}
 
 	if _, ok := m[topicName]; ok {
-		return true
+		return true, nil
 	}
 
-	return false
+	return false, nil
+}
+
+// checks that the broker accepts connections and answers metadata requests
+func PingBroker(ctx context.Context, brokerAddress string) error {
+	conn, err := dial(ctx, brokerAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Brokers()
+	return err
+}
+
+// partitions of the given topics, of all topics when none is given
+func readPartitions(ctx context.Context, brokerAddress string, topics ...string) ([]kafka.Partition, error) {
+	conn, err := dial(ctx, brokerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.ReadPartitions(topics...)
+}
+
+// connection with the deadline of ctx for all its requests
+func dial(ctx context.Context, brokerAddress string) (*kafka.Conn, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", brokerAddress)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
 }
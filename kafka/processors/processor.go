@@ -1,11 +1,20 @@
 package processors
 
-import "github.com/segmentio/kafka-go"
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+)
 
+/*
+Action delivers a consumed message. ctx carries the span of the delivery attempt and is canceled when the delivery is
+aborted by shutdown. BatchAction delivers many messages at once, like Action, and returns a delivery.BatchError when
+only some of them failed.
+*/
 type Processor struct {
-	Action func(message kafka.Message) error
+	Action      func(ctx context.Context, message kafka.Message) error
+	BatchAction func(ctx context.Context, messages []kafka.Message) error // optional, consumers deliver one message at a time when nil
 }
 
-func (Processor) New(action func(message kafka.Message) error) *Processor {
+func (Processor) New(action func(ctx context.Context, message kafka.Message) error) *Processor {
 	return &Processor{Action: action}
 }
\ No newline at end of file
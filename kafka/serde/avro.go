@@ -0,0 +1,135 @@
+package serde
+
+import (
+	"event-delivery-kafka/models"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"sync"
+	"time"
+)
+
+const eventAvroSchema = `{
+  "type": "record",
+  "name": "Event",
+  "namespace": "eventdelivery",
+  "fields": [
+    {"name": "user_id", "type": "string"},
+    {"name": "payload", "type": "string"},
+    {"name": "event_id", "type": "string", "default": ""},
+    {"name": "event_type", "type": "string", "default": ""},
+    {"name": "schema_version", "type": "string", "default": ""},
+    {"name": "source", "type": "string", "default": ""},
+    {"name": "client_timestamp", "type": ["null", {"type": "long", "logicalType": "timestamp-micros"}], "default": null}
+  ]
+}`
+
+/*
+Avro binary encoding of the event. Values are decoded with the schema they were written with (the writer schema of
+the registry), so values of older versions of the schema are read too, with empty fields for the missing ones.
+*/
+type AvroSerializer struct {
+	registry Registry
+	codec    *goavro.Codec
+	mu       *sync.Mutex
+	codecs   map[int]*goavro.Codec // schema id -> codec of the writer schema
+}
+
+func (AvroSerializer) New(registry Registry) *AvroSerializer {
+	codec, err := goavro.NewCodec(eventAvroSchema)
+	if err != nil {
+		panic(err)
+	}
+	return &AvroSerializer{
+		registry: registry,
+		codec:    codec,
+		mu:       &sync.Mutex{},
+		codecs:   map[int]*goavro.Codec{},
+	}
+}
+
+func (serializer *AvroSerializer) Format() string {
+	return FormatAvro
+}
+
+func (serializer *AvroSerializer) Serialize(topic string, event models.Event) ([]byte, error) {
+	schemaID, err := serializer.registry.Register(subject(topic), Schema{Type: SchemaTypeAvro, Schema: eventAvroSchema})
+	if err != nil {
+		return nil, err
+	}
+
+	var clientTimestamp interface{}
+	if !event.ClientTimestamp.IsZero() {
+		clientTimestamp = goavro.Union("long.timestamp-micros", event.ClientTimestamp)
+	}
+	record, err := serializer.codec.BinaryFromNative(nil, map[string]interface{}{
+		"user_id":          event.UserID,
+		"payload":          event.Payload,
+		"event_id":         event.EventID,
+		"event_type":       event.EventType,
+		"schema_version":   event.SchemaVersion,
+		"source":           event.Source,
+		"client_timestamp": clientTimestamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeWire(schemaID, record), nil
+}
+
+func (serializer *AvroSerializer) Deserialize(value []byte) (*models.Event, error) {
+	schemaID, record, err := decodeWire(value)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := serializer.writerCodec(schemaID)
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := codec.NativeFromBinary(record)
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro record: %w", err)
+	}
+	fields, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("avro record of schema id %d is not a record", schemaID)
+	}
+
+	str := func(name string) string {
+		value, _ := fields[name].(string)
+		return value
+	}
+	event := &models.Event{
+		UserID:        str("user_id"),
+		Payload:       str("payload"),
+		EventID:       str("event_id"),
+		EventType:     str("event_type"),
+		SchemaVersion: str("schema_version"),
+		Source:        str("source"),
+	}
+	if union, ok := fields["client_timestamp"].(map[string]interface{}); ok {
+		if clientTimestamp, ok := union["long.timestamp-micros"].(time.Time); ok {
+			event.ClientTimestamp = clientTimestamp
+		}
+	}
+	return event, nil
+}
+
+func (serializer *AvroSerializer) writerCodec(schemaID int) (*goavro.Codec, error) {
+	serializer.mu.Lock()
+	defer serializer.mu.Unlock()
+	if codec, ok := serializer.codecs[schemaID]; ok {
+		return codec, nil
+	}
+
+	schema, err := writerSchema(serializer.registry, schemaID, SchemaTypeAvro)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := goavro.NewCodec(schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro schema id %d: %w", schemaID, err)
+	}
+	serializer.codecs[schemaID] = codec
+	return codec, nil
+}
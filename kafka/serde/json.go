@@ -0,0 +1,66 @@
+package serde
+
+import (
+	"encoding/json"
+	"event-delivery-kafka/models"
+	"fmt"
+)
+
+const eventJSONSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Event",
+  "type": "object",
+  "required": ["user_id", "payload"],
+  "properties": {
+    "user_id": {"type": "string"},
+    "payload": {"type": "string"},
+    "event_id": {"type": "string"},
+    "event_type": {"type": "string"},
+    "schema_version": {"type": "string"},
+    "source": {"type": "string"},
+    "client_timestamp": {"type": "string", "format": "date-time"}
+  }
+}`
+
+/*
+Json of the event, the same as the body of PUT /events, described by a JSON Schema.
+*/
+type JSONSerializer struct {
+	registry Registry
+}
+
+func (JSONSerializer) New(registry Registry) *JSONSerializer {
+	return &JSONSerializer{registry: registry}
+}
+
+func (serializer *JSONSerializer) Format() string {
+	return FormatJSON
+}
+
+func (serializer *JSONSerializer) Serialize(topic string, event models.Event) ([]byte, error) {
+	schemaID, err := serializer.registry.Register(subject(topic), Schema{Type: SchemaTypeJSON, Schema: eventJSONSchema})
+	if err != nil {
+		return nil, err
+	}
+	record, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return encodeWire(schemaID, record), nil
+}
+
+func (serializer *JSONSerializer) Deserialize(value []byte) (*models.Event, error) {
+	schemaID, record, err := decodeWire(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writerSchema(serializer.registry, schemaID, SchemaTypeJSON); err != nil {
+		return nil, err
+	}
+
+	var event models.Event
+	if err := json.Unmarshal(record, &event); err != nil {
+		return nil, fmt.Errorf("invalid json record: %w", err)
+	}
+	return &event, nil
+}
@@ -0,0 +1,118 @@
+package serde
+
+import (
+	"encoding/binary"
+	"event-delivery-kafka/kafka/serde/eventpb"
+	"event-delivery-kafka/models"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// kafka/serde/eventpb/event.proto, the schema registered for the values
+const eventProtoSchema = `syntax = "proto3";
+
+package eventdelivery.serde.v1;
+
+import "google/protobuf/timestamp.proto";
+
+option go_package = "event-delivery-kafka/kafka/serde/eventpb";
+
+// Value of the Kafka messages of events, with value format protobuf.
+message Event {
+  string user_id = 1;
+  string payload = 2;
+  string event_id = 3;
+  string event_type = 4;
+  string schema_version = 5;
+  string source = 6;
+  google.protobuf.Timestamp client_timestamp = 7;
+}
+`
+
+/*
+Protobuf encoding of the event with message eventpb.Event. Like the Confluent serializer, the message indexes of the
+message type in the schema are written after the schema id, [0] (the first message) as the single byte 0.
+*/
+type ProtobufSerializer struct {
+	registry Registry
+}
+
+func (ProtobufSerializer) New(registry Registry) *ProtobufSerializer {
+	return &ProtobufSerializer{registry: registry}
+}
+
+func (serializer *ProtobufSerializer) Format() string {
+	return FormatProtobuf
+}
+
+func (serializer *ProtobufSerializer) Serialize(topic string, event models.Event) ([]byte, error) {
+	schemaID, err := serializer.registry.Register(subject(topic), Schema{Type: SchemaTypeProtobuf, Schema: eventProtoSchema})
+	if err != nil {
+		return nil, err
+	}
+
+	message := &eventpb.Event{
+		UserId:        event.UserID,
+		Payload:       event.Payload,
+		EventId:       event.EventID,
+		EventType:     event.EventType,
+		SchemaVersion: event.SchemaVersion,
+		Source:        event.Source,
+	}
+	if !event.ClientTimestamp.IsZero() {
+		message.ClientTimestamp = timestamppb.New(event.ClientTimestamp)
+	}
+	record, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return encodeWire(schemaID, append([]byte{0}, record...)), nil
+}
+
+func (serializer *ProtobufSerializer) Deserialize(value []byte) (*models.Event, error) {
+	schemaID, record, err := decodeWire(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writerSchema(serializer.registry, schemaID, SchemaTypeProtobuf); err != nil {
+		return nil, err
+	}
+	record, err = skipMessageIndexes(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var message eventpb.Event
+	if err := proto.Unmarshal(record, &message); err != nil {
+		return nil, fmt.Errorf("invalid protobuf record: %w", err)
+	}
+	event := &models.Event{
+		UserID:        message.GetUserId(),
+		Payload:       message.GetPayload(),
+		EventID:       message.GetEventId(),
+		EventType:     message.GetEventType(),
+		SchemaVersion: message.GetSchemaVersion(),
+		Source:        message.GetSource(),
+	}
+	if message.GetClientTimestamp() != nil {
+		event.ClientTimestamp = message.GetClientTimestamp().AsTime()
+	}
+	return event, nil
+}
+
+// message indexes are a zigzag varint count followed by the zigzag varint indexes, count 0 means [0]
+func skipMessageIndexes(record []byte) ([]byte, error) {
+	count, n := binary.Varint(record)
+	if n <= 0 || count < 0 {
+		return nil, ErrInvalidWireFormat
+	}
+	record = record[n:]
+	for i := int64(0); i < count; i++ {
+		if _, n = binary.Varint(record); n <= 0 {
+			return nil, ErrInvalidWireFormat
+		}
+		record = record[n:]
+	}
+	return record, nil
+}
@@ -0,0 +1,198 @@
+package serde
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schema types of the Confluent schema registry
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+	SchemaTypeJSON     = "JSON"
+)
+
+var ErrSchemaNotFound = errors.New("schema not found")
+
+type Schema struct {
+	Type   string
+	Schema string
+}
+
+/*
+Registry of the schemas of the Kafka message values. Every schema has a global id, which is written in front of
+every value, so consumers can decode values written with any version of the schema.
+*/
+type Registry interface {
+	// registers the schema under the subject and returns its id, the same id when the schema is already registered
+	Register(subject string, schema Schema) (int, error)
+	Schema(id int) (Schema, error)
+}
+
+/*
+In-process registry for tests and local runs, where the producer and the consumers run in the same process.
+Schemas are lost on restart, so messages written by previous runs can not be decoded.
+*/
+type MemoryRegistry struct {
+	mu      *sync.Mutex
+	schemas []Schema // schema with id i+1, like the Confluent registry the same schema has one id in every subject
+}
+
+func (MemoryRegistry) New() *MemoryRegistry {
+	return &MemoryRegistry{mu: &sync.Mutex{}}
+}
+
+func (registry *MemoryRegistry) Register(subject string, schema Schema) (int, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for i, registered := range registry.schemas {
+		if registered == schema {
+			return i + 1, nil
+		}
+	}
+	registry.schemas = append(registry.schemas, schema)
+	return len(registry.schemas), nil
+}
+
+func (registry *MemoryRegistry) Schema(id int) (Schema, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if id < 1 || id > len(registry.schemas) {
+		return Schema{}, fmt.Errorf("schema id %d: %w", id, ErrSchemaNotFound)
+	}
+	return registry.schemas[id-1], nil
+}
+
+/*
+Client of the REST API of a Confluent compatible schema registry. Schemas are immutable, so ids and schemas are cached
+and the registry is called once per schema.
+*/
+type RegistryClient struct {
+	baseURL    string
+	httpClient *http.Client
+	mu         *sync.Mutex
+	ids        map[string]map[Schema]int
+	schemas    map[int]Schema
+}
+
+func (RegistryClient) New(baseURL string, timeout time.Duration) *RegistryClient {
+	return &RegistryClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+		mu:         &sync.Mutex{},
+		ids:        map[string]map[Schema]int{},
+		schemas:    map[int]Schema{},
+	}
+}
+
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"` // empty for AVRO
+	ID         int    `json:"id,omitempty"`
+}
+
+type registryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func (client *RegistryClient) Register(subject string, schema Schema) (int, error) {
+	client.mu.Lock()
+	id, ok := client.ids[subject][schema]
+	client.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	request := registrySchema{Schema: schema.Schema}
+	if schema.Type != SchemaTypeAvro {
+		request.SchemaType = schema.Type
+	}
+	var response registrySchema
+	if err := client.call("POST", "/subjects/"+url.PathEscape(subject)+"/versions", request, &response); err != nil {
+		return 0, fmt.Errorf("failed to register schema of subject %s: %w", subject, err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.ids[subject] == nil {
+		client.ids[subject] = map[Schema]int{}
+	}
+	client.ids[subject][schema] = response.ID
+	client.schemas[response.ID] = schema
+	return response.ID, nil
+}
+
+func (client *RegistryClient) Schema(id int) (Schema, error) {
+	client.mu.Lock()
+	schema, ok := client.schemas[id]
+	client.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	var response registrySchema
+	if err := client.call("GET", fmt.Sprintf("/schemas/ids/%d", id), nil, &response); err != nil {
+		return Schema{}, fmt.Errorf("failed to get schema id %d: %w", id, err)
+	}
+	schema = Schema{Type: response.SchemaType, Schema: response.Schema}
+	if schema.Type == "" {
+		schema.Type = SchemaTypeAvro
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.schemas[id] = schema
+	return schema, nil
+}
+
+func (client *RegistryClient) call(method string, path string, body interface{}, result interface{}) error {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		if bodyBytes, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, client.baseURL+path, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var registryErr registryError
+		if json.Unmarshal(responseBytes, &registryErr) == nil && registryErr.Message != "" {
+			if response.StatusCode == http.StatusNotFound {
+				return fmt.Errorf("%s: %w", registryErr.Message, ErrSchemaNotFound)
+			}
+			return fmt.Errorf("schema registry returned %d (error code %d): %s", response.StatusCode, registryErr.ErrorCode, registryErr.Message)
+		}
+		return fmt.Errorf("schema registry returned %d", response.StatusCode)
+	}
+	return json.Unmarshal(responseBytes, result)
+}
@@ -0,0 +1,93 @@
+package serde
+
+import (
+	"encoding/binary"
+	"errors"
+	"event-delivery-kafka/models"
+	"fmt"
+)
+
+// formats of the values of the Kafka messages
+const (
+	FormatRaw      = "raw" // the payload of the event as it is, the envelope is only in the headers
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+/*
+Encodes the value of the Kafka message of an event as a record with the event and its envelope, so consumers of the
+topic have a contract. Values use the wire format of the Confluent serializers: magic byte 0, the id of the schema in
+the registry (4 bytes, big endian) and the encoded record.
+*/
+type Serializer interface {
+	Format() string
+	// registers the schema of the record under subject "<topic>-value" (topic name strategy) and encodes the event
+	Serialize(topic string, event models.Event) ([]byte, error)
+	// decodes the value with the schema of the id of the value
+	Deserialize(value []byte) (*models.Event, error)
+}
+
+/*
+Serializer of the format, nil for the raw format.
+*/
+func ForFormat(format string, registry Registry) (Serializer, error) {
+	switch format {
+	case "", FormatRaw:
+		return nil, nil
+	case FormatJSON:
+		return JSONSerializer{}.New(registry), nil
+	case FormatAvro:
+		return AvroSerializer{}.New(registry), nil
+	case FormatProtobuf:
+		return ProtobufSerializer{}.New(registry), nil
+	default:
+		return nil, fmt.Errorf("unknown value format %s", format)
+	}
+}
+
+/*
+Serializers of every format, sharing the registry. Consumers decode every value with the serializer of its format,
+so messages written before the value format of the producer changed can still be read.
+*/
+func Serializers(registry Registry) map[string]Serializer {
+	return map[string]Serializer{
+		FormatJSON:     JSONSerializer{}.New(registry),
+		FormatAvro:     AvroSerializer{}.New(registry),
+		FormatProtobuf: ProtobufSerializer{}.New(registry),
+	}
+}
+
+const magicByte byte = 0
+
+var ErrInvalidWireFormat = errors.New("value is not in the wire format of the schema registry")
+
+func subject(topic string) string {
+	return topic + "-value"
+}
+
+func encodeWire(schemaID int, record []byte) []byte {
+	value := make([]byte, 5, 5+len(record))
+	value[0] = magicByte
+	binary.BigEndian.PutUint32(value[1:5], uint32(schemaID))
+	return append(value, record...)
+}
+
+func decodeWire(value []byte) (int, []byte, error) {
+	if len(value) < 5 || value[0] != magicByte {
+		return 0, nil, ErrInvalidWireFormat
+	}
+	return int(binary.BigEndian.Uint32(value[1:5])), value[5:], nil
+}
+
+// schema of the value, checking that it was written with the expected schema type
+func writerSchema(registry Registry, schemaID int, schemaType string) (Schema, error) {
+	schema, err := registry.Schema(schemaID)
+	if err != nil {
+		return Schema{}, err
+	}
+	if schema.Type != schemaType {
+		return Schema{}, fmt.Errorf("schema id %d is %s, not %s", schemaID, schema.Type, schemaType)
+	}
+	return schema, nil
+}
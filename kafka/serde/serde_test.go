@@ -0,0 +1,159 @@
+package serde
+
+import (
+	"encoding/json"
+	"errors"
+	"event-delivery-kafka/models"
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSerializeAndDeserializeEvent(t *testing.T) {
+	registry := MemoryRegistry{}.New()
+	event := models.Event{
+		UserID:          "user_test_1",
+		Payload:         "event click !!!!",
+		EventID:         "event_1",
+		EventType:       "click",
+		SchemaVersion:   "2",
+		Source:          "web",
+		ClientTimestamp: time.Date(2022, 7, 1, 10, 0, 0, 500000000, time.UTC),
+	}
+
+	for _, format := range []string{FormatJSON, FormatAvro, FormatProtobuf} {
+		serializer, err := ForFormat(format, registry)
+		assert.Nil(t, err)
+		assert.Equal(t, format, serializer.Format())
+
+		value, err := serializer.Serialize("event-log", event)
+		assert.Nil(t, err, format)
+		assert.Equal(t, magicByte, value[0], format)
+
+		decoded, err := Serializers(registry)[format].Deserialize(value)
+		assert.Nil(t, err, format)
+		assert.Equal(t, event.UserID, decoded.UserID, format)
+		assert.Equal(t, event.Payload, decoded.Payload, format)
+		assert.Equal(t, event.EventID, decoded.EventID, format)
+		assert.Equal(t, event.EventType, decoded.EventType, format)
+		assert.Equal(t, event.SchemaVersion, decoded.SchemaVersion, format)
+		assert.Equal(t, event.Source, decoded.Source, format)
+		assert.Equal(t, event.ClientTimestamp, decoded.ClientTimestamp.UTC(), format)
+	}
+
+	// one schema per format, registered once
+	_, err := registry.Schema(3)
+	assert.Nil(t, err)
+	_, err = registry.Schema(4)
+	assert.True(t, errors.Is(err, ErrSchemaNotFound))
+}
+
+func TestSerializeEventWithoutEnvelope(t *testing.T) {
+	registry := MemoryRegistry{}.New()
+	for _, serializer := range Serializers(registry) {
+		value, err := serializer.Serialize("event-log", models.Event{UserID: "user_test_1", Payload: "event click !!!!"})
+		assert.Nil(t, err)
+
+		decoded, err := serializer.Deserialize(value)
+		assert.Nil(t, err)
+		assert.Equal(t, models.Event{UserID: "user_test_1", Payload: "event click !!!!"}, *decoded)
+	}
+
+	// the json record has only the fields that were sent, without a zero client_timestamp
+	value, err := JSONSerializer{}.New(registry).Serialize("event-log", models.Event{UserID: "user_test_1", Payload: "event click !!!!"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user_id":"user_test_1","payload":"event click !!!!"}`, string(value[5:]))
+}
+
+func TestRawFormatHasNoSerializer(t *testing.T) {
+	serializer, err := ForFormat(FormatRaw, MemoryRegistry{}.New())
+	assert.Nil(t, err)
+	assert.Nil(t, serializer)
+
+	_, err = ForFormat("xml", MemoryRegistry{}.New())
+	assert.NotNil(t, err)
+}
+
+func TestProtobufValueHasMessageIndexes(t *testing.T) {
+	serializer := ProtobufSerializer{}.New(MemoryRegistry{}.New())
+	value, err := serializer.Serialize("event-log", models.Event{UserID: "user_test_1", Payload: "click"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 1, 0}, value[:6])
+
+	// schema registered is the proto file of the generated code
+	proto, err := ioutil.ReadFile("eventpb/event.proto")
+	assert.Nil(t, err)
+	assert.Equal(t, string(proto), eventProtoSchema)
+}
+
+func TestDeserializeInvalidValues(t *testing.T) {
+	registry := MemoryRegistry{}.New()
+	avro := AvroSerializer{}.New(registry)
+	jsonValue, err := JSONSerializer{}.New(registry).Serialize("event-log", models.Event{UserID: "user_test_1", Payload: "click"})
+	assert.Nil(t, err)
+
+	_, err = avro.Deserialize([]byte("event click !!!!"))
+	assert.True(t, errors.Is(err, ErrInvalidWireFormat))
+	_, err = avro.Deserialize(encodeWire(42, nil))
+	assert.True(t, errors.Is(err, ErrSchemaNotFound))
+	_, err = avro.Deserialize(jsonValue)
+	assert.EqualError(t, err, "schema id 1 is JSON, not AVRO")
+}
+
+func TestDeserializeAvroWithOlderWriterSchema(t *testing.T) {
+	registry := MemoryRegistry{}.New()
+	writerSchema := `{"type": "record", "name": "Event", "namespace": "eventdelivery", "fields": [{"name": "user_id", "type": "string"}, {"name": "payload", "type": "string"}]}`
+	schemaID, err := registry.Register("event-log-value", Schema{Type: SchemaTypeAvro, Schema: writerSchema})
+	assert.Nil(t, err)
+	codec, err := goavro.NewCodec(writerSchema)
+	assert.Nil(t, err)
+	record, err := codec.BinaryFromNative(nil, map[string]interface{}{"user_id": "user_test_1", "payload": "click"})
+	assert.Nil(t, err)
+
+	event, err := AvroSerializer{}.New(registry).Deserialize(encodeWire(schemaID, record))
+	assert.Nil(t, err)
+	assert.Equal(t, models.Event{UserID: "user_test_1", Payload: "click"}, *event)
+}
+
+func TestRegistryClient(t *testing.T) {
+	calls := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		writer.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+		switch {
+		case request.Method == "POST" && request.URL.Path == "/subjects/event-log-value/versions":
+			var body map[string]string
+			json.NewDecoder(request.Body).Decode(&body)
+			assert.Equal(t, "PROTOBUF", body["schemaType"])
+			writer.Write([]byte(`{"id": 7}`))
+		case request.Method == "GET" && request.URL.Path == "/schemas/ids/8":
+			writer.Write([]byte(`{"schema": "{\"type\": \"string\"}"}`))
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+			writer.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+		}
+	}))
+	defer registry.Close()
+	client := RegistryClient{}.New(registry.URL, 1*time.Second)
+
+	for i := 0; i < 2; i++ {
+		id, err := client.Register("event-log-value", Schema{Type: SchemaTypeProtobuf, Schema: eventProtoSchema})
+		assert.Nil(t, err)
+		assert.Equal(t, 7, id)
+		schema, err := client.Schema(7)
+		assert.Nil(t, err)
+		assert.Equal(t, SchemaTypeProtobuf, schema.Type)
+	}
+	assert.Equal(t, 1, calls)
+
+	schema, err := client.Schema(8)
+	assert.Nil(t, err)
+	assert.Equal(t, Schema{Type: SchemaTypeAvro, Schema: `{"type": "string"}`}, schema)
+
+	_, err = client.Schema(9)
+	assert.True(t, errors.Is(err, ErrSchemaNotFound))
+}
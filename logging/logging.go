@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+type Config struct {
+	Level      string    // debug, info (default), warn or error
+	KafkaLevel string    // level of the internal logs of the Kafka readers and writers, warn when empty
+	Format     string    // json (default) or console
+	Output     io.Writer // os.Stdout when nil
+}
+
+/*
+Builds the logger of the app and the logger of the Kafka client. Both write to the same output with the same format,
+but the Kafka client has a level of its own, because the readers log every fetch and commit at info.
+*/
+func New(config Config) (logger *zap.Logger, kafkaLogger *zap.Logger, err error) {
+	level, err := parseLevel(config.Level, zapcore.InfoLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	kafkaLevel, err := parseLevel(config.KafkaLevel, zapcore.WarnLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "time"
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch config.Format {
+	case "", FormatJSON:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case FormatConsole:
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %s", config.Format)
+	}
+
+	output := config.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	sink := zapcore.Lock(zapcore.AddSync(output))
+
+	logger = zap.New(zapcore.NewCore(encoder, sink, level), zap.ErrorOutput(sink))
+	kafkaLogger = zap.New(zapcore.NewCore(encoder, sink, kafkaLevel), zap.ErrorOutput(sink)).Named("kafka")
+	return logger, kafkaLogger, nil
+}
+
+func parseLevel(value string, defaultLevel zapcore.Level) (zapcore.Level, error) {
+	if value == "" {
+		return defaultLevel, nil
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(strings.ToLower(value))); err != nil {
+		return defaultLevel, fmt.Errorf("unknown log level %s", value)
+	}
+	return level, nil
+}
+
+// the logger, or a logger that discards everything when it is nil, so loggers are optional for the components
+func OrNop(logger *zap.Logger) *zap.Logger {
+	if logger == nil {
+		return zap.NewNop()
+	}
+	return logger
+}
+
+/*
+Adapters of a logger to the loggers of kafka-go. Messages of kafka.ReaderConfig.Logger and kafka.Writer.Logger are
+logged at info, messages of the ErrorLogger at error. Nil loggers stay nil, so kafka-go does not log at all.
+*/
+func KafkaLogger(logger *zap.Logger) kafka.Logger {
+	if logger == nil {
+		return nil
+	}
+	sugar := logger.Sugar()
+	return kafka.LoggerFunc(sugar.Infof)
+}
+
+func KafkaErrorLogger(logger *zap.Logger) kafka.Logger {
+	if logger == nil {
+		return nil
+	}
+	sugar := logger.Sugar()
+	return kafka.LoggerFunc(sugar.Errorf)
+}
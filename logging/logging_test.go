@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func TestLoggersWriteJSONWithTheirOwnLevels(t *testing.T) {
+	var output bytes.Buffer
+	logger, kafkaLogger, err := New(Config{Level: "info", KafkaLevel: "warn", Output: &output})
+	assert.Nil(t, err)
+
+	logger.Debug("fetched message")
+	logger.Error("delivery failed, retries exhausted", zap.String("destination", "postgres"), zap.Error(errors.New("postgres is unavailable")))
+	KafkaLogger(kafkaLogger).Printf("committed offsets for group %s", "event-delivery-kafka-postgres")
+	KafkaErrorLogger(kafkaLogger).Printf("failed to fetch message: %v", "leader not available")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, "delivery failed, retries exhausted", entry["msg"])
+	assert.Equal(t, "postgres", entry["destination"])
+	assert.Equal(t, "postgres is unavailable", entry["error"])
+	assert.NotNil(t, entry["time"])
+
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "kafka", entry["logger"])
+	assert.Equal(t, "failed to fetch message: leader not available", entry["msg"])
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, _, err := New(Config{Level: "verbose"})
+	assert.EqualError(t, err, "unknown log level verbose")
+	_, _, err = New(Config{KafkaLevel: "WARN", Format: "logfmt"})
+	assert.EqualError(t, err, "unknown log format logfmt")
+	assert.Nil(t, KafkaLogger(nil))
+	assert.NotNil(t, OrNop(nil))
+}
@@ -2,10 +2,19 @@ package main
 
 import (
 	"event-delivery-kafka/api"
+	"event-delivery-kafka/api/ratelimit"
+	"event-delivery-kafka/delivery/circuitbreaker"
 	"event-delivery-kafka/delivery/destinations/mocks"
+	"event-delivery-kafka/kafka/backoff"
+	"event-delivery-kafka/kafka/components"
+	"event-delivery-kafka/logging"
+	"event-delivery-kafka/tracing"
 	"github.com/joho/godotenv"
+	"go.uber.org/zap"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,20 +25,226 @@ func main() {
 		log.Fatalf("Error loading .env file")
 	}
 
+	logger, kafkaLogger, err := logging.New(logging.Config{
+		Level:      os.Getenv("LOG_LEVEL"),
+		KafkaLevel: os.Getenv("KAFKA_LOG_LEVEL"),
+		Format:     os.Getenv("LOG_FORMAT"),
+	})
+	if err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	defer logger.Sync()
+
 	destinations := []mocks.Destination{
-		mocks.BigqueryMock{}.New(),
+		mocks.BigqueryMock{}.New(logger),
 		mocks.PostgresMock{}.New(),
 		mocks.SnowflakeMock{}.New(),
 		mocks.AzureDataLakeMock{}.New(),
-		mocks.RedshiftMock{}.New(),
+		mocks.RedshiftMock{}.New(logger),
 	}
 
 	app := api.App{
 		Port:               os.Getenv("PORT"),
+		GRPCPort:           os.Getenv("GRPC_PORT"),
 		Topic:              os.Getenv("TOPIC"),
 		BrokerAddress:      os.Getenv("BROKER_ADDRESS"),
 		DestinationTimeout: 1 * time.Second,
 		Destinations:       destinations,
+		IdempotencyStore:   os.Getenv("IDEMPOTENCY_STORE"),
+		IdempotencyFile:    os.Getenv("IDEMPOTENCY_FILE"),
+		IdempotencyTTL:     durationFromEnv("IDEMPOTENCY_TTL", 24*time.Hour),
+		SchemaDir:          os.Getenv("SCHEMA_DIR"),
+		APIKeys:            mapFromEnv("API_KEYS"),
+		HMACSecrets:        mapFromEnv("HMAC_SECRETS"),
+		HMACMaxSkew:        durationFromEnv("HMAC_MAX_SKEW", 5*time.Minute),
+		UserRateLimit: ratelimit.Config{
+			Rate:  floatFromEnv("RATE_LIMIT_USER_RPS", 0),
+			Burst: intFromEnv("RATE_LIMIT_USER_BURST", 0),
+		},
+		CredentialRateLimit: ratelimit.Config{
+			Rate:  floatFromEnv("RATE_LIMIT_CREDENTIAL_RPS", 0),
+			Burst: intFromEnv("RATE_LIMIT_CREDENTIAL_BURST", 0),
+		},
+		MaxEventBytes:     int64(intFromEnv("MAX_EVENT_BYTES", 1<<20)),
+		MaxBodyBytes:      int64(intFromEnv("MAX_BODY_BYTES", 10<<20)),
+		AsyncQueueSize:    intFromEnv("ASYNC_QUEUE_SIZE", 10000),
+		AsyncWorkers:      intFromEnv("ASYNC_WORKERS", 4),
+		TrackingTTL:       durationFromEnv("TRACKING_TTL", 1*time.Hour),
+		ValueFormat:       os.Getenv("VALUE_FORMAT"),
+		SchemaRegistryURL: os.Getenv("SCHEMA_REGISTRY_URL"),
+		ShutdownTimeout:   durationFromEnv("SHUTDOWN_TIMEOUT", 30*time.Second),
+		ReadinessTimeout:  durationFromEnv("READINESS_TIMEOUT", 2*time.Second),
+		Tracing: tracing.Config{
+			Exporter:     os.Getenv("TRACING_EXPORTER"),
+			OTLPEndpoint: os.Getenv("OTLP_ENDPOINT"),
+			OTLPInsecure: boolFromEnv("OTLP_INSECURE", false),
+			SampleRatio:  floatFromEnv("TRACING_SAMPLE_RATIO", 1),
+		},
+		Logger:           logger,
+		KafkaLogger:      kafkaLogger,
+		RetryTopicDelays: durationsFromEnv("RETRY_TOPIC_DELAYS"),
+		RetryPolicy:      policyFromEnv("RETRY_POLICY"),
+		RetryPolicies:    policiesFromEnv("RETRY_POLICIES"),
+		CircuitBreaker: circuitbreaker.Config{
+			FailureThreshold: intFromEnv("CIRCUIT_FAILURE_THRESHOLD", 0),
+			OpenTimeout:      durationFromEnv("CIRCUIT_OPEN_TIMEOUT", 30*time.Second),
+			SuccessThreshold: intFromEnv("CIRCUIT_SUCCESS_THRESHOLD", 1),
+		},
+		Batch: components.BatchConfig{
+			MaxSize:   intFromEnv("BATCH_MAX_SIZE", 1),
+			MaxLinger: durationFromEnv("BATCH_MAX_LINGER", 100*time.Millisecond),
+		},
+		Batches: batchesFromEnv("BATCHES"),
+	}
+	if err := app.Run(); err != nil {
+		logger.Fatal("app stopped", zap.Error(err))
+	}
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration %s for %s", value, name)
+	}
+	return duration
+}
+
+func intFromEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid integer %s for %s", value, name)
+	}
+	return number
+}
+
+func floatFromEnv(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid number %s for %s", value, name)
+	}
+	return number
+}
+
+func boolFromEnv(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid boolean %s for %s", value, name)
+	}
+	return flag
+}
+
+// parses values like "name1:value1,name2:value2"
+func mapFromEnv(name string) map[string]string {
+	result := map[string]string{}
+	value := os.Getenv(name)
+	if value == "" {
+		return result
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid value for %s, expected name:value pairs separated by comma", name)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result
+}
+
+// comma separated durations, like 1m,10m,1h
+func durationsFromEnv(name string) []time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	var durations []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		duration, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil || duration <= 0 {
+			log.Fatalf("Invalid duration %s for %s", item, name)
+		}
+		durations = append(durations, duration)
+	}
+	return durations
+}
+
+// a retry policy like "constant interval=500ms retries=5", see backoff.ParsePolicy
+func policyFromEnv(name string) backoff.PolicyConfig {
+	config, err := backoff.ParsePolicy(os.Getenv(name))
+	if err != nil {
+		log.Fatalf("Invalid retry policy for %s: %v", name, err)
+	}
+	return config
+}
+
+// retry policies of destinations separated by semicolon, like "postgres=constant interval=500ms;snowflake=none"
+func policiesFromEnv(name string) map[string]backoff.PolicyConfig {
+	result := map[string]backoff.PolicyConfig{}
+	value := os.Getenv(name)
+	if value == "" {
+		return result
+	}
+
+	for _, pair := range strings.Split(value, ";") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid value for %s, expected destination=policy pairs separated by semicolon", name)
+		}
+		config, err := backoff.ParsePolicy(parts[1])
+		if err != nil {
+			log.Fatalf("Invalid retry policy of %s for %s: %v", parts[0], name, err)
+		}
+		result[parts[0]] = config
+	}
+	return result
+}
+
+// batches of destinations separated by semicolon, max size and max linger like "bigquery=500/2s;redshift=1000/5s"
+func batchesFromEnv(name string) map[string]components.BatchConfig {
+	result := map[string]components.BatchConfig{}
+	value := os.Getenv(name)
+	if value == "" {
+		return result
+	}
+
+	for _, pair := range strings.Split(value, ";") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Invalid value for %s, expected destination=size/linger pairs separated by semicolon", name)
+		}
+		limits := strings.SplitN(parts[1], "/", 2)
+		size, err := strconv.Atoi(limits[0])
+		if err != nil || size <= 0 {
+			log.Fatalf("Invalid batch size of %s for %s", parts[0], name)
+		}
+		config := components.BatchConfig{MaxSize: size}
+		if len(limits) == 2 {
+			config.MaxLinger, err = time.ParseDuration(limits[1])
+			if err != nil || config.MaxLinger <= 0 {
+				log.Fatalf("Invalid batch linger of %s for %s", parts[0], name)
+			}
+		}
+		result[parts[0]] = config
 	}
-	app.Run()
+	return result
 }
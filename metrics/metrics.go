@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "event_delivery"
+
+// outcomes of a single call of a destination
+const (
+	AttemptSuccess = "success"
+	AttemptError   = "error"
+	AttemptTimeout = "timeout"
+)
+
+// outcomes of the delivery of a message, after its retries
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"  // retries exhausted, the offset is committed and the message is skipped
+	DeliveryAborted   = "aborted" // retries aborted by shutdown, the message is delivered again after restart
+	DeliveryRetried   = "retried" // written to the next retry topic, delivered again after its delay
+)
+
+/*
+Prometheus collectors of the ingestion (REST and gRPC API, producer) and of the delivery (consumers, destinations).
+Collectors are registered in a registry of their own, with the Go and process collectors, so tests can create as
+many Metrics as they need. Every method can be called on a nil *Metrics, so metrics are optional for the components.
+*/
+type Metrics struct {
+	Registry            *prometheus.Registry
+	ingestRequests      *prometheus.CounterVec
+	produceDuration     *prometheus.HistogramVec
+	producedMessages    *prometheus.CounterVec
+	deliveryAttempts    *prometheus.CounterVec
+	attemptDuration     *prometheus.HistogramVec
+	deliveries          *prometheus.CounterVec
+	retries             *prometheus.CounterVec
+	destinationTimeouts *prometheus.CounterVec
+	commitFailures      *prometheus.CounterVec
+	deadLetters         *prometheus.CounterVec
+	deliveryErrors      *prometheus.CounterVec
+	endToEndLatency     *prometheus.HistogramVec
+	batchSize           *prometheus.HistogramVec
+}
+
+func (Metrics) New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		ingestRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ingest_requests_total",
+			Help:      "Requests of the REST and gRPC API by protocol, route and status code.",
+		}, []string{"protocol", "route", "status"}),
+		produceDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "produce_duration_seconds",
+			Help:      "Duration of the writes of messages to Kafka by result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"result"}),
+		producedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "produced_messages_total",
+			Help:      "Messages written to Kafka by result.",
+		}, []string{"result"}),
+		deliveryAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_attempts_total",
+			Help:      "Calls of the destinations by destination and outcome (success, error or timeout).",
+		}, []string{"destination", "outcome"}),
+		attemptDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "delivery_attempt_duration_seconds",
+			Help:      "Duration of the calls of the destinations, up to the destination timeout.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"destination"}),
+		deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deliveries_total",
+			Help:      "Messages by destination and outcome of their delivery after retries (delivered, failed or aborted).",
+		}, []string{"destination", "outcome"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_retries_total",
+			Help:      "Retries of the exponential backoff by destination.",
+		}, []string{"destination"}),
+		destinationTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "destination_timeouts_total",
+			Help:      "Calls of the destinations that did not return within the destination timeout.",
+		}, []string{"destination"}),
+		commitFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commit_failures_total",
+			Help:      "Offsets of the consumer of a destination that could not be committed.",
+		}, []string{"destination"}),
+		deadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dead_letters_total",
+			Help:      "Messages written to the dead-letter topic of a destination after their retries were exhausted.",
+		}, []string{"destination"}),
+		deliveryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_errors_total",
+			Help:      "Failed attempts of the destinations by destination and class of the error (retryable, permanent, rate_limited or throttled).",
+		}, []string{"destination", "class"}),
+		endToEndLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "end_to_end_latency_seconds",
+			Help:      "Time from the timestamp of the Kafka message (when the event was received) to its successful delivery.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"destination"}),
+		batchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "delivery_batch_size",
+			Help:      "Messages sent to a destination with a single call, by the consumers that deliver batches.",
+			Buckets:   []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}, []string{"destination"}),
+	}
+
+	m.Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.ingestRequests,
+		m.produceDuration,
+		m.producedMessages,
+		m.deliveryAttempts,
+		m.attemptDuration,
+		m.deliveries,
+		m.retries,
+		m.destinationTimeouts,
+		m.commitFailures,
+		m.deadLetters,
+		m.deliveryErrors,
+		m.endToEndLatency,
+		m.batchSize,
+	)
+	return m
+}
+
+// exposition of the registry in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// status is the http status code of the REST API or the code of the gRPC API
+func (m *Metrics) IngestRequest(protocol string, route string, status string) {
+	if m == nil {
+		return
+	}
+	m.ingestRequests.WithLabelValues(protocol, route, status).Inc()
+}
+
+func (m *Metrics) Produced(duration time.Duration, messages int, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.produceDuration.WithLabelValues(result).Observe(duration.Seconds())
+	m.producedMessages.WithLabelValues(result).Add(float64(messages))
+}
+
+// a call of the destination, outcome is one of AttemptSuccess, AttemptError or AttemptTimeout
+func (m *Metrics) DeliveryAttempt(destination string, duration time.Duration, outcome string) {
+	if m == nil {
+		return
+	}
+	m.deliveryAttempts.WithLabelValues(destination, outcome).Inc()
+	m.attemptDuration.WithLabelValues(destination).Observe(duration.Seconds())
+	if outcome == AttemptTimeout {
+		m.destinationTimeouts.WithLabelValues(destination).Inc()
+	}
+}
+
+/*
+The delivery of a message after all its attempts, outcome is one of DeliveryDelivered, DeliveryFailed or
+DeliveryAborted. The end-to-end latency is observed for delivered messages with a timestamp.
+*/
+func (m *Metrics) Delivery(destination string, attempts int, outcome string, timestamp time.Time) {
+	if m == nil {
+		return
+	}
+	m.deliveries.WithLabelValues(destination, outcome).Inc()
+	if attempts > 1 {
+		m.retries.WithLabelValues(destination).Add(float64(attempts - 1))
+	}
+	if outcome == DeliveryDelivered && !timestamp.IsZero() {
+		m.endToEndLatency.WithLabelValues(destination).Observe(time.Since(timestamp).Seconds())
+	}
+}
+
+func (m *Metrics) CommitFailed(destination string) {
+	if m == nil {
+		return
+	}
+	m.commitFailures.WithLabelValues(destination).Inc()
+}
+
+func (m *Metrics) DeadLettered(destination string) {
+	if m == nil {
+		return
+	}
+	m.deadLetters.WithLabelValues(destination).Inc()
+}
+
+// a failed attempt, class is one of the classes of delivery.Classify
+func (m *Metrics) DeliveryError(destination string, class string) {
+	if m == nil {
+		return
+	}
+	m.deliveryErrors.WithLabelValues(destination, class).Inc()
+}
+
+// a call of the destination with a batch of messages, attempts of a batch and of its failed subsets too
+func (m *Metrics) DeliveryBatch(destination string, size int) {
+	if m == nil {
+		return
+	}
+	m.batchSize.WithLabelValues(destination).Observe(float64(size))
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDeliveryMetricsPerDestination(t *testing.T) {
+	m := Metrics{}.New()
+	m.DeliveryAttempt("postgres", 10*time.Millisecond, AttemptError)
+	m.DeliveryAttempt("postgres", 1*time.Second, AttemptTimeout)
+	m.DeliveryAttempt("postgres", 10*time.Millisecond, AttemptSuccess)
+	m.Delivery("postgres", 3, DeliveryDelivered, time.Now().Add(-2*time.Second))
+	m.DeliveryAttempt("bigquery", 10*time.Millisecond, AttemptSuccess)
+	m.Delivery("bigquery", 1, DeliveryDelivered, time.Time{})
+	m.Delivery("bigquery", 4, DeliveryFailed, time.Now())
+	m.CommitFailed("bigquery")
+	m.DeadLettered("bigquery")
+	m.DeliveryError("bigquery", "permanent")
+	m.DeliveryBatch("bigquery", 100)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.deliveryAttempts.WithLabelValues("postgres", AttemptError)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.deliveryAttempts.WithLabelValues("postgres", AttemptTimeout)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.destinationTimeouts.WithLabelValues("postgres")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.destinationTimeouts.WithLabelValues("bigquery")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.retries.WithLabelValues("postgres")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.retries.WithLabelValues("bigquery")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.deliveries.WithLabelValues("bigquery", DeliveryFailed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.commitFailures.WithLabelValues("bigquery")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.deadLetters.WithLabelValues("bigquery")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.deliveryErrors.WithLabelValues("bigquery", "permanent")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.batchSize))
+
+	// end-to-end latency only of delivered messages with a timestamp
+	families, err := m.Registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != "event_delivery_end_to_end_latency_seconds" {
+			continue
+		}
+		assert.Equal(t, 1, len(family.GetMetric()))
+		histogram := family.GetMetric()[0].GetHistogram()
+		assert.Equal(t, uint64(1), histogram.GetSampleCount())
+		assert.True(t, histogram.GetSampleSum() >= 2)
+	}
+}
+
+func TestProducedAndNilMetrics(t *testing.T) {
+	m := Metrics{}.New()
+	m.Produced(5*time.Millisecond, 3, nil)
+	m.Produced(5*time.Millisecond, 2, errors.New("leader not available"))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.producedMessages.WithLabelValues("success")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.producedMessages.WithLabelValues("error")))
+
+	// components without metrics call them on nil
+	var disabled *Metrics
+	disabled.IngestRequest("http", "/events", "200")
+	disabled.Produced(5*time.Millisecond, 1, nil)
+	disabled.DeliveryAttempt("postgres", 10*time.Millisecond, AttemptSuccess)
+	disabled.Delivery("postgres", 1, DeliveryDelivered, time.Now())
+	disabled.CommitFailed("postgres")
+	disabled.DeadLettered("postgres")
+	disabled.DeliveryError("postgres", "retryable")
+	disabled.DeliveryBatch("postgres", 10)
+}
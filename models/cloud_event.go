@@ -0,0 +1,263 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const CloudEventsSpecVersion = "1.0"
+
+var extensionNamePattern = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// attributes of the spec, every other attribute of a structured event is an extension
+var cloudEventAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "subject": true, "time": true,
+	"datacontenttype": true, "dataschema": true, "data": true, "data_base64": true,
+}
+
+/*
+CloudEvent 1.0 in the structured json format (https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/formats/json-format.md).
+Data holds json data, DataBase64 binary data. Extensions are kept as strings, like in the Kafka and HTTP bindings.
+*/
+type CloudEvent struct {
+	SpecVersion     string
+	ID              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	DataSchema      string
+	Data            json.RawMessage
+	DataBase64      string
+	Extensions      map[string]string
+}
+
+func (event CloudEvent) MarshalJSON() ([]byte, error) {
+	object := map[string]interface{}{
+		"specversion": event.SpecVersion,
+		"id":          event.ID,
+		"source":      event.Source,
+		"type":        event.Type,
+	}
+	optional := map[string]string{
+		"subject":         event.Subject,
+		"datacontenttype": event.DataContentType,
+		"dataschema":      event.DataSchema,
+		"data_base64":     event.DataBase64,
+	}
+	for name, value := range optional {
+		if value != "" {
+			object[name] = value
+		}
+	}
+	if !event.Time.IsZero() {
+		object["time"] = event.Time.Format(time.RFC3339Nano)
+	}
+	if len(event.Data) > 0 {
+		object["data"] = event.Data
+	}
+	for name, value := range event.Extensions {
+		if !cloudEventAttributes[name] {
+			object[name] = value
+		}
+	}
+	return json.Marshal(object)
+}
+
+func (event *CloudEvent) UnmarshalJSON(data []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+
+	*event = CloudEvent{}
+	for name, value := range object {
+		switch name {
+		case "data":
+			if !bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+				event.Data = value
+			}
+			continue
+		case "time":
+			var timestamp string
+			if err := json.Unmarshal(value, &timestamp); err != nil {
+				return fmt.Errorf("cloudevent attribute time should be a string: %v", err)
+			}
+			parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+			if err != nil {
+				return fmt.Errorf("cloudevent attribute time should be RFC 3339: %v", err)
+			}
+			event.Time = parsed
+			continue
+		}
+
+		attribute, err := attributeString(value)
+		if err != nil {
+			return fmt.Errorf("cloudevent attribute %s: %v", name, err)
+		}
+		switch name {
+		case "specversion":
+			event.SpecVersion = attribute
+		case "id":
+			event.ID = attribute
+		case "source":
+			event.Source = attribute
+		case "type":
+			event.Type = attribute
+		case "subject":
+			event.Subject = attribute
+		case "datacontenttype":
+			event.DataContentType = attribute
+		case "dataschema":
+			event.DataSchema = attribute
+		case "data_base64":
+			event.DataBase64 = attribute
+		default:
+			if event.Extensions == nil {
+				event.Extensions = map[string]string{}
+			}
+			event.Extensions[name] = attribute
+		}
+	}
+	return nil
+}
+
+// extensions can be strings, numbers or booleans, they are all kept as their string representation
+func attributeString(value json.RawMessage) (string, error) {
+	var attribute interface{}
+	if err := json.Unmarshal(value, &attribute); err != nil {
+		return "", err
+	}
+	switch typed := attribute.(type) {
+	case string:
+		return typed, nil
+	case float64, bool:
+		return strings.TrimSpace(string(value)), nil
+	default:
+		return "", errors.New("should be a string, number or boolean")
+	}
+}
+
+// checks the required attributes and the names of the extensions
+func (event CloudEvent) Validate() error {
+	if event.SpecVersion != CloudEventsSpecVersion {
+		return fmt.Errorf("cloudevent specversion should be %s, but got '%s'", CloudEventsSpecVersion, event.SpecVersion)
+	}
+	for name, value := range map[string]string{"id": event.ID, "source": event.Source, "type": event.Type} {
+		if value == "" {
+			return fmt.Errorf("cloudevent attribute %s should be provided", name)
+		}
+	}
+	if len(event.Data) > 0 && event.DataBase64 != "" {
+		return errors.New("cloudevent should not have both data and data_base64")
+	}
+	for name := range event.Extensions {
+		if !extensionNamePattern.MatchString(name) {
+			return fmt.Errorf("cloudevent extension name %s should have only lower-case letters and digits", name)
+		}
+	}
+	return nil
+}
+
+// data of the event as it is sent with the binary mode of the bindings (decoded data_base64, or the json data)
+func (event CloudEvent) DataBytes() ([]byte, error) {
+	if event.DataBase64 != "" {
+		return base64.StdEncoding.DecodeString(event.DataBase64)
+	}
+	return event.Data, nil
+}
+
+/*
+Maps the CloudEvent onto an Event. The user id, which is the key of the Kafka message, is the partitionkey extension
+(https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/extensions/partitioning.md) or the subject.
+*/
+func (event CloudEvent) ToEvent() (*Event, error) {
+	if err := event.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := event.DataBytes()
+	if err != nil {
+		return nil, fmt.Errorf("cloudevent data_base64 is not valid base64: %v", err)
+	}
+
+	userID := event.Extensions["partitionkey"]
+	if userID == "" {
+		userID = event.Subject
+	}
+	if userID == "" {
+		return nil, errors.New("cloudevent extension partitionkey or attribute subject should be provided, it is the user id of the event")
+	}
+	return &Event{
+		UserID:          userID,
+		Payload:         string(data),
+		EventID:         event.ID,
+		EventType:       event.Type,
+		SchemaVersion:   event.Extensions["schemaversion"],
+		Source:          event.Source,
+		ClientTimestamp: event.Time,
+		SpecVersion:     event.SpecVersion,
+		Subject:         event.Subject,
+		DataContentType: event.DataContentType,
+		DataSchema:      event.DataSchema,
+		Extensions:      event.Extensions,
+	}, nil
+}
+
+/*
+Maps an Event onto a CloudEvent. Events that were not sent as CloudEvents get the defaults of the arguments for the
+required attributes they miss. The payload is json data when it is valid json of a json content type (or of events
+without content type), a json string when it is other text and data_base64 otherwise.
+*/
+func (event Event) ToCloudEvent(defaultID string, defaultSource string, defaultType string) CloudEvent {
+	cloudEvent := CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              event.EventID,
+		Source:          event.Source,
+		Type:            event.EventType,
+		Subject:         event.Subject,
+		Time:            event.ClientTimestamp,
+		DataContentType: event.DataContentType,
+		DataSchema:      event.DataSchema,
+		Extensions:      map[string]string{},
+	}
+	for name, value := range event.Extensions {
+		cloudEvent.Extensions[name] = value
+	}
+	if cloudEvent.ID == "" {
+		cloudEvent.ID = defaultID
+	}
+	if cloudEvent.Source == "" {
+		cloudEvent.Source = defaultSource
+	}
+	if cloudEvent.Type == "" {
+		cloudEvent.Type = defaultType
+	}
+	if cloudEvent.Extensions["partitionkey"] == "" && event.UserID != event.Subject {
+		cloudEvent.Extensions["partitionkey"] = event.UserID
+	}
+	if event.SchemaVersion != "" {
+		cloudEvent.Extensions["schemaversion"] = event.SchemaVersion
+	}
+
+	payload := []byte(event.Payload)
+	isJSONContent := event.DataContentType == "" || strings.Contains(event.DataContentType, "json")
+	switch {
+	case isJSONContent && json.Valid(payload):
+		cloudEvent.Data = payload
+	case isJSONContent && utf8.Valid(payload):
+		cloudEvent.Data, _ = json.Marshal(event.Payload)
+	case utf8.Valid(payload) && strings.HasPrefix(event.DataContentType, "text/"):
+		cloudEvent.Data, _ = json.Marshal(event.Payload)
+	default:
+		cloudEvent.DataBase64 = base64.StdEncoding.EncodeToString(payload)
+	}
+	return cloudEvent
+}
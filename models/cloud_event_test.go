@@ -0,0 +1,55 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCloudEventDeserialization(t *testing.T) {
+	eventBytes := []byte(`{"specversion": "1.0", "id": "event_1", "source": "/web", "type": "click.v1", "subject": "user_test_1", "time": "2022-07-01T10:00:00Z", "data": {"x": 1}, "sampled": true, "tenant": "acme"}`)
+	var cloudEvent CloudEvent
+	err := json.Unmarshal(eventBytes, &cloudEvent)
+	if err != nil {
+		t.Errorf("Can not deserialize json to struct")
+	}
+
+	assert.Equal(t, "event_1", cloudEvent.ID)
+	assert.Equal(t, time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC), cloudEvent.Time)
+	assert.Equal(t, `{"x": 1}`, string(cloudEvent.Data))
+	assert.Equal(t, map[string]string{"sampled": "true", "tenant": "acme"}, cloudEvent.Extensions)
+
+	event, err := cloudEvent.ToEvent()
+	assert.Nil(t, err)
+	assert.Equal(t, "user_test_1", event.UserID)
+	assert.Equal(t, `{"x": 1}`, event.Payload)
+	assert.Equal(t, "click.v1", event.EventType)
+}
+
+func TestEventToCloudEventSerialization(t *testing.T) {
+	cases := []struct {
+		event    Event
+		expected string
+	}{
+		{
+			event:    Event{UserID: "user_test_1", Payload: `{"x":1}`, EventType: "click"},
+			expected: `{"data":{"x":1},"id":"id_1","partitionkey":"user_test_1","source":"/app","specversion":"1.0","type":"click"}`,
+		},
+		{
+			event:    Event{UserID: "user_test_1", Payload: "event click !!!!"},
+			expected: `{"data":"event click !!!!","id":"id_1","partitionkey":"user_test_1","source":"/app","specversion":"1.0","type":"app.event"}`,
+		},
+		{
+			event:    Event{UserID: "user_test_1", Payload: "\xff\x00", Subject: "user_test_1", DataContentType: "application/octet-stream"},
+			expected: `{"data_base64":"/wA=","datacontenttype":"application/octet-stream","id":"id_1","source":"/app","specversion":"1.0","subject":"user_test_1","type":"app.event"}`,
+		},
+	}
+	for _, c := range cases {
+		cloudEvent := c.event.ToCloudEvent("id_1", "/app", "app.event")
+		assert.Nil(t, cloudEvent.Validate())
+		eventBytes, err := json.Marshal(cloudEvent)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, string(eventBytes))
+	}
+}
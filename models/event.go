@@ -1,10 +1,46 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
+/*
+Envelope of an event. The metadata is produced as Kafka message headers next to the payload and rebuilt by the
+consumers, so destinations receive the same envelope that was sent by the client.
+*/
 type Event struct {
-	UserID  string `json:"user_id"`
-	Payload string `json:"payload"`
+	UserID          string    `json:"user_id"`
+	Payload         string    `json:"payload"`
+	EventID         string    `json:"event_id,omitempty"`         // optional, set by clients to deduplicate retries
+	EventType       string    `json:"event_type,omitempty"`       // optional, payload is validated against the schema of this type
+	SchemaVersion   string    `json:"schema_version,omitempty"`   // optional, version of the payload schema of the event type
+	Source          string    `json:"source,omitempty"`           // optional, application or service that created the event
+	ClientTimestamp time.Time `json:"client_timestamp,omitempty"` // optional, when the event happened according to the client (RFC 3339)
+	ReceivedAt      time.Time `json:"-"`                          // set by the server when the event is accepted, timestamp of the Kafka message
+	Principal       string    `json:"-"`                          // set by the server from the authenticated client, never by clients
+
+	// set only for events received as CloudEvents, see CloudEvent.ToEvent
+	SpecVersion     string            `json:"-"`
+	Subject         string            `json:"-"`
+	DataContentType string            `json:"-"`
+	DataSchema      string            `json:"-"`
+	Extensions      map[string]string `json:"-"`
 }
 
 func (Event) New(userId string, payload string) *Event {
-	return &Event{userId, payload}
-}
\ No newline at end of file
+	return &Event{UserID: userId, Payload: payload}
+}
+
+// omitempty never leaves out a time.Time, so a zero ClientTimestamp (not sent by the client) is left out here
+func (event Event) MarshalJSON() ([]byte, error) {
+	type envelope Event
+	var clientTimestamp *time.Time
+	if !event.ClientTimestamp.IsZero() {
+		clientTimestamp = &event.ClientTimestamp
+	}
+	return json.Marshal(struct {
+		envelope
+		ClientTimestamp *time.Time `json:"client_timestamp,omitempty"`
+	}{envelope: envelope(event), ClientTimestamp: clientTimestamp})
+}
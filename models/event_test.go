@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"testing"
+	"time"
 )
 
 func TestEventDeserialization(t *testing.T) {
@@ -17,4 +18,30 @@ func TestEventDeserialization(t *testing.T) {
 
 	assert.Equal(t, "user_test_1", event.UserID)
 	assert.Equal(t, "event click !!!!", event.Payload)
-}
\ No newline at end of file
+}
+
+func TestEventEnvelopeDeserialization(t *testing.T) {
+	eventBytes := []byte(`{"user_id": "user_test_1", "payload": "event click !!!!", "event_id": "event_1", "event_type": "click", "schema_version": "2", "source": "web", "client_timestamp": "2022-07-01T10:00:00Z", "principal": "spoofed"}`)
+	var event Event
+	err := json.Unmarshal(eventBytes, &event)
+	if err != nil {
+		t.Errorf("Can not deserialize json to struct")
+	}
+
+	assert.Equal(t, "event_1", event.EventID)
+	assert.Equal(t, "click", event.EventType)
+	assert.Equal(t, "2", event.SchemaVersion)
+	assert.Equal(t, "web", event.Source)
+	assert.Equal(t, time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC), event.ClientTimestamp)
+	assert.Equal(t, "", event.Principal)
+}
+
+func TestEventSerializationWithoutClientTimestamp(t *testing.T) {
+	eventBytes, err := json.Marshal(Event{UserID: "user_test_1", Payload: "event click !!!!"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user_id":"user_test_1","payload":"event click !!!!"}`, string(eventBytes))
+
+	eventBytes, err = json.Marshal(Event{UserID: "user_test_1", Payload: "event click !!!!", ClientTimestamp: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user_id":"user_test_1","payload":"event click !!!!","client_timestamp":"2022-07-01T10:00:00Z"}`, string(eventBytes))
+}
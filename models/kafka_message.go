@@ -3,9 +3,23 @@ package models
 import "time"
 
 type KafkaMessage struct {
-	Key       string
-	Value     string
-	Timestamp time.Time
+	Key             string
+	Value           string
+	Timestamp       time.Time
+	EventID         string // optional, also used to track the delivery of the message to Kafka
+	EventType       string
+	SchemaVersion   string
+	Source          string
+	ClientTimestamp time.Time
+	Principal       string            // authenticated client that sent the event, empty when authentication is disabled
+	TraceContext    map[string]string // W3C trace context of the request, the span of the producer is its child
+
+	// set only for events received as CloudEvents, which are produced with the Kafka protocol binding of CloudEvents
+	SpecVersion     string
+	Subject         string
+	DataContentType string
+	DataSchema      string
+	Extensions      map[string]string
 }
 
 func (KafkaMessage) New(key string, value string, timestamp time.Time) *KafkaMessage {
@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+
+	instrumentationName = "event-delivery-kafka"
+	defaultOTLPEndpoint = "localhost:4317"
+)
+
+type Config struct {
+	Exporter     string    // "none" (default), "stdout" or "otlp"
+	ServiceName  string    // service.name of the spans, event-delivery-kafka when empty
+	OTLPEndpoint string    // host:port of the OTLP gRPC receiver, localhost:4317 when empty
+	OTLPInsecure bool      // plain text connection to the OTLP receiver, like a local collector
+	SampleRatio  float64   // ratio of the traces started by the app that are sampled, 1 when 0. Remote parents decide for their traces
+	Writer       io.Writer // output of the stdout exporter, os.Stdout when nil
+}
+
+/*
+Registers the global tracer provider and the W3C trace context propagator, used by the REST API, the producer and
+the consumers. With exporter "none" only the propagator is registered, so spans are not recorded but the trace
+context of the clients is still carried through Kafka to the destinations.
+*/
+type Provider struct {
+	provider *sdktrace.TracerProvider // nil with exporter "none"
+}
+
+func (Provider) New(config Config) (*Provider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newExporter(config)
+	if err != nil || exporter == nil {
+		return &Provider{}, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = instrumentationName
+	}
+	sampleRatio := config.SampleRatio
+	if sampleRatio <= 0 {
+		sampleRatio = 1
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	}
+	if config.Exporter == ExporterStdout {
+		// every span is written when it ends, so they can be followed locally
+		options = append(options, sdktrace.WithSyncer(exporter))
+	} else {
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	return &Provider{provider: provider}, nil
+}
+
+func newExporter(config Config) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterStdout:
+		writer := config.Writer
+		if writer == nil {
+			writer = os.Stdout
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(writer))
+	case ExporterOTLP:
+		endpoint := config.OTLPEndpoint
+		if endpoint == "" {
+			endpoint = defaultOTLPEndpoint
+		}
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+		if config.OTLPInsecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", config.Exporter)
+	}
+}
+
+// exports the spans that are not exported yet, up to the deadline of ctx
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.provider == nil {
+		return nil
+	}
+	if err := p.provider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shutdown tracer provider: %w", err)
+	}
+	return nil
+}
+
+/*
+Tracer of the app, from the global tracer provider. It is looked up on every call, so the spans of the components
+follow the provider registered last (tests register their own).
+*/
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// ends the span, with status error when err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"testing"
+)
+
+func TestStdoutExporterWritesEndedSpans(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	var output bytes.Buffer
+	provider, err := Provider{}.New(Config{Exporter: ExporterStdout, Writer: &output})
+	assert.Nil(t, err)
+
+	ctx, parent := Tracer().Start(context.Background(), "ingest")
+	_, child := Tracer().Start(ctx, "event-log send")
+	End(child, errors.New("leader not available"))
+	End(parent, nil)
+	assert.Nil(t, provider.Shutdown(context.Background()))
+
+	assert.Contains(t, output.String(), `"Name":"ingest"`)
+	assert.Contains(t, output.String(), `"Name":"event-log send"`)
+	assert.Contains(t, output.String(), "leader not available")
+	assert.Contains(t, output.String(), parent.SpanContext().TraceID().String())
+}
+
+func TestWithoutExporterTraceContextIsPropagated(t *testing.T) {
+	provider, err := Provider{}.New(Config{Exporter: ExporterNone})
+	assert.Nil(t, err)
+	assert.Nil(t, provider.Shutdown(context.Background()))
+
+	carrier := propagation.MapCarrier{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+	ctx, span := Tracer().Start(ctx, "ingest")
+	defer span.End()
+
+	injected := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, injected)
+	assert.Contains(t, injected["traceparent"], "4bf92f3577b34da6a3ce929d0e0e4736")
+}
+
+func TestUnknownExporter(t *testing.T) {
+	_, err := Provider{}.New(Config{Exporter: "jaeger"})
+	assert.EqualError(t, err, "unknown tracing exporter jaeger")
+}